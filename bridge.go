@@ -9,30 +9,113 @@ package main
 // TODO(gsasha): docker
 // TODO(gsasha): use go mod.
 // TODO(gsasha): tests
-// TODO(gsasha): export availability on mqtt
-// TODO(gsasha): export health status on http
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
 	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/loader"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models"
+	_ "github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models/coolmasternet"
+	_ "github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models/daikin"
+	_ "github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models/gree"
+	_ "github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models/midea"
+	_ "github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models/samsung"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-var configFile = flag.String("config_file", "config.yaml", "configuration file")
+var (
+	configFile      = flag.String("config_file", "config.yaml", "configuration file")
+	shutdownTimeout = flag.Duration("shutdown_timeout", 10*time.Second, "maximum time to shut down cleanly")
+)
 
 func main() {
-	log.Printf("HVAC IP to MQTT Bridge starting up.")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "get-token":
+			getToken(os.Args[2:])
+			return
+		case "discover":
+			discover(os.Args[2:])
+			return
+		}
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s get-token [flags]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s discover [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "Supported models: %s\n", strings.Join(models.Models(), ", "))
+	}
 	flag.Parse()
-	devices, err := loader.Load(*configFile)
+	runBridge()
+}
+
+func runBridge() {
+	log.Printf("HVAC IP to MQTT Bridge starting up.")
+	bridge, err := loader.Load(*configFile)
 	if err != nil {
 		log.Fatalf("Loading failed: %s", err)
 	}
 	log.Printf("Running configured devices")
-	for _, device := range devices {
-		device.Run()
+	bridge.Run()
+
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status := make(map[string]base.ConnectionState)
+		for _, device := range bridge.Devices {
+			status[device.Name()] = device.ConnectionState()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+	http.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		type deviceState struct {
+			State        base.State        `json:"state"`
+			Capabilities base.Capabilities `json:"capabilities"`
+		}
+		state := make(map[string]deviceState)
+		for _, device := range bridge.Devices {
+			state[device.Name()] = deviceState{
+				State:        device.Snapshot(),
+				Capabilities: device.Capabilities(),
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	})
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		log.Printf("Listening to HTTP port")
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("HTTP server failed: %s", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %s, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		server.Shutdown(ctx)
+		bridge.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Printf("Shutdown complete")
+	case <-ctx.Done():
+		log.Fatalf("Shutdown did not complete within %s", *shutdownTimeout)
 	}
-	log.Printf("Listening to HTTP port")
-	http.ListenAndServe(":8080", nil)
-	log.Printf("Done ListenAndServe")
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	yaml "github.com/goccy/go-yaml"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models/midea"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models/samsung"
+	"log"
+	"strings"
+	"time"
+)
+
+// discover runs the discover subcommand, which searches the local network
+// for Samsung and Midea units and prints a configuration entry for each of
+// them.
+func discover(args []string) {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for units to answer")
+	flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	log.Printf("Searching for units for %s", *timeout)
+	var mideaFound []midea.DiscoveredDevice
+	var mideaErr error
+	mideaDone := make(chan struct{})
+	go func() {
+		defer close(mideaDone)
+		mideaFound, mideaErr = midea.Discover(ctx)
+	}()
+	found, err := samsung.Discover(ctx)
+	if err != nil {
+		log.Fatalf("Discovery failed: %s", err)
+	}
+	<-mideaDone
+	if mideaErr != nil {
+		log.Printf("Midea discovery failed: %s", mideaErr)
+	}
+	if len(found) == 0 && len(mideaFound) == 0 {
+		fmt.Println("No units found.")
+		return
+	}
+
+	var devices []yaml.MapSlice
+	for _, device := range found {
+		name := "samsung_" + strings.ToLower(device.DUID)
+		devices = append(devices, yaml.MapSlice{
+			{Key: "name", Value: name},
+			{Key: "model", Value: "samsungac2878"},
+			{Key: "host", Value: device.Host},
+			{Key: "mqtt_prefix", Value: "hvac/" + name},
+			{Key: "duid", Value: device.DUID},
+			{Key: "auth_token", Value: ""},
+		})
+		log.Printf("Found %s at %s (model %s %s)", device.DUID, device.Host, device.Model, device.Nickname)
+	}
+	for _, device := range mideaFound {
+		if device.Type != "" && device.Type != "ac" {
+			log.Printf("Skipping Midea %s appliance %s at %s", device.Type, device.ID, device.Host)
+			continue
+		}
+		name := "midea_" + device.ID
+		entry := yaml.MapSlice{
+			{Key: "name", Value: name},
+			{Key: "model", Value: "midea"},
+			{Key: "host", Value: device.Host},
+			{Key: "mqtt_prefix", Value: "hvac/" + name},
+			{Key: "duid", Value: device.ID},
+		}
+		if device.Version == 3 {
+			entry = append(entry, yaml.MapItem{Key: "token", Value: ""}, yaml.MapItem{Key: "key", Value: ""})
+		}
+		devices = append(devices, entry)
+		log.Printf("Found Midea %s at %s (version %d, serial number %s)", device.ID, device.Host, device.Version, device.SerialNumber)
+	}
+	block, err := yaml.Marshal(map[string]interface{}{"devices": devices})
+	if err != nil {
+		log.Fatalf("Cannot format configuration: %s", err)
+	}
+	fmt.Printf("%s\n", block)
+	if len(found) > 0 {
+		fmt.Println("Run get-token for each Samsung unit to fill in its auth_token.")
+	}
+	if len(mideaFound) > 0 {
+		fmt.Println("Midea units of version 3 also need the token and key from the Midea cloud.")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	yaml "github.com/goccy/go-yaml"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/loader"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models/samsung"
+	"log"
+	"os"
+	"time"
+)
+
+// getToken runs the get-token subcommand, which obtains an auth_token from a
+// Samsung unit and prints or writes the corresponding device configuration.
+func getToken(args []string) {
+	flags := flag.NewFlagSet("get-token", flag.ExitOnError)
+	host := flags.String("host", "", "address of the air conditioner")
+	port := flags.String("port", "2878", "port of the air conditioner")
+	name := flags.String("name", "my_ac", "device name in the configuration")
+	mqttPrefix := flags.String("mqtt_prefix", "", "MQTT prefix of the device (default hvac/<name>)")
+	duid := flags.String("duid", "", "DUID (MAC address) of the air conditioner")
+	certFile := flags.String("cert_file", "", "client certificate required by some units")
+	keyFile := flags.String("key_file", "", "client certificate key, if not in cert_file")
+	timeout := flags.Duration("timeout", 2*time.Minute, "how long to wait for the token")
+	write := flags.String("write", "", "configuration file to add the device to")
+	flags.Parse(args)
+	if *host == "" {
+		fmt.Fprintln(os.Stderr, "get-token: -host is required")
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *mqttPrefix == "" {
+		*mqttPrefix = "hvac/" + *name
+	}
+
+	options := base.ConnectionOptions{
+		TLS: base.TLSOptions{
+			CertFile: *certFile,
+			KeyFile:  *keyFile,
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	log.Printf("Requesting token from %s:%s", *host, *port)
+	token, err := samsung.GetToken(ctx, *host, *port, options, func() {
+		fmt.Println("The unit is waiting: power it on with the remote control now.")
+	})
+	if err != nil {
+		log.Fatalf("Getting token failed: %s", err)
+	}
+
+	values := yaml.MapSlice{
+		{Key: "model", Value: "samsungac2878"},
+		{Key: "host", Value: *host},
+	}
+	if *port != "2878" {
+		values = append(values, yaml.MapItem{Key: "port", Value: *port})
+	}
+	values = append(values, yaml.MapItem{Key: "mqtt_prefix", Value: *mqttPrefix})
+	if *duid != "" {
+		values = append(values, yaml.MapItem{Key: "duid", Value: *duid})
+	}
+	values = append(values, yaml.MapItem{Key: "auth_token", Value: token})
+	if *certFile != "" {
+		tls := yaml.MapSlice{{Key: "cert_file", Value: *certFile}}
+		if *keyFile != "" {
+			tls = append(tls, yaml.MapItem{Key: "key_file", Value: *keyFile})
+		}
+		values = append(values, yaml.MapItem{Key: "tls", Value: tls})
+	}
+
+	if *write != "" {
+		if err := loader.UpdateDeviceConfig(*write, *name, values); err != nil {
+			log.Fatalf("Writing configuration failed: %s", err)
+		}
+		log.Printf("Device %s written to %s", *name, *write)
+		return
+	}
+	block, err := yaml.Marshal(map[string]interface{}{
+		"devices": []yaml.MapSlice{append(yaml.MapSlice{{Key: "name", Value: *name}}, values...)},
+	})
+	if err != nil {
+		log.Fatalf("Cannot format configuration: %s", err)
+	}
+	fmt.Printf("Got token %s. Device configuration:\n\n%s", token, block)
+	if *duid == "" {
+		fmt.Println("\nAdd the unit's duid (its MAC address without separators).")
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/gsasha/hvac_ip_mqtt_bridge
 
-go 1.12
+go 1.15
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.3.2
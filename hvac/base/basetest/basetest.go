@@ -0,0 +1,17 @@
+// Package basetest holds helpers for testing drivers.
+package basetest
+
+import (
+	"net"
+	"testing"
+)
+
+// HostPort returns the host and port of the address a fake device listens on.
+func HostPort(t testing.TB, address net.Addr) (host, port string) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port
+}
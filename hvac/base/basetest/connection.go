@@ -0,0 +1,117 @@
+package basetest
+
+import (
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"sync"
+)
+
+// Connection is a fake base.Connection recording the messages sent. If
+// Answer is set, Connect establishes it and delivers Greeting and then the
+// answers to the messages sent from a message loop of its own, as a real
+// connection does. Otherwise tests deliver the messages with Deliver.
+type Connection struct {
+	// Greeting is sent by the device once connected.
+	Greeting []string
+	// Answer returns the messages answering a message sent.
+	Answer func(message string) []string
+
+	mutex    sync.Mutex
+	receiver base.Receiver
+	sent     []string
+	// expectedReads counts the calls to ExpectRead.
+	expectedReads int
+	// requests queues the messages sent for the message loop. It is nil
+	// while not connected.
+	requests chan string
+	done     chan struct{}
+}
+
+func (c *Connection) Connect(host, port string, receiver base.Receiver) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.receiver = receiver
+	if c.Answer == nil {
+		return
+	}
+	c.requests = make(chan string, 1000)
+	c.done = make(chan struct{})
+	go c.messageLoop(receiver, c.requests, c.done)
+}
+
+func (c *Connection) messageLoop(receiver base.Receiver, requests chan string, done chan struct{}) {
+	defer close(done)
+	receiver.OnConnectionEstablished()
+	for _, message := range c.Greeting {
+		receiver.HandleMessage([]byte(message))
+	}
+	for request := range requests {
+		for _, message := range c.Answer(request) {
+			receiver.HandleMessage([]byte(message))
+		}
+	}
+}
+
+func (c *Connection) ExpectRead() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.expectedReads++
+}
+
+func (c *Connection) SendMessage(message []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sent = append(c.sent, string(message))
+	if c.requests != nil {
+		c.requests <- string(message)
+	}
+	return nil
+}
+
+func (c *Connection) State() base.ConnectionState {
+	return base.ConnectionState{Connected: true}
+}
+
+func (c *Connection) Close() {
+	c.mutex.Lock()
+	requests, done := c.requests, c.done
+	c.requests, c.done = nil, nil
+	c.mutex.Unlock()
+	if requests == nil {
+		return
+	}
+	close(requests)
+	<-done
+}
+
+// Sent returns the messages sent.
+func (c *Connection) Sent() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.sent...)
+}
+
+// TakeSent returns the messages sent since the last call.
+func (c *Connection) TakeSent() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sent := c.sent
+	c.sent = nil
+	return sent
+}
+
+// ExpectedReads returns the number of calls to ExpectRead.
+func (c *Connection) ExpectedReads() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.expectedReads
+}
+
+// Deliver hands the messages to the receiver, as the message loop would.
+func (c *Connection) Deliver(messages ...string) {
+	c.mutex.Lock()
+	receiver := c.receiver
+	c.mutex.Unlock()
+	for _, message := range messages {
+		receiver.HandleMessage([]byte(message))
+	}
+}
@@ -0,0 +1,87 @@
+package basetest
+
+import (
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Recorder is a StateNotifier keeping what it was notified of.
+type Recorder struct {
+	mutex        sync.Mutex
+	states       []base.State
+	availability []bool
+	results      []base.CommandResult
+}
+
+// NewRecorder returns a Recorder notified by the controller.
+func NewRecorder(controller base.Controller) *Recorder {
+	r := &Recorder{}
+	controller.SetStateNotifier(r)
+	return r
+}
+
+func (r *Recorder) UpdateState(state base.State) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.states = append(r.states, state)
+}
+
+func (r *Recorder) UpdateAvailability(online bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.availability = append(r.availability, online)
+}
+
+func (r *Recorder) UpdateCommandResult(result base.CommandResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.results = append(r.results, result)
+}
+
+func (r *Recorder) States() []base.State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]base.State(nil), r.states...)
+}
+
+func (r *Recorder) Availability() []bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]bool(nil), r.availability...)
+}
+
+func (r *Recorder) Results() []base.CommandResult {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]base.CommandResult(nil), r.results...)
+}
+
+// WaitFor waits until there are n states and results, returning the last.
+func (r *Recorder) WaitFor(t testing.TB, states, results int) (base.State, base.CommandResult) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mutex.Lock()
+		if len(r.states) >= states && len(r.results) >= results {
+			defer r.mutex.Unlock()
+			var state base.State
+			var result base.CommandResult
+			if states > 0 {
+				state = r.states[states-1]
+			}
+			if results > 0 {
+				result = r.results[results-1]
+			}
+			return state, result
+		}
+		r.mutex.Unlock()
+		if time.Now().After(deadline) {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			t.Fatalf("got %d states and %d results, want %d and %d", len(r.states), len(r.results), states, results)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,91 @@
+package base
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Capabilities describes the settings supported by a unit. Empty lists mean
+// the setting is not supported.
+type Capabilities struct {
+	Modes       []Mode   `json:"modes"`
+	FanModes    []string `json:"fan_modes,omitempty"`
+	SwingModes  []string `json:"swing_modes,omitempty"`
+	PresetModes []string `json:"preset_modes,omitempty"`
+	// MinTemperature, MaxTemperature and TemperatureStep bound the setpoint.
+	// No range is enforced when MaxTemperature is zero.
+	MinTemperature  float64 `json:"min_temp"`
+	MaxTemperature  float64 `json:"max_temp"`
+	TemperatureStep float64 `json:"temp_step"`
+	// TemperatureUnit is "C" or "F" for units not following Home Assistant's
+	// unit system, or empty.
+	TemperatureUnit string `json:"temperature_unit,omitempty"`
+	// CurrentTemperature and Humidity tell whether the unit reports them.
+	CurrentTemperature bool `json:"current_temperature"`
+	Humidity           bool `json:"humidity"`
+}
+
+func (c Capabilities) CheckMode(mode Mode) error {
+	for _, supported := range c.Modes {
+		if mode == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported mode %q", mode)
+}
+
+// CheckFanMode returns the supported fan mode matching the value, ignoring case.
+func (c Capabilities) CheckFanMode(fanMode string) (string, error) {
+	return checkName("fan mode", fanMode, c.FanModes)
+}
+
+func (c Capabilities) CheckSwingMode(swingMode string) (string, error) {
+	return checkName("swing mode", swingMode, c.SwingModes)
+}
+
+// CheckPresetMode also accepts "none", which turns presets off.
+func (c Capabilities) CheckPresetMode(presetMode string) (string, error) {
+	if len(c.PresetModes) > 0 && strings.EqualFold(presetMode, "none") {
+		return "none", nil
+	}
+	return checkName("preset mode", presetMode, c.PresetModes)
+}
+
+func (c Capabilities) CheckTemperature(temperature float64) error {
+	if c.MaxTemperature == 0 {
+		return nil
+	}
+	if temperature < c.MinTemperature || temperature > c.MaxTemperature {
+		return fmt.Errorf("Temperature %s out of range %s-%s", formatFloat(temperature),
+			formatFloat(c.MinTemperature), formatFloat(c.MaxTemperature))
+	}
+	return nil
+}
+
+func checkName(setting, value string, supported []string) (string, error) {
+	for _, name := range supported {
+		if strings.EqualFold(value, name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("Unsupported %s %q", setting, value)
+}
+
+// capabilitiesOverride replaces the capabilities reported by a controller.
+type capabilitiesOverride struct {
+	Controller
+	capabilities Capabilities
+}
+
+func (c *capabilitiesOverride) Capabilities() Capabilities {
+	return c.capabilities
+}
+
+// OverrideCapabilities returns the controller with its capabilities replaced,
+// for units supporting less than their driver does.
+func OverrideCapabilities(controller Controller, capabilities Capabilities) Controller {
+	return &capabilitiesOverride{
+		Controller:   controller,
+		capabilities: capabilities,
+	}
+}
@@ -1,21 +1,84 @@
 package base
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"log"
+	"math/rand"
+	"net"
 	"sync"
 	"time"
 )
 
-const (
-	writeMaxDuration     = time.Second * 15
-	responseMaxDuration  = time.Second * 15
-	readMaxDuration      = time.Second * 15
-	connectionRetryDelay = time.Second * 30
-)
+// ConnectionOptions configures the timeouts and reconnection policy of a
+// Connection. Zero values are replaced by defaults.
+type ConnectionOptions struct {
+	DialTimeout time.Duration
+	// WriteTimeout bounds sending a message.
+	WriteTimeout time.Duration
+	// ResponseTimeout is how long to wait for a response to a sent message.
+	ResponseTimeout time.Duration
+	// ReadTimeout is how long to wait for an expected message.
+	ReadTimeout time.Duration
+	// RetryDelay is the delay after the first failed connection attempt. It is
+	// doubled after each further failure, up to MaxRetryDelay.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// TLS configures the handshake with the device.
+	TLS TLSOptions
+}
+
+// WithDefaults returns the options with zero values replaced by defaults.
+func (o ConnectionOptions) WithDefaults() ConnectionOptions {
+	setDefault := func(value *time.Duration, def time.Duration) {
+		if *value <= 0 {
+			*value = def
+		}
+	}
+	setDefault(&o.DialTimeout, time.Second*15)
+	setDefault(&o.WriteTimeout, time.Second*15)
+	setDefault(&o.ResponseTimeout, time.Second*15)
+	setDefault(&o.ReadTimeout, time.Second*15)
+	setDefault(&o.RetryDelay, time.Second*30)
+	setDefault(&o.MaxRetryDelay, time.Minute*5)
+	if o.MaxRetryDelay < o.RetryDelay {
+		o.MaxRetryDelay = o.RetryDelay
+	}
+	return o
+}
+
+// retryDelay returns the backoff before the next connection attempt after
+// the given number of consecutive failures, with jitter so that many
+// devices do not retry in lockstep.
+func (o ConnectionOptions) retryDelay(failures int) time.Duration {
+	delay := o.RetryDelay
+	for i := 1; i < failures && delay < o.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > o.MaxRetryDelay {
+		delay = o.MaxRetryDelay
+	}
+	// Pick uniformly from the upper half of the delay.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// ConnectionState reports the state of a connection and its retries.
+type ConnectionState struct {
+	Connected bool `json:"connected"`
+	// Failures is the number of failed attempts since the last connection.
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+	NextRetry time.Time `json:"next_retry"`
+}
+
+// ErrNotConnected is returned when sending a message while disconnected.
+var ErrNotConnected = errors.New("not connected")
 
 type Receiver interface {
 	OnConnectionEstablished()
+	// OnConnectionLost is called when an established connection fails.
+	OnConnectionLost()
 	HandleMessage(message []byte)
 }
 
@@ -25,111 +88,227 @@ type Connection interface {
 	// ExpectRead tells connection that a read is imminent, so it knows there is trouble if not received in time.
 	ExpectRead()
 	// SendMessage tells connection to send the given message.
-	SendMessage(message []byte)
+	SendMessage(message []byte) error
+	// State returns the current connection and retry state.
+	State() ConnectionState
+	// Close stops reconnecting and closes the connection, returning once the
+	// message loop has exited.
+	Close()
 }
 
-// TLSSocketConnection runs a persistent connection over TLS socket, trying to reconnect on failures.
-type TLSSocketConnection struct {
+// SocketConnection runs a persistent connection over a TCP or TLS socket, trying to reconnect on failures.
+type SocketConnection struct {
 	mutex    sync.Mutex
 	host     string
 	port     string
-	conn     *tls.Conn
+	conn     net.Conn
+	state    ConnectionState
 	receiver Receiver
+	options  ConnectionOptions
+	// config is nil on plain TCP connections.
+	config *tls.Config
+	// newFramer splits the data received on each connection into messages.
+	newFramer FramerFactory
+
+	// cancel stops the message loop started by Connect.
+	cancel context.CancelFunc
+	// done is closed when the message loop exits.
+	done chan struct{}
 }
 
-func NewTLSSocketConnection() Connection {
-	return &TLSSocketConnection{}
+func NewTLSSocketConnection(options ConnectionOptions, newFramer FramerFactory) (Connection, error) {
+	config, err := NewTLSConfig(options.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return &SocketConnection{
+		options:   options.WithDefaults(),
+		config:    config,
+		newFramer: newFramer,
+	}, nil
+}
+
+// NewTCPSocketConnection returns a connection over plain TCP, for devices
+// speaking an unencrypted protocol.
+func NewTCPSocketConnection(options ConnectionOptions, newFramer FramerFactory) Connection {
+	return &SocketConnection{
+		options:   options.WithDefaults(),
+		newFramer: newFramer,
+	}
 }
 
-func (c *TLSSocketConnection) Connect(host, port string, receiver Receiver) {
+func (c *SocketConnection) Connect(host, port string, receiver Receiver) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.host = host
 	c.port = port
 	c.receiver = receiver
-	go c.messageLoop()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go c.messageLoop(ctx, c.done)
+}
+
+func (c *SocketConnection) Close() {
+	c.mutex.Lock()
+	if c.cancel == nil {
+		c.mutex.Unlock()
+		return
+	}
+	// Cancelled before taking the connection, so that one being established
+	// now is either seen here or closed by connectionEstablished.
+	c.cancel()
+	conn, done := c.conn, c.done
+	c.mutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	<-done
 }
 
 // We know that a message should arrive. Will fail and retry connection if not.
-func (c *TLSSocketConnection) ExpectRead() {
-	c.conn.SetReadDeadline(time.Now().Add(readMaxDuration))
+func (c *SocketConnection) ExpectRead() {
+	if conn := c.getConnection(); conn != nil {
+		conn.SetReadDeadline(time.Now().Add(c.options.ReadTimeout))
+	}
+}
+
+func (c *SocketConnection) State() ConnectionState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state
 }
 
-// dialUntilConnected retries dialing the host, returning only after connection got established.
-func (c *TLSSocketConnection) dialUntilConnected() {
+// dialUntilConnected retries dialing the host, returning only after connection
+// got established. Returns false if the connection was closed meanwhile.
+func (c *SocketConnection) dialUntilConnected(ctx context.Context) bool {
 	c.resetConnection(nil)
 	for {
-		config := &tls.Config{
-    CipherSuites: []uint16{
-        tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-        tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-    },
-    PreferServerCipherSuites: true,
-   // InsecureSkipVerify:       true,
-    MinVersion:               tls.VersionTLS10,
-    MaxVersion:               tls.VersionTLS10,
-			ClientAuth:         tls.NoClientCert,
-			InsecureSkipVerify: true,
-		}
-		// TODO(gsasha): is there a need to time out Dial?
 		log.Printf("Dialing %s:%s", c.host, c.port)
-		conn, err := tls.Dial("tcp", c.host+":"+c.port, config)
+		conn, err := c.dial(ctx)
+		if ctx.Err() != nil {
+			return false
+		}
 		if err != nil {
-			log.Printf("Failed to connect to %s:%s : %s. Sleeping...", c.host, c.port, err)
-			time.Sleep(connectionRetryDelay)
+			delay := c.dialFailed(err)
+			log.Printf("Failed to connect to %s:%s : %s. Retrying in %s", c.host, c.port, err, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return false
+			}
 		} else {
 			log.Printf("Connected to %s:%s", c.host, c.port)
-			c.resetConnection(conn)
+			if !c.connectionEstablished(ctx, conn) {
+				return false
+			}
 			c.receiver.OnConnectionEstablished()
-			return
+			return true
 		}
 	}
 }
 
-func (c *TLSSocketConnection) resetConnection(conn *tls.Conn) {
+// dial opens a TLS connection, or a plain TCP one if there is no TLS
+// configuration.
+func (c *SocketConnection) dial(ctx context.Context) (net.Conn, error) {
+	netDialer := &net.Dialer{Timeout: c.options.DialTimeout}
+	address := net.JoinHostPort(c.host, c.port)
+	if c.config == nil {
+		return netDialer.DialContext(ctx, "tcp", address)
+	}
+	dialer := &tls.Dialer{
+		NetDialer: netDialer,
+		Config:    c.config,
+	}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// connectionEstablished installs a new connection, unless the connection was
+// closed while dialing.
+func (c *SocketConnection) connectionEstablished(ctx context.Context, conn net.Conn) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if ctx.Err() != nil {
+		conn.Close()
+		return false
+	}
+	c.conn = conn
+	c.state = ConnectionState{Connected: true}
+	return true
+}
+
+// dialFailed records a failed connection attempt, returning the delay
+// before the next one.
+func (c *SocketConnection) dialFailed(err error) time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.state.Failures++
+	c.state.LastError = err.Error()
+	delay := c.options.retryDelay(c.state.Failures)
+	c.state.NextRetry = time.Now().Add(delay)
+	return delay
+}
+
+func (c *SocketConnection) resetConnection(conn net.Conn) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	c.conn = conn
+	c.state.Connected = conn != nil
 }
 
-func (c *TLSSocketConnection) getConnection() *tls.Conn {
+func (c *SocketConnection) getConnection() net.Conn {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	return c.conn
 }
 
-func (c *TLSSocketConnection) messageLoop() {
+func (c *SocketConnection) messageLoop(ctx context.Context, done chan struct{}) {
+	defer close(done)
 	for {
-		c.dialUntilConnected()
+		if !c.dialUntilConnected(ctx) {
+			log.Printf("Connection to %s:%s closed", c.host, c.port)
+			return
+		}
+		conn := c.getConnection()
+		if conn == nil {
+			continue
+		}
+		framer := c.newFramer(conn)
 		for {
-			conn := c.getConnection()
-			if conn == nil {
-				break
-			}
-
-			buf := make([]byte, 16*1024)
-			n, err := conn.Read(buf)
+			message, err := framer.Next()
 			if err != nil {
-				log.Println("Error reading from tls socket: %d, %s", n, err)
+				log.Printf("Error reading from socket: %s", err)
+				c.resetConnection(nil)
+				conn.Close()
+				c.receiver.OnConnectionLost()
+				if ctx.Err() != nil {
+					log.Printf("Connection to %s:%s closed", c.host, c.port)
+					return
+				}
 				break
-			} else {
-				c.receiver.HandleMessage(buf[:n])
-				c.conn.SetReadDeadline(time.Time{})
 			}
+			// Cleared before handling, so that a read expected by the
+			// handler keeps its deadline.
+			conn.SetReadDeadline(time.Time{})
+			c.receiver.HandleMessage(message)
 		}
 	}
 }
 
-func (c *TLSSocketConnection) SendMessage(message []byte) {
+func (c *SocketConnection) SendMessage(message []byte) error {
 	conn := c.getConnection()
 	if conn == nil {
 		log.Printf("Not connected to %s:%s while trying to send message. Dropping.", c.host, c.port)
-		return
+		return ErrNotConnected
 	}
-	conn.SetWriteDeadline(time.Now().Add(writeMaxDuration))
+	conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
 	_, err := conn.Write([]byte(message))
 	if err != nil {
-		log.Printf("Error writing to TLS socket:%s", err)
-		c.resetConnection(nil)
-		return
+		log.Printf("Error writing to socket:%s", err)
+		// Closing makes the message loop notice and reconnect.
+		conn.Close()
+		return err
 	}
-	conn.SetReadDeadline(time.Now().Add(responseMaxDuration))
+	conn.SetReadDeadline(time.Now().Add(c.options.ResponseTimeout))
+	return nil
 }
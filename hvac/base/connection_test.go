@@ -0,0 +1,102 @@
+package base
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// expectingReceiver expects a further message after each one it receives,
+// as drivers do after sending a request from the message loop.
+type expectingReceiver struct {
+	connection Connection
+	received   chan string
+	lost       chan struct{}
+}
+
+func (r *expectingReceiver) OnConnectionEstablished() {}
+
+func (r *expectingReceiver) OnConnectionLost() {
+	r.lost <- struct{}{}
+}
+
+func (r *expectingReceiver) HandleMessage(message []byte) {
+	r.connection.ExpectRead()
+	r.received <- string(message)
+}
+
+func TestReadExpectedByHandler(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello\n"))
+		// Never answers the request the hello prompts.
+		time.Sleep(5 * time.Second)
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	connection := NewTCPSocketConnection(ConnectionOptions{
+		ReadTimeout: 100 * time.Millisecond,
+		RetryDelay:  time.Minute,
+	}, NewLineFramer)
+	receiver := &expectingReceiver{
+		connection: connection,
+		received:   make(chan string, 10),
+		lost:       make(chan struct{}, 10),
+	}
+	connection.Connect(host, port, receiver)
+	defer connection.Close()
+
+	select {
+	case <-receiver.received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("No message received")
+	}
+	select {
+	case <-receiver.lost:
+	case <-time.After(2 * time.Second):
+		t.Error("Connection not lost after the expected read timed out")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	options := ConnectionOptions{RetryDelay: time.Second, MaxRetryDelay: 8 * time.Second}
+	for _, test := range []struct {
+		failures int
+		// delay is the backoff before jitter, which picks from its upper half.
+		delay time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 8 * time.Second},
+		{100, 8 * time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			if got := options.retryDelay(test.failures); got < test.delay/2 || got > test.delay {
+				t.Errorf("retryDelay(%d) = %s, want between %s and %s", test.failures, got, test.delay/2, test.delay)
+				break
+			}
+		}
+	}
+}
+
+func TestRetryDelayDefaults(t *testing.T) {
+	// A maximum below the first delay is raised to it.
+	options := ConnectionOptions{RetryDelay: time.Minute, MaxRetryDelay: time.Second}.WithDefaults()
+	if options.MaxRetryDelay != time.Minute {
+		t.Errorf("MaxRetryDelay = %s, want 1m", options.MaxRetryDelay)
+	}
+	if got := options.retryDelay(10); got < 30*time.Second || got > time.Minute {
+		t.Errorf("retryDelay(10) = %s, want between 30s and 1m", got)
+	}
+}
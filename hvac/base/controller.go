@@ -1,19 +1,55 @@
 package base
 
+import (
+	"time"
+)
+
+// CommandResult reports the outcome of a command sent to a device.
+type CommandResult struct {
+	// Command is the name of the controller setting, such as "mode".
+	Command string `json:"command"`
+	// Value is the requested value.
+	Value string `json:"value"`
+	// Status is the status reported by the device, or the reason the command
+	// could not be delivered.
+	Status  string    `json:"status"`
+	Success bool      `json:"success"`
+	Time    time.Time `json:"timestamp"`
+}
+
+// SwingModes are the swing modes exchanged over MQTT. Drivers translate them
+// to the louver directions supported by the device.
+var SwingModes = []string{"off", "vertical", "horizontal", "both"}
+
 type StateNotifier interface {
-	UpdateAction(action string)
-	UpdateOpMode(mode string)
-	UpdateFanMode(fanMode string)
-	UpdateTemperature(temperature string)
-	UpdateCurrentTemperature(temperature string)
-	UpdateAttributes(attributes map[string]string)
+	// UpdateState reports the current state of the device. Only the fields
+	// that changed since the previous update are published.
+	UpdateState(state State)
+	// UpdateAvailability reports whether the device is reachable and responding.
+	UpdateAvailability(online bool)
+	// UpdateCommandResult reports whether a command was accepted by the device.
+	UpdateCommandResult(result CommandResult)
 }
 
 type Controller interface {
 	SetStateNotifier(stateNotifier StateNotifier)
 	Connect()
-	SetPowerMode(powerMode string)
-	SetOpMode(mode string)
+	// Close disconnects from the device and stops all background work. The
+	// device is reported offline.
+	Close()
+	SetPower(on bool)
+	// SetMode selects the operating mode. ModeOff powers the unit off.
+	SetMode(mode Mode)
 	SetFanMode(fanMode string)
-	SetTemperature(temperature string)
+	SetSwingMode(swingMode string)
+	SetPresetMode(presetMode string)
+	// Capabilities describes the settings supported by the device. Commands
+	// outside of them are rejected before reaching the controller.
+	Capabilities() Capabilities
+	// ConnectionState reports the state of the connection to the device.
+	ConnectionState() ConnectionState
+	// Snapshot returns the current state of the device. It is safe to call
+	// concurrently with updates from the device.
+	Snapshot() State
+	SetTemperature(temperature float64)
 }
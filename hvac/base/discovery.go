@@ -0,0 +1,130 @@
+package base
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+)
+
+var invalidObjectIdChars = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// discoveryObjectId converts a device id into a valid Home Assistant object id.
+func discoveryObjectId(id string) string {
+	return invalidObjectIdChars.ReplaceAllString(id, "_")
+}
+
+func (m *MQTT) discoveryTopic(id string) string {
+	return m.discoveryPrefix + "/climate/" + discoveryObjectId(id) + "/config"
+}
+
+// discoveryConfig builds the Home Assistant MQTT climate discovery payload for a device.
+func (m *MQTT) discoveryConfig(info DeviceInfo, controller Controller) map[string]interface{} {
+	prefix := info.Prefix + "/"
+	uniqueId := "hvac_ip_mqtt_bridge_" + discoveryObjectId(info.ID)
+	identifiers := []string{uniqueId}
+	if info.DUID != "" {
+		identifiers = append(identifiers, info.DUID)
+	}
+	capabilities := controller.Capabilities()
+	config := map[string]interface{}{
+		"name":                      info.Name,
+		"unique_id":                 uniqueId,
+		"power_command_topic":       prefix + powerCommandTopic,
+		"mode_command_topic":        prefix + opModeCommandTopic,
+		"mode_state_topic":          prefix + opModeStateTopic,
+		"modes":                     capabilities.Modes,
+		"action_topic":              prefix + actionTopic,
+		"temperature_command_topic": prefix + temperatureCommandTopic,
+		"temperature_state_topic":   prefix + temperatureStateTopic,
+		"json_attributes_topic":     prefix + attributesTopic,
+		"precision":                 0.1,
+		"qos":                       info.QoS,
+		"availability": []map[string]string{
+			{"topic": m.bridgeAvailabilityTopic()},
+			{"topic": prefix + availabilityTopic},
+		},
+		"availability_mode": "all",
+		"device": map[string]interface{}{
+			"identifiers": identifiers,
+			"name":        info.Name,
+			"model":       info.Model,
+		},
+	}
+	if len(capabilities.FanModes) > 0 {
+		config["fan_mode_command_topic"] = prefix + fanModeCommandTopic
+		config["fan_mode_state_topic"] = prefix + fanModeStateTopic
+		config["fan_modes"] = capabilities.FanModes
+	}
+	if len(capabilities.SwingModes) > 0 {
+		config["swing_mode_command_topic"] = prefix + swingModeCommandTopic
+		config["swing_mode_state_topic"] = prefix + swingModeStateTopic
+		config["swing_modes"] = capabilities.SwingModes
+	}
+	if len(capabilities.PresetModes) > 0 {
+		config["preset_mode_command_topic"] = prefix + presetModeCommandTopic
+		config["preset_mode_state_topic"] = prefix + presetModeStateTopic
+		config["preset_modes"] = capabilities.PresetModes
+	}
+	if capabilities.MaxTemperature != 0 {
+		config["min_temp"] = capabilities.MinTemperature
+		config["max_temp"] = capabilities.MaxTemperature
+	}
+	if capabilities.TemperatureStep != 0 {
+		config["temp_step"] = capabilities.TemperatureStep
+	}
+	if capabilities.TemperatureUnit != "" {
+		config["temperature_unit"] = capabilities.TemperatureUnit
+	}
+	if capabilities.CurrentTemperature {
+		config["current_temperature_topic"] = prefix + currentTemperatureStateTopic
+	}
+	if capabilities.Humidity {
+		config["current_humidity_topic"] = prefix + currentHumidityStateTopic
+	}
+	return config
+}
+
+func (m *MQTT) publishDiscovery() {
+	m.mutex.Lock()
+	var devices []DeviceInfo
+	var controllers []Controller
+	for id, info := range m.devices {
+		devices = append(devices, info)
+		controllers = append(controllers, m.controllers[id])
+	}
+	var removed []string
+	for id := range m.removed {
+		removed = append(removed, id)
+	}
+	m.mutex.Unlock()
+
+	for _, id := range removed {
+		m.clearDeviceDiscovery(id)
+	}
+	for i, info := range devices {
+		m.publishDeviceDiscovery(info, controllers[i])
+	}
+}
+
+func (m *MQTT) publishDeviceDiscovery(info DeviceInfo, controller Controller) {
+	if m.discoveryPrefix == "" {
+		return
+	}
+	payload, err := json.Marshal(m.discoveryConfig(info, controller))
+	if err != nil {
+		log.Printf("Cannot encode discovery config for %s: %s", info.ID, err)
+		return
+	}
+	topic := m.discoveryTopic(info.ID)
+	log.Printf("Publishing discovery config for %s to %s", info.ID, topic)
+	m.client.Publish(topic, 1, true, payload)
+}
+
+func (m *MQTT) clearDeviceDiscovery(id string) {
+	if m.discoveryPrefix == "" {
+		return
+	}
+	topic := m.discoveryTopic(id)
+	log.Printf("Removing discovery config for %s from %s", id, topic)
+	m.client.Publish(topic, 1, true, "")
+}
@@ -0,0 +1,36 @@
+package base
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// EncryptECB encrypts with the block cipher in ECB mode, after PKCS#7
+// padding, as several unit protocols do.
+func EncryptECB(block cipher.Block, plain []byte) []byte {
+	size := block.BlockSize()
+	padding := size - len(plain)%size
+	data := append(append([]byte(nil), plain...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	for i := 0; i < len(data); i += size {
+		block.Encrypt(data[i:i+size], data[i:i+size])
+	}
+	return data
+}
+
+// DecryptECB decrypts data encrypted by EncryptECB and removes its padding.
+func DecryptECB(block cipher.Block, data []byte) ([]byte, error) {
+	size := block.BlockSize()
+	if len(data) == 0 || len(data)%size != 0 {
+		return nil, fmt.Errorf("Invalid encrypted length %d", len(data))
+	}
+	plain := make([]byte, len(data))
+	for i := 0; i < len(data); i += size {
+		block.Decrypt(plain[i:i+size], data[i:i+size])
+	}
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > size {
+		return nil, fmt.Errorf("Invalid padding")
+	}
+	return plain[:len(plain)-padding], nil
+}
@@ -0,0 +1,36 @@
+package base
+
+import (
+	"bytes"
+	"crypto/aes"
+	"testing"
+)
+
+func TestECB(t *testing.T) {
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"", "short", "exactly 16 bytes", "longer than a single block"} {
+		encrypted := EncryptECB(block, []byte(plain))
+		if len(encrypted)%16 != 0 || len(encrypted) <= len(plain) {
+			t.Errorf("EncryptECB(%q) is %d bytes", plain, len(encrypted))
+		}
+		got, err := DecryptECB(block, encrypted)
+		if err != nil || !bytes.Equal(got, []byte(plain)) {
+			t.Errorf("DecryptECB(EncryptECB(%q)) = %q, %v", plain, got, err)
+		}
+	}
+	if _, err := DecryptECB(block, make([]byte, 15)); err == nil {
+		t.Errorf("DecryptECB accepted a partial block")
+	}
+	if _, err := DecryptECB(block, nil); err == nil {
+		t.Errorf("DecryptECB accepted no data")
+	}
+	// The encrypted block of zeroes decrypts to a padding of 0.
+	invalid := make([]byte, 16)
+	block.Encrypt(invalid, invalid)
+	if _, err := DecryptECB(block, invalid); err == nil {
+		t.Errorf("DecryptECB accepted a padding of 0")
+	}
+}
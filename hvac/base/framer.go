@@ -0,0 +1,119 @@
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+)
+
+// Framer splits the byte stream of a connection into complete messages,
+// regardless of how the stream is segmented into reads.
+type Framer interface {
+	// Next blocks until a complete message is available and returns it.
+	Next() ([]byte, error)
+}
+
+// FramerFactory creates a framer reading from a newly established connection.
+type FramerFactory func(r io.Reader) Framer
+
+// lineFramer delivers newline-delimited messages, without the line terminator.
+type lineFramer struct {
+	reader *bufio.Reader
+}
+
+func NewLineFramer(r io.Reader) Framer {
+	return &lineFramer{reader: bufio.NewReader(r)}
+}
+
+func (f *lineFramer) Next() ([]byte, error) {
+	for {
+		line, err := f.reader.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+// xmlFramer delivers top-level XML elements, along with any XML declaration
+// preceding them. Non-whitespace text between elements, such as a protocol
+// greeting, is delivered as a message of its own once the next element starts.
+type xmlFramer struct {
+	recorder *recordingReader
+	decoder  *xml.Decoder
+}
+
+func NewXMLFramer(r io.Reader) Framer {
+	recorder := &recordingReader{reader: r}
+	return &xmlFramer{
+		recorder: recorder,
+		decoder:  xml.NewDecoder(recorder),
+	}
+}
+
+func (f *xmlFramer) Next() ([]byte, error) {
+	depth := 0
+	start := f.decoder.InputOffset()
+	// prolog is set once a declaration or comment preceding the element is seen.
+	prolog := false
+	for {
+		token, err := f.decoder.RawToken()
+		if err != nil {
+			return nil, err
+		}
+		end := f.decoder.InputOffset()
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				return f.recorder.take(start, end), nil
+			}
+		case xml.CharData:
+			if depth > 0 {
+				break
+			}
+			if len(bytes.TrimSpace(t)) > 0 {
+				return f.recorder.take(start, end), nil
+			}
+			if !prolog {
+				// Skip whitespace between messages.
+				f.recorder.take(end, end)
+				start = end
+			}
+		case xml.ProcInst, xml.Comment, xml.Directive:
+			if depth == 0 {
+				prolog = true
+			}
+		}
+	}
+}
+
+// recordingReader keeps the bytes read through it, so that the raw text of
+// decoded tokens can be recovered by stream offset.
+type recordingReader struct {
+	reader io.Reader
+	buf    []byte
+	// offset is the stream offset of buf[0].
+	offset int64
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+// take returns the bytes between the given stream offsets and discards
+// everything recorded before end.
+func (r *recordingReader) take(start, end int64) []byte {
+	message := append([]byte(nil), r.buf[start-r.offset:end-r.offset]...)
+	r.buf = append(r.buf[:0], r.buf[end-r.offset:]...)
+	r.offset = end
+	return message
+}
@@ -0,0 +1,158 @@
+package base
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+// chunkReader returns the chunks one per Read, as a socket delivering
+// segments would.
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if n < len(r.chunks[0]) {
+		r.chunks[0] = r.chunks[0][n:]
+	} else {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+// readAll returns the messages delivered by the framer until it fails.
+func readAll(framer Framer) ([]string, error) {
+	var messages []string
+	for {
+		message, err := framer.Next()
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, string(message))
+	}
+}
+
+func TestXMLFramer(t *testing.T) {
+	const (
+		status = `<Update Type="Status"><Status DUID="1"/></Update>`
+		device = `<Response Type="DeviceState" Status="Okay"><DeviceState/></Response>`
+		decl   = `<?xml version="1.0" encoding="utf-8" ?>`
+	)
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{
+			name:   "whole document",
+			chunks: []string{status},
+			want:   []string{status},
+		},
+		{
+			name:   "split mid-tag",
+			chunks: []string{`<Update Ty`, `pe="Status"><Sta`, `tus DUID="1"/></Upd`, `ate>`},
+			want:   []string{status},
+		},
+		{
+			name:   "split byte by byte",
+			chunks: splitBytes(status),
+			want:   []string{status},
+		},
+		{
+			name:   "two documents in one read",
+			chunks: []string{status + "\r\n" + device + "\r\n"},
+			want:   []string{status, device},
+		},
+		{
+			name:   "greeting before first element",
+			chunks: []string{"DPLUG-1.6\n", status},
+			want:   []string{"DPLUG-1.6\n", status},
+		},
+		{
+			name:   "greeting coalesced with first element",
+			chunks: []string{"DPLUG-1.6\n" + status},
+			want:   []string{"DPLUG-1.6\n", status},
+		},
+		{
+			name:   "declaration before each element",
+			chunks: []string{decl + status + "\n" + decl, device},
+			want:   []string{decl + status, decl + device},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readAll(NewXMLFramer(&chunkReader{chunks: test.chunks}))
+			if err != io.EOF {
+				t.Errorf("got error %v, want EOF", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got messages %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestXMLFramerEOFMidMessage(t *testing.T) {
+	framer := NewXMLFramer(&chunkReader{chunks: []string{`<Update Type="Status"><Sta`}})
+	if message, err := framer.Next(); err == nil {
+		t.Errorf("got message %q, want error", message)
+	}
+}
+
+func TestLineFramer(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{
+			name:   "whole lines",
+			chunks: []string{"L1.100 ON\r\n", "OK\r\n"},
+			want:   []string{"L1.100 ON", "OK"},
+		},
+		{
+			name:   "split lines",
+			chunks: []string{"L1.1", "00 O", "N\r", "\nO", "K\n"},
+			want:   []string{"L1.100 ON", "OK"},
+		},
+		{
+			name:   "coalesced lines",
+			chunks: []string{"L1.100 ON\r\nL1.101 OFF\r\nOK\r\n"},
+			want:   []string{"L1.100 ON", "L1.101 OFF", "OK"},
+		},
+		{
+			name:   "empty lines skipped",
+			chunks: []string{"\r\n\r\nOK\r\n\n"},
+			want:   []string{"OK"},
+		},
+		{
+			name:   "EOF mid-line",
+			chunks: []string{"OK\r\nL1.10"},
+			want:   []string{"OK"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readAll(NewLineFramer(&chunkReader{chunks: test.chunks}))
+			if err != io.EOF {
+				t.Errorf("got error %v, want EOF", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got messages %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func splitBytes(s string) []string {
+	var chunks []string
+	for i := range s {
+		chunks = append(chunks, s[i:i+1])
+	}
+	return chunks
+}
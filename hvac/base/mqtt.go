@@ -1,11 +1,15 @@
 package base
 
 import (
-	"fmt"
-	"log"
 	"crypto/rand"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"sync"
+	"time"
 )
 
 const (
@@ -15,55 +19,260 @@ const (
 	opModeStateTopic             = "mode/state"
 	actionTopic                  = "action"
 	currentTemperatureStateTopic = "current_temperature/state"
+	currentHumidityStateTopic    = "current_humidity/state"
 	temperatureCommandTopic      = "temperature/set"
 	temperatureStateTopic        = "temperature/state"
 	fanModeCommandTopic          = "fan_mode/set"
 	fanModeStateTopic            = "fan_mode/state"
+	swingModeCommandTopic        = "swing_mode/set"
+	swingModeStateTopic          = "swing_mode/state"
+	presetModeCommandTopic       = "preset_mode/set"
+	presetModeStateTopic         = "preset_mode/state"
+	attributesTopic              = "attributes"
+	lastCommandTopic             = "last_command"
+	errorTopic                   = "error"
+
+	bridgeAvailabilityTopic = "availability"
+	bridgeDiscoveredTopic   = "discovered"
+	availabilityOnline      = "online"
+	availabilityOffline     = "offline"
+
+	// disconnectQuiesce is how long in milliseconds to wait for outstanding
+	// publications when disconnecting.
+	disconnectQuiesce = 1000
+	// closeTimeout bounds each wait for the broker when closing, so that
+	// shutdown completes even if the broker does not answer.
+	closeTimeout = 2 * time.Second
 )
 
+// commandTopics are subscribed to for every device.
+var commandTopics = []string{
+	powerCommandTopic,
+	opModeCommandTopic,
+	fanModeCommandTopic,
+	swingModeCommandTopic,
+	presetModeCommandTopic,
+	temperatureCommandTopic,
+}
+
+// MQTTOptions configures the connection to the MQTT broker.
+type MQTTOptions struct {
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// TLSConfig is used for ssl:// and wss:// brokers.
+	TLSConfig *tls.Config
+	// DiscoveryPrefix is the Home Assistant discovery prefix. Discovery is
+	// disabled when empty.
+	DiscoveryPrefix string
+	// BridgeTopic is the prefix of the bridge's own topics, such as its
+	// availability (last will) topic.
+	BridgeTopic string
+	// RefreshInterval is how often all device state is republished, even if
+	// unchanged. Periodic refresh is disabled when zero.
+	RefreshInterval time.Duration
+}
+
+// DeviceInfo describes a device registered with the MQTT bridge.
+type DeviceInfo struct {
+	ID     string
+	Name   string
+	Prefix string
+	Model  string
+	DUID   string
+	// QoS is used for state publications and command subscriptions.
+	QoS byte
+	// Retain is set on state publications.
+	Retain bool
+}
+
 type MQTT struct {
-	clientId string
-	prefix   string
+	clientId        string
+	discoveryPrefix string
+	bridgeTopic     string
+
+	client mqtt.Client
+	// done is closed by Close to stop background work.
+	done      chan struct{}
+	closeOnce sync.Once
 
-	client      mqtt.Client
+	mutex       sync.Mutex
 	controllers map[string]Controller
-	prefixes    map[string]string
+	devices     map[string]DeviceInfo
+	notifiers   map[string]*MQTTNotifier
+	removed     map[string]bool
 }
 
+// MQTTNotifier publishes the state of a single device. Values are only
+// published when they change, except for periodic and reconnect refreshes.
 type MQTTNotifier struct {
 	mqtt   *MQTT
-	prefix string
+	device DeviceInfo
+	// capabilities tell which of the optional fields the device supports.
+	capabilities Capabilities
+
+	mutex sync.Mutex
+	// published holds the last value published to each state topic.
+	published    map[string]string
+	availability string
 }
 
-func (m *MQTTNotifier) UpdateAction(action string) {
-	m.mqtt.updateAction(m.prefix, action)
+func (m *MQTTNotifier) UpdateState(state State) {
+	for _, message := range m.stateMessages(state) {
+		m.publish(message.topic, message.value)
+	}
 }
-func (m *MQTTNotifier) UpdateOpMode(opMode string) {
-	m.mqtt.updateOpMode(m.prefix, opMode)
+
+type stateMessage struct {
+	topic string
+	value string
 }
-func (m *MQTTNotifier) UpdateFanMode(fanMode string) {
-	m.mqtt.updateFanMode(m.prefix, fanMode)
+
+// stateMessages formats the known fields of the state for their topics.
+func (m *MQTTNotifier) stateMessages(state State) []stateMessage {
+	var messages []stateMessage
+	add := func(topic, value string) {
+		if value != "" {
+			messages = append(messages, stateMessage{topic, value})
+		}
+	}
+	// A mode the unit reports but Home Assistant does not know is left out,
+	// rather than rejected by it.
+	if mode, err := ParseMode(string(state.EffectiveMode())); err == nil {
+		add(opModeStateTopic, string(mode))
+	}
+	addFloat := func(topic string, value *float64) {
+		if value != nil {
+			add(topic, formatFloat(*value))
+		}
+	}
+	// Fields the unit supports but does not report are published as idle,
+	// off or none, so that the last retained value does not stay shown.
+	action := state.Action
+	if action == "" {
+		action = ActionIdle
+		if state.EffectiveMode() == ModeOff {
+			action = ActionOff
+		}
+	}
+	add(actionTopic, string(action))
+	add(fanModeStateTopic, state.FanMode)
+	swingMode := state.SwingMode
+	if swingMode == "" {
+		swingMode, _ = m.capabilities.CheckSwingMode("off")
+	}
+	add(swingModeStateTopic, swingMode)
+	presetMode := state.PresetMode
+	if presetMode == "" {
+		presetMode, _ = m.capabilities.CheckPresetMode("none")
+	}
+	add(presetModeStateTopic, presetMode)
+	addFloat(temperatureStateTopic, state.Setpoint)
+	addFloat(currentTemperatureStateTopic, state.CurrentTemperature)
+	addFloat(currentHumidityStateTopic, state.Humidity)
+	if state.Extras != nil {
+		message, err := json.Marshal(state.Extras)
+		if err != nil {
+			log.Printf("Cannot encode attributes for %s: %s", m.device.ID, err)
+		} else {
+			add(attributesTopic, string(message))
+		}
+	}
+	return messages
 }
-func (m *MQTTNotifier) UpdateTemperature(temperature string) {
-	m.mqtt.updateTemperature(m.prefix, temperature)
+
+func (m *MQTTNotifier) UpdateAvailability(online bool) {
+	availability := availabilityOffline
+	if online {
+		availability = availabilityOnline
+	}
+	m.mutex.Lock()
+	m.availability = availability
+	m.mutex.Unlock()
+	m.mqtt.publishAvailability(m.device, availability)
 }
-func (m *MQTTNotifier) UpdateCurrentTemperature(temperature string) {
-	m.mqtt.updateCurrentTemperature(m.prefix, temperature)
+
+func (m *MQTTNotifier) UpdateCommandResult(result CommandResult) {
+	message, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Cannot encode command result for %s: %s", m.device.ID, err)
+		return
+	}
+	m.publish(lastCommandTopic, string(message))
+	if result.Success {
+		m.publish(errorTopic, "")
+	} else {
+		m.publish(errorTopic, fmt.Sprintf("%s %s: %s", result.Command, result.Value, result.Status))
+	}
 }
-func (m *MQTTNotifier) UpdateAttributes(attributes map[string]string) {
-	m.mqtt.updateAttributes(m.prefix, attributes)
+
+// publish sends the value to the topic unless it was already published.
+// A value that fails to publish is forgotten, so that it is sent again when
+// next updated.
+func (m *MQTTNotifier) publish(topic string, message string) {
+	m.mutex.Lock()
+	last, ok := m.published[topic]
+	m.published[topic] = message
+	m.mutex.Unlock()
+	if ok && last == message {
+		return
+	}
+	token := m.mqtt.publish(m.device, topic, message)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Error publishing %s/%s: %s", m.device.Prefix, topic, token.Error())
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			if m.published[topic] == message {
+				delete(m.published, topic)
+			}
+		}
+	}()
+}
+
+// republish sends all the last known values again, refreshing retained state.
+func (m *MQTTNotifier) republish() {
+	m.mutex.Lock()
+	published := make(map[string]string, len(m.published))
+	for topic, message := range m.published {
+		published[topic] = message
+	}
+	availability := m.availability
+	m.mutex.Unlock()
+
+	if availability != "" {
+		m.mqtt.publishAvailability(m.device, availability)
+	}
+	for topic, message := range published {
+		m.mqtt.publish(m.device, topic, message)
+	}
 }
 
-func NewMQTT(broker string, clientId string) *MQTT {
+func NewMQTT(options MQTTOptions) *MQTT {
+	broker := options.Broker
+	clientId := options.ClientID
 	log.Printf("Connecting to MQTT broker %s for %s", broker, clientId)
 	m := &MQTT{
-		clientId:    clientId,
-		controllers: make(map[string]Controller),
-		prefixes:    make(map[string]string),
+		clientId:        clientId,
+		discoveryPrefix: options.DiscoveryPrefix,
+		bridgeTopic:     options.BridgeTopic,
+		controllers:     make(map[string]Controller),
+		devices:         make(map[string]DeviceInfo),
+		notifiers:       make(map[string]*MQTTNotifier),
+		removed:         make(map[string]bool),
+		done:            make(chan struct{}),
 	}
 
-	options := mqtt.NewClientOptions()
-	options.AddBroker(broker)
+	clientOptions := mqtt.NewClientOptions()
+	clientOptions.AddBroker(broker)
+	if options.Username != "" {
+		clientOptions.SetUsername(options.Username)
+		clientOptions.SetPassword(options.Password)
+	}
+	if options.TLSConfig != nil {
+		clientOptions.SetTLSConfig(options.TLSConfig)
+	}
 	random_id := make([]byte, 8)
 	log.Printf("Reading random")
 	_, err := rand.Read(random_id)
@@ -73,27 +282,131 @@ func NewMQTT(broker string, clientId string) *MQTT {
 	clientId = fmt.Sprintf("%s_%s", clientId, base64.StdEncoding.EncodeToString(random_id))
 	log.Printf("MQTT Client ID %s", clientId)
 
-	options.SetClientID(clientId)
-	options.SetOnConnectHandler(func(client mqtt.Client) {
+	clientOptions.SetClientID(clientId)
+	// The broker marks the whole bridge as unavailable if it disappears.
+	clientOptions.SetWill(m.bridgeAvailabilityTopic(), availabilityOffline, 1, true)
+	clientOptions.SetOnConnectHandler(func(client mqtt.Client) {
 		log.Printf("Connection established to %s:%s", clientId, broker)
+		m.client.Publish(m.bridgeAvailabilityTopic(), 1, true, availabilityOnline)
 		m.subscribeTopics()
+		m.publishDiscovery()
+		m.republish()
 	})
-	options.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+	clientOptions.SetConnectionLostHandler(func(client mqtt.Client, err error) {
 		log.Printf("Connection lost to %s:%s %s", clientId, broker, err)
 	})
-	options.SetAutoReconnect(true)
+	clientOptions.SetAutoReconnect(true)
 
-	m.client = mqtt.NewClient(options)
+	m.client = mqtt.NewClient(clientOptions)
+	if options.RefreshInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(options.RefreshInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if m.client.IsConnected() {
+						m.republish()
+					}
+				case <-m.done:
+					return
+				}
+			}
+		}()
+	}
 	return m
 }
 
-func (m *MQTT) RegisterController(id string, prefix string, controller Controller) StateNotifier {
-	m.controllers[id] = controller
-	m.prefixes[id] = prefix
-	return &MQTTNotifier{
-		mqtt:   m,
-		prefix: prefix,
+// RegisterController adds a controller to the bridge, subscribing to its
+// command topics and announcing it to Home Assistant.
+func (m *MQTT) RegisterController(info DeviceInfo, controller Controller) StateNotifier {
+	notifier := &MQTTNotifier{
+		mqtt:         m,
+		device:       info,
+		capabilities: controller.Capabilities(),
+		published:    make(map[string]string),
 	}
+	m.mutex.Lock()
+	m.controllers[info.ID] = controller
+	m.devices[info.ID] = info
+	m.notifiers[info.ID] = notifier
+	delete(m.removed, info.ID)
+	m.mutex.Unlock()
+
+	if m.client.IsConnected() {
+		m.subscribeDevice(info, controller)
+		m.publishDeviceDiscovery(info, controller)
+	}
+	return notifier
+}
+
+// RemoveDiscovery deletes the discovery entry of a device that is no longer
+// handled by the bridge.
+func (m *MQTT) RemoveDiscovery(id string) {
+	m.mutex.Lock()
+	m.removed[id] = true
+	m.mutex.Unlock()
+
+	if m.client.IsConnected() {
+		m.clearDeviceDiscovery(id)
+	}
+}
+
+// Close unsubscribes from all command topics and marks the bridge offline,
+// if connected, and disconnects from the broker. Disconnecting also stops
+// the client reconnecting while the connection is down.
+func (m *MQTT) Close() {
+	m.closeOnce.Do(func() { close(m.done) })
+	if m.client.IsConnected() {
+		m.goOffline()
+	}
+	m.client.Disconnect(disconnectQuiesce)
+	log.Printf("Disconnected from MQTT broker")
+}
+
+// goOffline unsubscribes from all command topics and marks the bridge
+// offline.
+func (m *MQTT) goOffline() {
+	m.mutex.Lock()
+	var topics []string
+	for _, info := range m.devices {
+		for _, topic := range commandTopics {
+			topics = append(topics, info.Prefix+"/"+topic)
+		}
+	}
+	m.mutex.Unlock()
+
+	if len(topics) > 0 {
+		token := m.client.Unsubscribe(topics...)
+		if !token.WaitTimeout(closeTimeout) {
+			log.Printf("Timed out unsubscribing from topics")
+		} else if token.Error() != nil {
+			log.Printf("Error unsubscribing from topics: %s", token.Error())
+		}
+	}
+	token := m.client.Publish(m.bridgeAvailabilityTopic(), 1, true, availabilityOffline)
+	if !token.WaitTimeout(closeTimeout) {
+		log.Printf("Timed out publishing bridge availability")
+	} else if token.Error() != nil {
+		log.Printf("Error publishing bridge availability: %s", token.Error())
+	}
+}
+
+// PublishDiscovered publishes the devices found on the network but not
+// configured, as a retained JSON list on the bridge's discovered topic.
+func (m *MQTT) PublishDiscovered(devices interface{}) {
+	message, err := json.Marshal(devices)
+	if err != nil {
+		log.Printf("Cannot encode discovered devices: %s", err)
+		return
+	}
+	topic := m.bridgeTopic + "/" + bridgeDiscoveredTopic
+	log.Println("mqtt publishing", topic, string(message))
+	m.client.Publish(topic, 1, true, message)
+}
+
+func (m *MQTT) bridgeAvailabilityTopic() string {
+	return m.bridgeTopic + "/" + bridgeAvailabilityTopic
 }
 
 func (m *MQTT) Connect() {
@@ -105,63 +418,133 @@ func (m *MQTT) Connect() {
 	}
 }
 
+// republish refreshes the state of all devices.
+func (m *MQTT) republish() {
+	m.mutex.Lock()
+	notifiers := make([]*MQTTNotifier, 0, len(m.notifiers))
+	for _, notifier := range m.notifiers {
+		notifiers = append(notifiers, notifier)
+	}
+	m.mutex.Unlock()
+
+	for _, notifier := range notifiers {
+		notifier.republish()
+	}
+}
+
 func (m *MQTT) subscribeTopics() {
-	for controllerId := range m.controllers {
-		prefix := m.prefixes[controllerId]
-		key := fmt.Sprintf("%s", controllerId)
-		log.Printf("subscribing to prefix %s for %s", prefix, controllerId)
-		tokens := []mqtt.Token{
-			m.client.Subscribe(prefix+"/"+powerCommandTopic, 0,
-				func(client mqtt.Client, message mqtt.Message) {
-					log.Printf("Received %s:%s:%s", key, message.Topic(), string(message.Payload()))
-					m.controllers[key].SetPowerMode(string(message.Payload()))
-				}),
-			m.client.Subscribe(prefix+"/"+opModeCommandTopic, 0,
-				func(client mqtt.Client, message mqtt.Message) {
-					log.Println("Received %s:%s:%s", key, message.Topic(), string(message.Payload()))
-					m.controllers[key].SetOpMode(string(message.Payload()))
-				}),
-			m.client.Subscribe(prefix+"/"+fanModeCommandTopic, 0,
-				func(client mqtt.Client, message mqtt.Message) {
-					log.Println("Received %s:%s:%s", key, message.Topic(), string(message.Payload()))
-					m.controllers[key].SetFanMode(string(message.Payload()))
-				}),
-			m.client.Subscribe(prefix+"/"+temperatureCommandTopic, 0,
-				func(client mqtt.Client, message mqtt.Message) {
-					log.Println("Received %s:%s:%s", key, message.Topic(), string(message.Payload()))
-					m.controllers[key].SetTemperature(string(message.Payload()))
-				}),
-			// TODO(gsasha): subscribe to more commands.
-		}
-		for _, token := range tokens {
-			if token.Wait() && token.Error() != nil {
-				log.Printf("Error subscribing to topics %s: %s", controllerId, token.Error())
-				return
+	m.mutex.Lock()
+	devices := make([]DeviceInfo, 0, len(m.devices))
+	controllers := make([]Controller, 0, len(m.devices))
+	for id, info := range m.devices {
+		devices = append(devices, info)
+		controllers = append(controllers, m.controllers[id])
+	}
+	m.mutex.Unlock()
+
+	for i, info := range devices {
+		m.subscribeDevice(info, controllers[i])
+	}
+}
+
+func (m *MQTT) subscribeDevice(info DeviceInfo, controller Controller) {
+	prefix := info.Prefix
+	key := info.ID
+	log.Printf("subscribing to prefix %s for %s", prefix, key)
+	handle := func(topic, command string, apply func(value string) error) mqtt.Token {
+		return m.client.Subscribe(prefix+"/"+topic, info.QoS,
+			func(client mqtt.Client, message mqtt.Message) {
+				log.Printf("Received %s:%s:%s", key, message.Topic(), string(message.Payload()))
+				value := string(message.Payload())
+				if err := apply(value); err != nil {
+					m.rejectCommand(key, command, value, err)
+				}
+			})
+	}
+	tokens := []mqtt.Token{
+		handle(powerCommandTopic, "power", func(value string) error {
+			on, err := ParsePower(value)
+			if err == nil {
+				controller.SetPower(on)
+			}
+			return err
+		}),
+		handle(opModeCommandTopic, "mode", func(value string) error {
+			mode, err := ParseMode(value)
+			if err == nil {
+				err = controller.Capabilities().CheckMode(mode)
+			}
+			if err == nil {
+				controller.SetMode(mode)
+			}
+			return err
+		}),
+		handle(fanModeCommandTopic, "fan_mode", func(value string) error {
+			fanMode, err := controller.Capabilities().CheckFanMode(value)
+			if err == nil {
+				controller.SetFanMode(fanMode)
 			}
+			return err
+		}),
+		handle(swingModeCommandTopic, "swing_mode", func(value string) error {
+			swingMode, err := controller.Capabilities().CheckSwingMode(value)
+			if err == nil {
+				controller.SetSwingMode(swingMode)
+			}
+			return err
+		}),
+		handle(presetModeCommandTopic, "preset_mode", func(value string) error {
+			presetMode, err := controller.Capabilities().CheckPresetMode(value)
+			if err == nil {
+				controller.SetPresetMode(presetMode)
+			}
+			return err
+		}),
+		handle(temperatureCommandTopic, "temperature", func(value string) error {
+			temperature, err := ParseTemperature(value)
+			if err == nil {
+				err = controller.Capabilities().CheckTemperature(temperature)
+			}
+			if err == nil {
+				controller.SetTemperature(temperature)
+			}
+			return err
+		}),
+	}
+	for _, token := range tokens {
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Error subscribing to topics %s: %s", key, token.Error())
+			return
 		}
-		log.Printf("Subscribed to topics for %s", controllerId)
 	}
+	log.Printf("Subscribed to topics for %s", key)
 }
 
-func (m *MQTT) updateAction(prefix string, action string) {
-	m.publish(prefix, actionTopic, action)
-}
-func (m *MQTT) updateOpMode(prefix string, opMode string) {
-	m.publish(prefix, opModeStateTopic, opMode)
-}
-func (m *MQTT) updateFanMode(prefix string, fanMode string) {
-	m.publish(prefix, fanModeStateTopic, fanMode)
-}
-func (m *MQTT) updateTemperature(prefix string, temperature string) {
-	m.publish(prefix, temperatureStateTopic, temperature)
-}
-func (m *MQTT) updateCurrentTemperature(prefix string, temperature string) {
-	m.publish(prefix, currentTemperatureStateTopic, temperature)
+// rejectCommand reports a command that was not sent to the device because
+// its value is invalid.
+func (m *MQTT) rejectCommand(id, command, value string, err error) {
+	log.Printf("Rejected %s command %s for %s: %s", command, value, id, err)
+	m.mutex.Lock()
+	notifier := m.notifiers[id]
+	m.mutex.Unlock()
+	if notifier == nil {
+		return
+	}
+	notifier.UpdateCommandResult(CommandResult{
+		Command: command,
+		Value:   value,
+		Status:  err.Error(),
+		Time:    time.Now(),
+	})
 }
-func (m *MQTT) updateAttributes(prefix string, attributes map[string]string) {
-	// TODO(gsasha): implement.
+
+func (m *MQTT) publishAvailability(device DeviceInfo, availability string) {
+	topic := device.Prefix + "/" + availabilityTopic
+	log.Println("mqtt publishing", topic, availability)
+	m.client.Publish(topic, 1, true, availability)
 }
-func (m *MQTT) publish(prefix string, topic string, message string) {
-	log.Println("mqtt publishing", prefix+"/"+topic, message)
-	m.client.Publish(prefix+"/"+topic, 0, false, message)
+func (m *MQTT) publish(device DeviceInfo, topic string, message string) mqtt.Token {
+	topic = device.Prefix + "/" + topic
+	log.Println("mqtt publishing", topic, message)
+	return m.client.Publish(topic, device.QoS, device.Retain, message)
 }
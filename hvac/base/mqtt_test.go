@@ -0,0 +1,570 @@
+package base
+
+import (
+	"encoding/json"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMessage is a message published to or delivered by fakeClient.
+type fakeMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  string
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return m.qos }
+func (m *fakeMessage) Retained() bool    { return m.retained }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m *fakeMessage) Ack()              {}
+
+// fakeClient is a connected mqtt.Client recording the messages published
+// and the subscriptions.
+type fakeClient struct {
+	mutex      sync.Mutex
+	connected  bool
+	published  []fakeMessage
+	subscribed map[string]byte
+	handlers   map[string]mqtt.MessageHandler
+}
+
+func (c *fakeClient) IsConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected
+}
+
+func (c *fakeClient) IsConnectionOpen() bool { return c.IsConnected() }
+func (c *fakeClient) Connect() mqtt.Token    { return &mqtt.DummyToken{} }
+
+func (c *fakeClient) Disconnect(quiesce uint) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.connected = false
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	message := fakeMessage{topic: topic, qos: qos, retained: retained}
+	switch payload := payload.(type) {
+	case string:
+		message.payload = payload
+	case []byte:
+		message.payload = string(payload)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.published = append(c.published, message)
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.subscribed[topic] = qos
+	c.handlers[topic] = callback
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	for topic, qos := range filters {
+		c.Subscribe(topic, qos, callback)
+	}
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, topic := range topics {
+		delete(c.subscribed, topic)
+		delete(c.handlers, topic)
+	}
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeClient) AddRoute(topic string, callback mqtt.MessageHandler) {}
+
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// takePublished returns the messages published since the last call.
+func (c *fakeClient) takePublished() []fakeMessage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	published := c.published
+	c.published = nil
+	return published
+}
+
+// deliver hands a message to the handler subscribed to the topic.
+func (c *fakeClient) deliver(topic, payload string) {
+	c.mutex.Lock()
+	handler := c.handlers[topic]
+	c.mutex.Unlock()
+	handler(c, &fakeMessage{topic: topic, payload: payload})
+}
+
+// lastPublished returns the last message published to each topic.
+func lastPublished(messages []fakeMessage) map[string]fakeMessage {
+	last := make(map[string]fakeMessage)
+	for _, message := range messages {
+		last[message.topic] = message
+	}
+	return last
+}
+
+func newTestMQTT() (*MQTT, *fakeClient) {
+	client := &fakeClient{
+		connected:  true,
+		subscribed: make(map[string]byte),
+		handlers:   make(map[string]mqtt.MessageHandler),
+	}
+	return &MQTT{
+		clientId:        "test",
+		discoveryPrefix: "homeassistant",
+		bridgeTopic:     "bridge",
+		client:          client,
+		done:            make(chan struct{}),
+		controllers:     make(map[string]Controller),
+		devices:         make(map[string]DeviceInfo),
+		notifiers:       make(map[string]*MQTTNotifier),
+		removed:         make(map[string]bool),
+	}, client
+}
+
+// fakeController records the commands it gets.
+type fakeController struct {
+	Controller
+	capabilities Capabilities
+	commands     []string
+}
+
+func (c *fakeController) Capabilities() Capabilities { return c.capabilities }
+func (c *fakeController) SetMode(mode Mode)          { c.commands = append(c.commands, "mode "+string(mode)) }
+
+func (c *fakeController) SetTemperature(temperature float64) {
+	c.commands = append(c.commands, "temperature "+formatFloat(temperature))
+}
+
+func TestStateMessagesMode(t *testing.T) {
+	notifier := &MQTTNotifier{}
+	for _, test := range []struct {
+		state State
+		want  string
+	}{
+		{State{Power: true, Mode: ModeCool}, "cool"},
+		{State{Power: false, Mode: ModeCool}, "off"},
+		{State{Power: true, Mode: ""}, ""},
+		{State{Power: true, Mode: "frost"}, ""},
+	} {
+		got := ""
+		for _, message := range notifier.stateMessages(test.state) {
+			if message.topic == opModeStateTopic {
+				got = message.value
+			}
+		}
+		if got != test.want {
+			t.Errorf("Mode published for %+v = %q, want %q", test.state, got, test.want)
+		}
+	}
+}
+
+func TestPublishForgetsFailedValues(t *testing.T) {
+	// Never connected, so that publishing fails.
+	m := NewMQTT(MQTTOptions{Broker: "tcp://127.0.0.1:1"})
+	notifier := &MQTTNotifier{
+		mqtt:      m,
+		device:    DeviceInfo{Prefix: "test"},
+		published: make(map[string]string),
+	}
+	notifier.publish(opModeStateTopic, "cool")
+	for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond * 10) {
+		notifier.mutex.Lock()
+		_, ok := notifier.published[opModeStateTopic]
+		notifier.mutex.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Failed value still recorded as published")
+		}
+	}
+}
+
+func TestCloseNotConnected(t *testing.T) {
+	m := NewMQTT(MQTTOptions{Broker: "tcp://127.0.0.1:1", RefreshInterval: time.Hour})
+	m.Close()
+	m.Close()
+	select {
+	case <-m.done:
+	default:
+		t.Error("Close did not stop the refresh")
+	}
+}
+
+func TestStateMessagesUnknownFields(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		capabilities Capabilities
+		state        State
+		want         map[string]string
+	}{
+		{
+			name:         "supported",
+			capabilities: Capabilities{SwingModes: SwingModes, PresetModes: []string{"boost"}},
+			state:        State{Power: true, Mode: ModeAuto},
+			want: map[string]string{
+				opModeStateTopic:     "auto",
+				actionTopic:          "idle",
+				swingModeStateTopic:  "off",
+				presetModeStateTopic: "none",
+			},
+		},
+		{
+			name:  "unsupported",
+			state: State{Power: false, Mode: ModeAuto},
+			want: map[string]string{
+				opModeStateTopic: "off",
+				actionTopic:      "off",
+			},
+		},
+		{
+			name:         "reported",
+			capabilities: Capabilities{SwingModes: SwingModes, PresetModes: []string{"boost"}},
+			state:        State{Power: true, Mode: ModeCool, Action: ActionCooling, SwingMode: "both", PresetMode: "boost"},
+			want: map[string]string{
+				opModeStateTopic:     "cool",
+				actionTopic:          "cooling",
+				swingModeStateTopic:  "both",
+				presetModeStateTopic: "boost",
+			},
+		},
+	} {
+		notifier := &MQTTNotifier{capabilities: test.capabilities}
+		got := make(map[string]string)
+		for _, message := range notifier.stateMessages(test.state) {
+			got[message.topic] = message.value
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: published %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		capabilities Capabilities
+		want         map[string]interface{}
+		absent       []string
+	}{
+		{
+			name: "minimal",
+			capabilities: Capabilities{
+				Modes: []Mode{ModeOff, ModeCool},
+			},
+			want: map[string]interface{}{
+				"name":                      "Bedroom AC",
+				"unique_id":                 "hvac_ip_mqtt_bridge_bedroom_ac",
+				"mode_command_topic":        "hvac/bedroom/mode/set",
+				"mode_state_topic":          "hvac/bedroom/mode/state",
+				"modes":                     []interface{}{"off", "cool"},
+				"temperature_command_topic": "hvac/bedroom/temperature/set",
+				"temperature_state_topic":   "hvac/bedroom/temperature/state",
+			},
+			absent: []string{"fan_modes", "swing_modes", "preset_modes", "min_temp", "current_temperature_topic"},
+		},
+		{
+			name: "full",
+			capabilities: Capabilities{
+				Modes:              Modes,
+				FanModes:           []string{"auto", "low"},
+				SwingModes:         []string{"off", "vertical"},
+				PresetModes:        []string{"boost"},
+				MinTemperature:     16,
+				MaxTemperature:     30,
+				TemperatureStep:    0.5,
+				CurrentTemperature: true,
+			},
+			want: map[string]interface{}{
+				"fan_mode_command_topic":    "hvac/bedroom/fan_mode/set",
+				"fan_modes":                 []interface{}{"auto", "low"},
+				"swing_mode_state_topic":    "hvac/bedroom/swing_mode/state",
+				"swing_modes":               []interface{}{"off", "vertical"},
+				"preset_mode_command_topic": "hvac/bedroom/preset_mode/set",
+				"preset_modes":              []interface{}{"boost"},
+				"min_temp":                  16.0,
+				"max_temp":                  30.0,
+				"temp_step":                 0.5,
+				"current_temperature_topic": "hvac/bedroom/current_temperature/state",
+			},
+		},
+	} {
+		m, client := newTestMQTT()
+		m.RegisterController(DeviceInfo{ID: "bedroom ac", Name: "Bedroom AC", Prefix: "hvac/bedroom"},
+			&fakeController{capabilities: test.capabilities})
+		message, ok := lastPublished(client.takePublished())["homeassistant/climate/bedroom_ac/config"]
+		if !ok || !message.retained {
+			t.Fatalf("%s: discovery published as %+v, want retained", test.name, message)
+		}
+		var config map[string]interface{}
+		if err := json.Unmarshal([]byte(message.payload), &config); err != nil {
+			t.Fatalf("%s: cannot decode %s: %s", test.name, message.payload, err)
+		}
+		for key, want := range test.want {
+			if !reflect.DeepEqual(config[key], want) {
+				t.Errorf("%s: %s = %v, want %v", test.name, key, config[key], want)
+			}
+		}
+		for _, key := range test.absent {
+			if value, ok := config[key]; ok {
+				t.Errorf("%s: %s = %v, want none", test.name, key, value)
+			}
+		}
+	}
+}
+
+func TestDiscoveryRemoved(t *testing.T) {
+	m, client := newTestMQTT()
+	m.RemoveDiscovery("old ac")
+	message, ok := lastPublished(client.takePublished())["homeassistant/climate/old_ac/config"]
+	if !ok || message.payload != "" || !message.retained {
+		t.Errorf("Discovery of the removed device published as %+v, want cleared", message)
+	}
+	m.discoveryPrefix = ""
+	m.RemoveDiscovery("old ac")
+	if published := client.takePublished(); len(published) != 0 {
+		t.Errorf("Published %+v with discovery disabled", published)
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	m, client := newTestMQTT()
+	notifier := m.RegisterController(DeviceInfo{ID: "bedroom", Prefix: "hvac/bedroom"}, &fakeController{})
+	var config struct {
+		Availability     []map[string]string `json:"availability"`
+		AvailabilityMode string              `json:"availability_mode"`
+	}
+	discovery := lastPublished(client.takePublished())["homeassistant/climate/bedroom/config"]
+	if err := json.Unmarshal([]byte(discovery.payload), &config); err != nil {
+		t.Fatal(err)
+	}
+	wantTopics := []map[string]string{{"topic": "bridge/availability"}, {"topic": "hvac/bedroom/mode/availability"}}
+	if !reflect.DeepEqual(config.Availability, wantTopics) || config.AvailabilityMode != "all" {
+		t.Errorf("Availability %v in mode %q, want %v in mode all", config.Availability, config.AvailabilityMode, wantTopics)
+	}
+
+	for _, test := range []struct {
+		online bool
+		want   string
+	}{
+		{true, "online"},
+		{false, "offline"},
+	} {
+		notifier.UpdateAvailability(test.online)
+		want := fakeMessage{topic: "hvac/bedroom/mode/availability", qos: 1, retained: true, payload: test.want}
+		if published := client.takePublished(); !reflect.DeepEqual(published, []fakeMessage{want}) {
+			t.Errorf("UpdateAvailability(%v) published %+v, want %+v", test.online, published, want)
+		}
+	}
+
+	m.Close()
+	want := fakeMessage{topic: "bridge/availability", qos: 1, retained: true, payload: "offline"}
+	if published := client.takePublished(); !reflect.DeepEqual(published, []fakeMessage{want}) {
+		t.Errorf("Close published %+v, want %+v", published, want)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	m, client := newTestMQTT()
+	notifier := m.RegisterController(DeviceInfo{ID: "bedroom", Prefix: "hvac/bedroom"}, &fakeController{})
+	var config map[string]interface{}
+	discovery := lastPublished(client.takePublished())["homeassistant/climate/bedroom/config"]
+	if err := json.Unmarshal([]byte(discovery.payload), &config); err != nil {
+		t.Fatal(err)
+	}
+	if topic := config["json_attributes_topic"]; topic != "hvac/bedroom/attributes" {
+		t.Errorf("json_attributes_topic = %v, want hvac/bedroom/attributes", topic)
+	}
+
+	notifier.UpdateState(State{Extras: map[string]string{"AC_FUN_ERROR": "00000000", "AC_OUTDOOR_TEMP": "12"}})
+	message, ok := lastPublished(client.takePublished())["hvac/bedroom/attributes"]
+	var attributes map[string]string
+	if !ok || json.Unmarshal([]byte(message.payload), &attributes) != nil {
+		t.Fatalf("Attributes published as %+v, want a JSON object", message)
+	}
+	if want := map[string]string{"AC_FUN_ERROR": "00000000", "AC_OUTDOOR_TEMP": "12"}; !reflect.DeepEqual(attributes, want) {
+		t.Errorf("Attributes = %v, want %v", attributes, want)
+	}
+}
+
+func TestQoSAndRetain(t *testing.T) {
+	for _, test := range []struct {
+		qos    byte
+		retain bool
+	}{
+		{0, false},
+		{1, true},
+		{2, true},
+	} {
+		m, client := newTestMQTT()
+		notifier := m.RegisterController(DeviceInfo{ID: "bedroom", Prefix: "hvac/bedroom", QoS: test.qos, Retain: test.retain},
+			&fakeController{capabilities: Capabilities{Modes: Modes}})
+		if len(client.subscribed) == 0 {
+			t.Error("No command topics subscribed")
+		}
+		for topic, qos := range client.subscribed {
+			if qos != test.qos {
+				t.Errorf("Subscribed to %s with QoS %d, want %d", topic, qos, test.qos)
+			}
+		}
+		var config map[string]interface{}
+		discovery := lastPublished(client.takePublished())["homeassistant/climate/bedroom/config"]
+		if err := json.Unmarshal([]byte(discovery.payload), &config); err != nil {
+			t.Fatal(err)
+		}
+		if config["qos"] != float64(test.qos) {
+			t.Errorf("Discovery qos = %v, want %d", config["qos"], test.qos)
+		}
+
+		notifier.UpdateState(State{Power: true, Mode: ModeCool, Setpoint: Float(22)})
+		notifier.UpdateAvailability(true)
+		for _, message := range client.takePublished() {
+			qos, retained := test.qos, test.retain
+			if message.topic == "hvac/bedroom/mode/availability" {
+				// Availability does not follow the device settings.
+				qos, retained = 1, true
+			}
+			if message.qos != qos || message.retained != retained {
+				t.Errorf("Published %s with QoS %d, retained %v, want %d, %v",
+					message.topic, message.qos, message.retained, qos, retained)
+			}
+		}
+	}
+}
+
+func TestPublishOnChange(t *testing.T) {
+	m, client := newTestMQTT()
+	notifier := m.RegisterController(DeviceInfo{ID: "bedroom", Prefix: "hvac/bedroom"}, &fakeController{})
+	client.takePublished()
+	topics := func(messages []fakeMessage) map[string]string {
+		values := make(map[string]string)
+		for _, message := range messages {
+			values[message.topic] = message.payload
+		}
+		return values
+	}
+
+	notifier.UpdateAvailability(true)
+	for _, test := range []struct {
+		name   string
+		update func()
+		want   map[string]string
+	}{
+		{
+			name:   "first state",
+			update: func() { notifier.UpdateState(State{Power: true, Mode: ModeCool, Setpoint: Float(22)}) },
+			want: map[string]string{
+				"hvac/bedroom/mode/availability": "online",
+				"hvac/bedroom/mode/state":        "cool",
+				"hvac/bedroom/action":            "idle",
+				"hvac/bedroom/temperature/state": "22",
+			},
+		},
+		{
+			name:   "unchanged",
+			update: func() { notifier.UpdateState(State{Power: true, Mode: ModeCool, Setpoint: Float(22)}) },
+			want:   map[string]string{},
+		},
+		{
+			name:   "setpoint changed",
+			update: func() { notifier.UpdateState(State{Power: true, Mode: ModeCool, Setpoint: Float(23)}) },
+			want:   map[string]string{"hvac/bedroom/temperature/state": "23"},
+		},
+		{
+			// Periodic and reconnect refreshes send everything again.
+			name:   "refresh",
+			update: m.republish,
+			want: map[string]string{
+				"hvac/bedroom/mode/availability": "online",
+				"hvac/bedroom/mode/state":        "cool",
+				"hvac/bedroom/action":            "idle",
+				"hvac/bedroom/temperature/state": "23",
+			},
+		},
+	} {
+		test.update()
+		if got := topics(client.takePublished()); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: published %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCommandResults(t *testing.T) {
+	m, client := newTestMQTT()
+	controller := &fakeController{capabilities: Capabilities{Modes: []Mode{ModeOff, ModeCool}}}
+	notifier := m.RegisterController(DeviceInfo{ID: "bedroom", Prefix: "hvac/bedroom"}, controller)
+	timestamp := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name      string
+		send      func()
+		success   bool
+		wantError string
+	}{
+		{
+			name: "accepted",
+			send: func() {
+				notifier.UpdateCommandResult(CommandResult{Command: "mode", Value: "cool", Status: "OK", Success: true, Time: timestamp})
+			},
+			success: true,
+		},
+		{
+			name: "failed",
+			send: func() {
+				notifier.UpdateCommandResult(CommandResult{Command: "mode", Value: "cool", Status: "Busy", Time: timestamp})
+			},
+			wantError: "mode cool: Busy",
+		},
+		{
+			name: "unsupported",
+			send: func() { client.deliver("hvac/bedroom/mode/set", "heat") },
+		},
+	} {
+		client.takePublished()
+		test.send()
+		published := lastPublished(client.takePublished())
+		var result CommandResult
+		if err := json.Unmarshal([]byte(published["hvac/bedroom/last_command"].payload), &result); err != nil {
+			t.Errorf("%s: cannot decode last_command: %s", test.name, err)
+			continue
+		}
+		if result.Success != test.success || result.Command != "mode" || result.Status == "" {
+			t.Errorf("%s: last_command = %+v", test.name, result)
+		}
+		gotError, ok := published["hvac/bedroom/error"]
+		if !ok {
+			t.Errorf("%s: error not published", test.name)
+		} else if test.wantError != "" && gotError.payload != test.wantError {
+			t.Errorf("%s: error = %q, want %q", test.name, gotError.payload, test.wantError)
+		} else if !test.success && gotError.payload == "" {
+			t.Errorf("%s: error is empty", test.name)
+		}
+	}
+	if len(controller.commands) != 0 {
+		t.Errorf("Rejected command reached the controller: %v", controller.commands)
+	}
+
+	client.deliver("hvac/bedroom/mode/set", "cool")
+	if want := []string{"mode cool"}; !reflect.DeepEqual(controller.commands, want) {
+		t.Errorf("Controller got %v, want %v", controller.commands, want)
+	}
+}
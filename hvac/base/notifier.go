@@ -0,0 +1,56 @@
+package base
+
+import (
+	"time"
+)
+
+// Notifier reports the state of a device to its StateNotifier, if one is
+// set. It is not safe for concurrent use: drivers hold their mutex while
+// notifying, so that notifications are delivered in order.
+type Notifier struct {
+	stateNotifier StateNotifier
+	// online is the last availability reported.
+	online            bool
+	availabilityKnown bool
+}
+
+func (n *Notifier) SetStateNotifier(stateNotifier StateNotifier) {
+	n.stateNotifier = stateNotifier
+}
+
+// SetOnline reports the availability of the device if it changed.
+func (n *Notifier) SetOnline(online bool) {
+	if n.availabilityKnown && n.online == online {
+		return
+	}
+	n.online = online
+	n.availabilityKnown = true
+	if n.stateNotifier == nil {
+		return
+	}
+	n.stateNotifier.UpdateAvailability(online)
+}
+
+// Online returns the availability last reported.
+func (n *Notifier) Online() bool {
+	return n.online
+}
+
+func (n *Notifier) UpdateState(state State) {
+	if n.stateNotifier == nil {
+		return
+	}
+	n.stateNotifier.UpdateState(state)
+}
+
+// UpdateCommandResult reports the outcome of a command with the status the
+// device answered, or the reason it could not be delivered.
+func (n *Notifier) UpdateCommandResult(result CommandResult, status string, success bool) {
+	result.Status = status
+	result.Success = success
+	result.Time = time.Now()
+	if n.stateNotifier == nil {
+		return
+	}
+	n.stateNotifier.UpdateCommandResult(result)
+}
@@ -0,0 +1,150 @@
+package base
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PolledCommand is a command queued for a Poller. Change describes the
+// change for the driver's apply callback.
+type PolledCommand struct {
+	Result CommandResult
+	Change interface{}
+}
+
+// maxQueuedCommands bounds the commands waiting for a slow unit.
+const maxQueuedCommands = 16
+
+// Poller makes all the exchanges with a polled unit from one goroutine: it
+// polls the unit every interval and applies the queued commands in between,
+// so that exchanges are made one at a time and not by the callers.
+//
+// It shares the mutex and notifier of its driver. The mutex guards the
+// poller's state along with the driver's, and is held while handling the
+// outcome of a poll or a command and notifying it, so notifications are
+// delivered in order, but not during exchanges.
+type Poller struct {
+	interval time.Duration
+	poll     func(ctx context.Context)
+	apply    func(ctx context.Context, command *PolledCommand)
+	mutex    *sync.Mutex
+	notifier *Notifier
+
+	// cancel stops the polling started by Start.
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// state and commands are guarded by mutex. commands is nil while not
+	// started.
+	state    ConnectionState
+	commands chan *PolledCommand
+}
+
+func NewPoller(interval time.Duration, mutex *sync.Mutex, notifier *Notifier,
+	poll func(ctx context.Context), apply func(ctx context.Context, command *PolledCommand)) *Poller {
+	return &Poller{
+		interval: interval,
+		poll:     poll,
+		apply:    apply,
+		mutex:    mutex,
+		notifier: notifier,
+	}
+}
+
+// Start polls the unit right away and then every interval, until Stop.
+func (p *Poller) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	commands := make(chan *PolledCommand, maxQueuedCommands)
+	p.mutex.Lock()
+	p.commands = commands
+	p.notifier.SetOnline(false)
+	p.mutex.Unlock()
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		p.poll(ctx)
+		for {
+			select {
+			case <-ticker.C:
+				p.poll(ctx)
+			case command := <-commands:
+				if ctx.Err() != nil {
+					// Stopped, but the command was selected first.
+					p.mutex.Lock()
+					p.notifier.UpdateCommandResult(command.Result, ErrNotConnected.Error(), false)
+					p.mutex.Unlock()
+					return
+				}
+				p.apply(ctx, command)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop cancels the exchange in progress and waits for the polling goroutine
+// to return, failing the commands still queued.
+func (p *Poller) Stop() {
+	p.mutex.Lock()
+	commands := p.commands
+	p.commands = nil
+	p.mutex.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+		<-p.done
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for len(commands) > 0 {
+		command := <-commands
+		p.notifier.UpdateCommandResult(command.Result, ErrNotConnected.Error(), false)
+	}
+	p.notifier.SetOnline(false)
+}
+
+// Send queues the command for the polling goroutine, failing it if the
+// poller is stopped or too many commands are waiting.
+func (p *Poller) Send(result CommandResult, change interface{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.commands == nil {
+		p.notifier.UpdateCommandResult(result, ErrNotConnected.Error(), false)
+		return
+	}
+	select {
+	case p.commands <- &PolledCommand{Result: result, Change: change}:
+	default:
+		p.notifier.UpdateCommandResult(result, "Too many pending commands", false)
+	}
+}
+
+func (p *Poller) State() ConnectionState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state
+}
+
+// Succeeded records that the unit answered and reports it online. The
+// caller holds the mutex.
+func (p *Poller) Succeeded() {
+	p.state = ConnectionState{
+		Connected: true,
+		NextRetry: time.Now().Add(p.interval),
+	}
+	p.notifier.SetOnline(true)
+}
+
+// Failed records that the unit did not answer and reports it offline. The
+// caller holds the mutex.
+func (p *Poller) Failed(err error) {
+	p.state.Connected = false
+	p.state.Failures++
+	p.state.LastError = err.Error()
+	p.state.NextRetry = time.Now().Add(p.interval)
+	p.notifier.SetOnline(false)
+}
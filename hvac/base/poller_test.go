@@ -0,0 +1,141 @@
+package base_test
+
+import (
+	"context"
+	"errors"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base/basetest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testUnit is a driver whose commands block until released.
+type testUnit struct {
+	mutex    sync.Mutex
+	notifier base.Notifier
+	poller   *base.Poller
+	fail     error
+	// started receives each command taken by the polling goroutine.
+	started chan string
+	release chan struct{}
+	applied []string
+}
+
+func newTestUnit(recorder *basetest.Recorder) *testUnit {
+	u := &testUnit{started: make(chan string, 100), release: make(chan struct{})}
+	u.notifier.SetStateNotifier(recorder)
+	u.poller = base.NewPoller(time.Hour, &u.mutex, &u.notifier, u.poll, u.apply)
+	return u
+}
+
+func (u *testUnit) poll(ctx context.Context) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.fail != nil {
+		u.poller.Failed(u.fail)
+		return
+	}
+	u.poller.Succeeded()
+	u.notifier.UpdateState(base.State{Power: true})
+}
+
+func (u *testUnit) apply(ctx context.Context, command *base.PolledCommand) {
+	u.started <- command.Change.(string)
+	select {
+	case <-u.release:
+	case <-ctx.Done():
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if ctx.Err() != nil {
+		u.notifier.UpdateCommandResult(command.Result, ctx.Err().Error(), false)
+		return
+	}
+	u.applied = append(u.applied, command.Change.(string))
+	u.notifier.UpdateCommandResult(command.Result, "OK", true)
+}
+
+func TestPollerAppliesCommandsInOrder(t *testing.T) {
+	recorder := &basetest.Recorder{}
+	u := newTestUnit(recorder)
+	u.poller.Start()
+	defer u.poller.Stop()
+	recorder.WaitFor(t, 1, 0)
+	for _, value := range []string{"a", "b", "c"} {
+		u.poller.Send(base.CommandResult{Command: "test", Value: value}, value)
+	}
+	close(u.release)
+	recorder.WaitFor(t, 1, 3)
+	u.mutex.Lock()
+	applied := u.applied
+	u.mutex.Unlock()
+	if !reflect.DeepEqual(applied, []string{"a", "b", "c"}) {
+		t.Errorf("Applied %v, want [a b c]", applied)
+	}
+	if state := u.poller.State(); !state.Connected {
+		t.Errorf("State = %+v, want connected", state)
+	}
+	if availability := recorder.Availability(); !reflect.DeepEqual(availability, []bool{false, true}) {
+		t.Errorf("Availability = %v, want [false true]", availability)
+	}
+}
+
+func TestPollerFailsCommandsNotApplied(t *testing.T) {
+	recorder := &basetest.Recorder{}
+	u := newTestUnit(recorder)
+	u.poller.Send(base.CommandResult{Command: "early"}, "early")
+	u.poller.Start()
+	recorder.WaitFor(t, 1, 1)
+	// The first command blocks the goroutine, so the queue fills up.
+	u.poller.Send(base.CommandResult{Command: "blocking"}, "blocking")
+	<-u.started
+	for i := 0; i < 17; i++ {
+		u.poller.Send(base.CommandResult{Command: "queued"}, "queued")
+	}
+	u.poller.Stop()
+	results := recorder.Results()
+	if len(results) != 19 {
+		t.Fatalf("Results = %+v, want 19", results)
+	}
+	statuses := map[string]int{}
+	for _, result := range results {
+		if result.Success {
+			t.Errorf("Result %+v succeeded", result)
+		}
+		statuses[result.Status]++
+	}
+	// The blocking command was canceled, 16 were queued and one overflowed,
+	// besides the one sent before Start.
+	want := map[string]int{
+		base.ErrNotConnected.Error(): 17,
+		"Too many pending commands":  1,
+		context.Canceled.Error():     1,
+	}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("Statuses = %v, want %v", statuses, want)
+	}
+	if u.poller.Send(base.CommandResult{Command: "late"}, "late"); len(recorder.Results()) != 20 {
+		t.Errorf("Command sent after Stop not failed")
+	}
+}
+
+func TestPollerFailed(t *testing.T) {
+	recorder := &basetest.Recorder{}
+	u := newTestUnit(recorder)
+	u.fail = errors.New("no answer")
+	u.poller.Start()
+	defer u.poller.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for u.poller.State().Failures == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	state := u.poller.State()
+	if state.Connected || state.Failures != 1 || state.LastError != "no answer" || state.NextRetry.IsZero() {
+		t.Errorf("State = %+v, want one failure", state)
+	}
+	if availability := recorder.Availability(); !reflect.DeepEqual(availability, []bool{false}) {
+		t.Errorf("Availability = %v, want [false]", availability)
+	}
+}
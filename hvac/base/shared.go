@@ -0,0 +1,240 @@
+package base
+
+import (
+	"strings"
+	"sync"
+)
+
+// SharedConnection tracks the units sharing the connection to a gateway,
+// such as the indoor units of a multi-split or VRF system. The connection
+// is opened when the first unit is added and closed after the last one is
+// removed.
+type SharedConnection struct {
+	// lifecycleMutex serializes opening and closing as units come and go.
+	lifecycleMutex sync.Mutex
+	open           func()
+	close          func()
+	forget         func()
+
+	mutex sync.Mutex
+	// units are the added units, keyed by upper-case id.
+	units map[string]interface{}
+}
+
+// NewSharedConnection returns a SharedConnection calling open and close as
+// units come and go. forget is called whenever no units are left after one
+// is removed, also if it was never added, so that drivers can drop the
+// gateway of units closed without connecting.
+func NewSharedConnection(open, close, forget func()) *SharedConnection {
+	return &SharedConnection{
+		open:   open,
+		close:  close,
+		forget: forget,
+		units:  make(map[string]interface{}),
+	}
+}
+
+// AddUnit routes messages for the id to the unit, opening the connection if
+// it is the first.
+func (s *SharedConnection) AddUnit(id string, unit interface{}) {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	s.mutex.Lock()
+	first := len(s.units) == 0
+	s.units[strings.ToUpper(id)] = unit
+	s.mutex.Unlock()
+	if first {
+		s.open()
+	}
+}
+
+// RemoveUnit stops routing messages to the unit, closing the connection if
+// it was the last one.
+func (s *SharedConnection) RemoveUnit(id string, unit interface{}) {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	s.mutex.Lock()
+	key := strings.ToUpper(id)
+	added := s.units[key] == unit
+	if added {
+		delete(s.units, key)
+	}
+	empty := len(s.units) == 0
+	s.mutex.Unlock()
+	if added && empty {
+		s.close()
+	}
+	if empty {
+		s.forget()
+	}
+}
+
+// Unit returns the unit with the id, or nil.
+func (s *SharedConnection) Unit(id string) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.units[strings.ToUpper(id)]
+}
+
+func (s *SharedConnection) Units() []interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var units []interface{}
+	for _, unit := range s.units {
+		units = append(units, unit)
+	}
+	return units
+}
+
+// Gateways holds the gateways of a driver by address, so that the units
+// configured at the same address share one. Drivers remove a gateway once
+// its last unit is closed. The zero value is empty.
+type Gateways struct {
+	mutex    sync.Mutex
+	gateways map[string]interface{}
+}
+
+// Get returns the gateway at the address. get is called with the gateway
+// already there, or nil for the first unit at the address, and returns the
+// gateway to use or an error if the unit cannot share it.
+func (g *Gateways) Get(address string, get func(existing interface{}) (interface{}, error)) (interface{}, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	gateway, err := get(g.gateways[address])
+	if err != nil {
+		return nil, err
+	}
+	if g.gateways == nil {
+		g.gateways = make(map[string]interface{})
+	}
+	g.gateways[address] = gateway
+	return gateway, nil
+}
+
+// Remove forgets the gateway at the address, unless it was replaced.
+func (g *Gateways) Remove(address string, gateway interface{}) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.gateways[address] == gateway {
+		delete(g.gateways, address)
+	}
+}
+
+// PendingCommand is a message sent to a gateway and awaiting its answer.
+type PendingCommand struct {
+	Message string
+	// Unit sent the message, nil for messages about all units.
+	Unit interface{}
+	// Outcome is reported to the unit once the Last message of its command
+	// is answered.
+	Outcome *CommandOutcome
+	Last    bool
+}
+
+// CommandOutcome collects the answers to the messages sent for one MQTT
+// command.
+type CommandOutcome struct {
+	Result CommandResult
+	// Err is the first error answered, if any.
+	Err string
+}
+
+// PendingCommands are the messages sent to a gateway awaiting their answers,
+// in sending order. The zero value is empty.
+type PendingCommands struct {
+	// sendMutex keeps the messages sent in the order recorded.
+	sendMutex sync.Mutex
+
+	mutex    sync.Mutex
+	commands []*PendingCommand
+}
+
+// Send records the command and sends its message. It is recorded first, as
+// the answer may arrive before send returns, and forgotten if send fails.
+func (p *PendingCommands) Send(command *PendingCommand, send func(message string) error) error {
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+	p.mutex.Lock()
+	p.commands = append(p.commands, command)
+	p.mutex.Unlock()
+	if err := send(command.Message); err != nil {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.remove(command)
+		return err
+	}
+	return nil
+}
+
+// SendCommand sends the messages of an MQTT command of the unit, stopping
+// at the first that fails. The outcome is due when the last is answered.
+func (p *PendingCommands) SendCommand(unit interface{}, result CommandResult, messages []string, send func(message string) error) error {
+	outcome := &CommandOutcome{Result: result}
+	for i, message := range messages {
+		err := p.Send(&PendingCommand{
+			Message: message,
+			Unit:    unit,
+			Outcome: outcome,
+			Last:    i == len(messages)-1,
+		}, send)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Current returns the oldest command, or nil.
+func (p *PendingCommands) Current() *PendingCommand {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.commands) == 0 {
+		return nil
+	}
+	return p.commands[0]
+}
+
+// Has tells whether the message is awaiting its answer.
+func (p *PendingCommands) Has(message string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, command := range p.commands {
+		if command.Message == message {
+			return true
+		}
+	}
+	return false
+}
+
+// Answered removes and returns the oldest command of the unit, or of any
+// unit if nil, or nil if there is none.
+func (p *PendingCommands) Answered(unit interface{}) *PendingCommand {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, command := range p.commands {
+		if unit == nil || command.Unit == unit {
+			p.remove(command)
+			return command
+		}
+	}
+	return nil
+}
+
+// Clear removes and returns all the commands, as their answers are lost
+// with the connection.
+func (p *PendingCommands) Clear() []*PendingCommand {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	commands := p.commands
+	p.commands = nil
+	return commands
+}
+
+func (p *PendingCommands) remove(command *PendingCommand) {
+	for i, pending := range p.commands {
+		if pending == command {
+			p.commands = append(p.commands[:i], p.commands[i+1:]...)
+			return
+		}
+	}
+}
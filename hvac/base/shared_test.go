@@ -0,0 +1,122 @@
+package base
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSharedConnection(t *testing.T) {
+	var events []string
+	shared := NewSharedConnection(
+		func() { events = append(events, "open") },
+		func() { events = append(events, "close") },
+		func() { events = append(events, "forget") })
+	first, second, other := "first", "second", "other"
+	shared.AddUnit("aa", &first)
+	shared.AddUnit("BB", &second)
+	if !reflect.DeepEqual(events, []string{"open"}) {
+		t.Fatalf("Events after adding two units = %v, want [open]", events)
+	}
+	if unit := shared.Unit("AA"); unit != &first {
+		t.Errorf("Unit(AA) = %v, want the first unit", unit)
+	}
+	if unit := shared.Unit("cc"); unit != nil {
+		t.Errorf("Unit(cc) = %v, want nil", unit)
+	}
+	if units := shared.Units(); len(units) != 2 {
+		t.Errorf("Units() = %v, want two", units)
+	}
+	// Removing a unit not added under the id is ignored.
+	shared.RemoveUnit("bb", &other)
+	shared.RemoveUnit("aa", &first)
+	if !reflect.DeepEqual(events, []string{"open"}) {
+		t.Fatalf("Events with a unit left = %v, want [open]", events)
+	}
+	shared.RemoveUnit("bb", &second)
+	shared.AddUnit("aa", &first)
+	if !reflect.DeepEqual(events, []string{"open", "close", "forget", "open"}) {
+		t.Errorf("Events = %v, want [open close forget open]", events)
+	}
+	shared.RemoveUnit("aa", &first)
+	// A unit closed without connecting is removed without being added.
+	events = nil
+	shared.RemoveUnit("aa", &first)
+	if !reflect.DeepEqual(events, []string{"forget"}) {
+		t.Errorf("Events removing a unit never added = %v, want [forget]", events)
+	}
+}
+
+func TestGateways(t *testing.T) {
+	var gateways Gateways
+	get := func(existing interface{}) (interface{}, error) {
+		if existing != nil {
+			return existing, nil
+		}
+		return new(int), nil
+	}
+	a, _ := gateways.Get("host:1", get)
+	b, _ := gateways.Get("host:1", get)
+	c, _ := gateways.Get("host:2", get)
+	if a != b || a == c {
+		t.Errorf("Gateways = %p, %p, %p, want the first two shared", a, b, c)
+	}
+	_, err := gateways.Get("host:1", func(existing interface{}) (interface{}, error) {
+		return nil, fmt.Errorf("Conflict")
+	})
+	if err == nil {
+		t.Errorf("Get succeeded despite the conflict")
+	}
+	if d, _ := gateways.Get("host:1", get); d != a {
+		t.Errorf("Gateway replaced after a refused Get")
+	}
+}
+
+func TestPendingCommands(t *testing.T) {
+	var pending PendingCommands
+	var sent []string
+	send := func(message string) error {
+		// The answer may be handled before sending returns.
+		if pending.Current() == nil {
+			t.Errorf("%s sent before it was recorded", message)
+		}
+		if message == "fail" {
+			return fmt.Errorf("failed")
+		}
+		sent = append(sent, message)
+		return nil
+	}
+	first, second := "first", "second"
+	pending.Send(&PendingCommand{Message: "ls"}, send)
+	result := CommandResult{Command: "mode", Value: "cool"}
+	if err := pending.SendCommand(&first, result, []string{"cool", "on"}, send); err != nil {
+		t.Fatal(err)
+	}
+	if err := pending.SendCommand(&second, result, []string{"heat", "fail", "on"}, send); err == nil {
+		t.Error("SendCommand succeeded despite the failed message")
+	}
+	if !reflect.DeepEqual(sent, []string{"ls", "cool", "on", "heat"}) {
+		t.Errorf("Sent %q, want up to the failed message", sent)
+	}
+	if !pending.Has("ls") || pending.Has("fail") {
+		t.Errorf("Has(ls) = %v, Has(fail) = %v, want true, false", pending.Has("ls"), pending.Has("fail"))
+	}
+
+	if command := pending.Answered(&second); command == nil || command.Message != "heat" {
+		t.Errorf("Answered(second) = %+v, want heat", command)
+	}
+	if command := pending.Answered(nil); command == nil || command.Message != "ls" {
+		t.Errorf("Answered(nil) = %+v, want ls", command)
+	}
+	command := pending.Answered(&first)
+	if command == nil || command.Message != "cool" || command.Last || command.Outcome.Result != result {
+		t.Errorf("Answered(first) = %+v, want cool of the mode command", command)
+	}
+	commands := pending.Clear()
+	if len(commands) != 1 || commands[0].Message != "on" || !commands[0].Last || commands[0].Outcome != command.Outcome {
+		t.Errorf("Clear() = %+v, want the last message of the mode command", commands)
+	}
+	if pending.Current() != nil {
+		t.Errorf("Current() = %+v after Clear", pending.Current())
+	}
+}
@@ -0,0 +1,100 @@
+package base
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Mode is the operating mode of a unit, as exchanged with Home Assistant.
+type Mode string
+
+const (
+	ModeOff     Mode = "off"
+	ModeAuto    Mode = "auto"
+	ModeCool    Mode = "cool"
+	ModeHeat    Mode = "heat"
+	ModeDry     Mode = "dry"
+	ModeFanOnly Mode = "fan_only"
+)
+
+// Modes are all the known operating modes.
+var Modes = []Mode{ModeOff, ModeAuto, ModeCool, ModeHeat, ModeDry, ModeFanOnly}
+
+func ParseMode(value string) (Mode, error) {
+	for _, mode := range Modes {
+		if strings.EqualFold(value, string(mode)) {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown mode %q", value)
+}
+
+// ParsePower accepts the ON/OFF payloads sent by Home Assistant, in any case.
+func ParsePower(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "1":
+		return true, nil
+	case "off", "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("Unknown power value %q", value)
+}
+
+func ParseTemperature(value string) (float64, error) {
+	temperature, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid temperature %q", value)
+	}
+	return temperature, nil
+}
+
+// Action is what a unit is currently doing.
+type Action string
+
+const (
+	ActionOff     Action = "off"
+	ActionIdle    Action = "idle"
+	ActionCooling Action = "cooling"
+	ActionHeating Action = "heating"
+	ActionDrying  Action = "drying"
+	ActionFan     Action = "fan"
+)
+
+// State is the state of a unit at one point in time. Drivers translate their
+// device's representation to and from it. Empty strings and nil values are
+// not known for the device.
+type State struct {
+	Power bool `json:"power"`
+	// Mode is the selected operating mode, which is kept while powered off.
+	Mode   Mode   `json:"mode"`
+	Action Action `json:"action,omitempty"`
+	// FanMode, SwingMode and PresetMode use the Home Assistant names, see
+	// SwingModes.
+	FanMode            string   `json:"fan_mode,omitempty"`
+	SwingMode          string   `json:"swing_mode,omitempty"`
+	PresetMode         string   `json:"preset_mode,omitempty"`
+	Setpoint           *float64 `json:"setpoint,omitempty"`
+	CurrentTemperature *float64 `json:"current_temperature,omitempty"`
+	Humidity           *float64 `json:"humidity,omitempty"`
+	// Extras are device specific values, published as attributes.
+	Extras map[string]string `json:"extras,omitempty"`
+}
+
+// EffectiveMode is the mode reported to Home Assistant, which has no
+// separate power state.
+func (s State) EffectiveMode() Mode {
+	if !s.Power {
+		return ModeOff
+	}
+	return s.Mode
+}
+
+// Float returns a pointer to the value, for setting optional State fields.
+func Float(value float64) *float64 {
+	return &value
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,104 @@
+package base
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// TLSOptions configures the TLS handshake with a device.
+type TLSOptions struct {
+	// CertFile and KeyFile hold the client certificate presented to the
+	// device. KeyFile may be omitted if CertFile also contains the key.
+	CertFile string
+	KeyFile  string
+	// CipherSuites are crypto/tls cipher suite names, such as
+	// "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA".
+	CipherSuites []string
+	// MinVersion and MaxVersion are "1.0", "1.1", "1.2" or "1.3".
+	MinVersion string
+	MaxVersion string
+	// Fingerprint is the hex SHA-256 digest of the device certificate. The
+	// certificate is not verified otherwise, as devices use self-signed ones.
+	Fingerprint string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig builds a client TLS configuration from the options.
+func NewTLSConfig(options TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ClientAuth:         tls.NoClientCert,
+		InsecureSkipVerify: true,
+	}
+	if len(options.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range options.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("Unknown TLS cipher suite: %s", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	if options.MinVersion != "" {
+		version, ok := tlsVersions[options.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS min version: %s", options.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if options.MaxVersion != "" {
+		version, ok := tlsVersions[options.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS max version: %s", options.MaxVersion)
+		}
+		config.MaxVersion = version
+	}
+	if config.MinVersion != 0 && config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return nil, fmt.Errorf("TLS min version %s is above max version %s", options.MinVersion, options.MaxVersion)
+	}
+	if options.KeyFile != "" && options.CertFile == "" {
+		return nil, fmt.Errorf("TLS key file given without certificate file")
+	}
+	if options.CertFile != "" {
+		keyFile := options.KeyFile
+		if keyFile == "" {
+			keyFile = options.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(options.CertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load TLS client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if options.Fingerprint != "" {
+		fingerprint, err := hex.DecodeString(strings.Replace(options.Fingerprint, ":", "", -1))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return nil, fmt.Errorf("TLS fingerprint must be a hex SHA-256 digest: %s", options.Fingerprint)
+		}
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("no server certificate")
+			}
+			digest := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(digest[:], fingerprint) {
+				return fmt.Errorf("server certificate fingerprint %s does not match", hex.EncodeToString(digest[:]))
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,93 @@
+package base
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestTLSFingerprint(t *testing.T) {
+	certificate := []byte("device certificate")
+	digest := sha256.Sum256(certificate)
+	fingerprint := hex.EncodeToString(digest[:])
+	var pairs []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		pairs = append(pairs, fingerprint[i:i+2])
+	}
+	for _, test := range []struct {
+		name        string
+		fingerprint string
+		rawCerts    [][]byte
+		wantErr     bool
+	}{
+		{"match", fingerprint, [][]byte{certificate}, false},
+		{"colon separated", strings.ToUpper(strings.Join(pairs, ":")), [][]byte{certificate}, false},
+		{"mismatch", fingerprint, [][]byte{[]byte("other certificate")}, true},
+		{"no certificate", fingerprint, nil, true},
+	} {
+		config, err := NewTLSConfig(TLSOptions{Fingerprint: test.fingerprint})
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		err = config.VerifyPeerCertificate(test.rawCerts, nil)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: VerifyPeerCertificate() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		options TLSOptions
+		wantErr bool
+		check   func(config *tls.Config) bool
+	}{
+		{
+			name:    "versions",
+			options: TLSOptions{MinVersion: "1.0", MaxVersion: "1.2"},
+			check: func(config *tls.Config) bool {
+				return config.MinVersion == tls.VersionTLS10 && config.MaxVersion == tls.VersionTLS12
+			},
+		},
+		{
+			name:    "cipher suites",
+			options: TLSOptions{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"}},
+			check: func(config *tls.Config) bool {
+				return len(config.CipherSuites) == 1 &&
+					config.CipherSuites[0] == tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA
+			},
+		},
+		{
+			name:    "no fingerprint",
+			options: TLSOptions{},
+			check: func(config *tls.Config) bool {
+				return config.VerifyPeerCertificate == nil
+			},
+		},
+		{name: "min above max", options: TLSOptions{MinVersion: "1.2", MaxVersion: "1.0"}, wantErr: true},
+		{name: "unknown version", options: TLSOptions{MinVersion: "2.0"}, wantErr: true},
+		{name: "unknown cipher suite", options: TLSOptions{CipherSuites: []string{"TLS_NONE"}}, wantErr: true},
+		{name: "key without certificate", options: TLSOptions{KeyFile: "key.pem"}, wantErr: true},
+		{name: "short fingerprint", options: TLSOptions{Fingerprint: "ab:cd"}, wantErr: true},
+		{name: "invalid fingerprint", options: TLSOptions{Fingerprint: strings.Repeat("zz", sha256.Size)}, wantErr: true},
+	} {
+		config, err := NewTLSConfig(test.options)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: NewTLSConfig() succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !test.check(config) {
+			t.Errorf("%s: unexpected config %+v", test.name, config)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package base
+
+import (
+	"strings"
+)
+
+// Translation maps a value exchanged over MQTT to the value of a device.
+type Translation struct {
+	MQTT   string
+	Device string
+}
+
+// Translations is a translation table, looked up ignoring case. A value
+// listed several times translates as its first entry, and unknown values
+// translate as "".
+type Translations []Translation
+
+func (t Translations) ToDevice(value string) string {
+	for _, e := range t {
+		if strings.EqualFold(value, e.MQTT) {
+			return e.Device
+		}
+	}
+	return ""
+}
+
+func (t Translations) FromDevice(value string) string {
+	for _, e := range t {
+		if strings.EqualFold(value, e.Device) {
+			return e.MQTT
+		}
+	}
+	return ""
+}
+
+// MQTTValues returns the values exchanged over MQTT, in table order.
+func (t Translations) MQTTValues() []string {
+	var values []string
+	seen := make(map[string]bool)
+	for _, e := range t {
+		if !seen[e.MQTT] {
+			seen[e.MQTT] = true
+			values = append(values, e.MQTT)
+		}
+	}
+	return values
+}
+
+// CodeTranslation maps a value exchanged over MQTT to the numeric code of a
+// device.
+type CodeTranslation struct {
+	MQTT string
+	Code int
+}
+
+// CodeTranslations is a translation table to numeric codes. Unknown values
+// translate as 0 and unknown codes as "".
+type CodeTranslations []CodeTranslation
+
+func (t CodeTranslations) ToDevice(value string) int {
+	for _, e := range t {
+		if strings.EqualFold(value, e.MQTT) {
+			return e.Code
+		}
+	}
+	return 0
+}
+
+func (t CodeTranslations) FromDevice(code int) string {
+	for _, e := range t {
+		if code == e.Code {
+			return e.MQTT
+		}
+	}
+	return ""
+}
+
+// MQTTValues returns the values exchanged over MQTT, in table order.
+func (t CodeTranslations) MQTTValues() []string {
+	var values []string
+	seen := make(map[string]bool)
+	for _, e := range t {
+		if !seen[e.MQTT] {
+			seen[e.MQTT] = true
+			values = append(values, e.MQTT)
+		}
+	}
+	return values
+}
@@ -0,0 +1,33 @@
+package base
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTranslations(t *testing.T) {
+	table := Translations{
+		{MQTT: "heat", Device: "Heat"},
+		{MQTT: "heat", Device: "Haux"},
+		{MQTT: "fan_only", Device: "Fan"},
+	}
+	if got := table.ToDevice("HEAT"); got != "Heat" {
+		t.Errorf("ToDevice(HEAT) = %q, want Heat", got)
+	}
+	if got := table.FromDevice("haux"); got != "heat" {
+		t.Errorf("FromDevice(haux) = %q, want heat", got)
+	}
+	if got := table.ToDevice("cool"); got != "" {
+		t.Errorf("ToDevice(cool) = %q, want empty", got)
+	}
+	if got := table.MQTTValues(); !reflect.DeepEqual(got, []string{"heat", "fan_only"}) {
+		t.Errorf("MQTTValues() = %v, want [heat fan_only]", got)
+	}
+	codes := CodeTranslations{{MQTT: "auto", Code: 0}, {MQTT: "cool", Code: 1}}
+	if got := codes.ToDevice("Cool"); got != 1 {
+		t.Errorf("ToDevice(Cool) = %d, want 1", got)
+	}
+	if got := codes.FromDevice(7); got != "" {
+		t.Errorf("FromDevice(7) = %q, want empty", got)
+	}
+}
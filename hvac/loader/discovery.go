@@ -0,0 +1,76 @@
+package loader
+
+import (
+	"context"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models/samsung"
+	"log"
+	"time"
+)
+
+// lanDiscoveryTimeout is how long to wait for units to answer.
+const lanDiscoveryTimeout = 5 * time.Second
+
+type LANDiscoveryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often to search, such as "10m". Only searches at
+	// startup if not given.
+	Interval string `yaml:"interval"`
+	// Publish sends the unconfigured devices to the bridge's discovered topic.
+	Publish bool `yaml:"publish"`
+}
+
+// runLANDiscovery searches for Samsung units on the network, reporting the
+// ones that are not configured.
+func (bridge *Bridge) runLANDiscovery(ctx context.Context, interval time.Duration, publish bool) {
+	for {
+		bridge.discoverUnconfigured(ctx, publish)
+		if interval <= 0 {
+			return
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (bridge *Bridge) discoverUnconfigured(ctx context.Context, publish bool) {
+	ctx, cancel := context.WithTimeout(ctx, lanDiscoveryTimeout)
+	defer cancel()
+	found, err := samsung.Discover(ctx)
+	if err != nil {
+		log.Printf("LAN discovery failed: %s", err)
+		return
+	}
+	unconfigured := unconfiguredDevices(bridge.configs, found)
+	for _, device := range unconfigured {
+		log.Printf("Found unconfigured device %s at %s (model %s)", device.DUID, device.Host, device.Model)
+	}
+	if publish {
+		bridge.MQTT.PublishDiscovered(unconfigured)
+	}
+}
+
+// unconfiguredDevices returns the found devices whose DUID and host are not
+// configured. DUIDs are compared in the normalized form units report.
+func unconfiguredDevices(configs []DeviceConfig, found []samsung.DiscoveredDevice) []samsung.DiscoveredDevice {
+	configuredDUIDs := make(map[string]bool)
+	configuredHosts := make(map[string]bool)
+	for _, config := range configs {
+		if duid := samsung.NormalizeDUID(config.DUID); duid != "" {
+			configuredDUIDs[duid] = true
+		}
+		if config.Host != "" {
+			configuredHosts[config.Host] = true
+		}
+	}
+	unconfigured := []samsung.DiscoveredDevice{}
+	for _, device := range found {
+		if configuredDUIDs[samsung.NormalizeDUID(device.DUID)] || configuredHosts[device.Host] {
+			continue
+		}
+		unconfigured = append(unconfigured, device)
+	}
+	return unconfigured
+}
@@ -0,0 +1,29 @@
+package loader
+
+import (
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models/samsung"
+	"reflect"
+	"testing"
+)
+
+func TestUnconfiguredDevices(t *testing.T) {
+	configs := []DeviceConfig{
+		{Name: "mac", DUID: "f8:04:2e:aa:bb:cc", Host: "10.0.0.2"},
+		{Name: "dashes", DUID: "f8-04-2e-aa-bb-dd"},
+		{Name: "no duid", Host: "10.0.0.4"},
+	}
+	found := []samsung.DiscoveredDevice{
+		{DUID: "F8042EAABBCC", Host: "10.0.0.12"},
+		{DUID: "F8042EAABBDD", Host: "10.0.0.13"},
+		{DUID: "F8042EAABBEE", Host: "10.0.0.4"},
+		{DUID: "", Host: "10.0.0.15"},
+		{DUID: "F8042EAABBFF", Host: "10.0.0.16"},
+	}
+	want := []samsung.DiscoveredDevice{
+		{DUID: "", Host: "10.0.0.15"},
+		{DUID: "F8042EAABBFF", Host: "10.0.0.16"},
+	}
+	if got := unconfiguredDevices(configs, found); !reflect.DeepEqual(got, want) {
+		t.Errorf("unconfiguredDevices() = %+v, want %+v", got, want)
+	}
+}
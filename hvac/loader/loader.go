@@ -1,17 +1,24 @@
 package loader
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	yaml "github.com/goccy/go-yaml"
 	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
 	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models"
 	"io/ioutil"
 	"log"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Config struct {
-	MQTT    *MQTTConfig    `yaml:"mqtt"`
-	Devices []DeviceConfig `yaml:"devices"`
+	MQTT         *MQTTConfig         `yaml:"mqtt"`
+	Devices      []DeviceConfig      `yaml:"devices"`
+	LANDiscovery *LANDiscoveryConfig `yaml:"lan_discovery"`
 }
 
 type MQTTConfig struct {
@@ -20,8 +27,31 @@ type MQTTConfig struct {
 	Protocol string `yaml:"protocol"`
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
+	// TLS settings for ssl:// and wss:// brokers.
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+	Insecure   bool   `yaml:"insecure"`
+	// QoS and Retain apply to state publications and command subscriptions,
+	// unless overridden per device. State is retained by default.
+	QoS    *int  `yaml:"qos"`
+	Retain *bool `yaml:"retain"`
+	// RefreshInterval is a duration such as "15m" after which all state is
+	// republished even if unchanged.
+	RefreshInterval string `yaml:"refresh_interval"`
+	// Discovery enables Home Assistant MQTT discovery. On by default.
+	Discovery       *bool  `yaml:"discovery"`
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+	// BridgeTopic is the prefix for the bridge's own topics.
+	BridgeTopic string `yaml:"bridge_topic"`
+	// RemovedDevices lists ids of devices whose discovery entries should be
+	// deleted from Home Assistant.
+	RemovedDevices []string `yaml:"removed_devices"`
 }
 
+// DeviceConfig holds the settings common to all models. The settings of the
+// model's driver are decoded by the driver from the same YAML node.
 type DeviceConfig struct {
 	Name       string `yaml:"name"`
 	Model      string `yaml:"model"`
@@ -29,41 +59,319 @@ type DeviceConfig struct {
 	Port       string `yaml:"port"`
 	MQTTPrefix string `yaml:"mqtt_prefix"`
 	DUID       string `yaml:"duid"`
-	AuthToken  string `yaml:"auth_token"`
+	// QoS and Retain override the mqtt section settings for this device.
+	QoS    *int  `yaml:"qos"`
+	Retain *bool `yaml:"retain"`
+	// Connection timings, as durations such as "15s".
+	DialTimeout     string `yaml:"dial_timeout"`
+	WriteTimeout    string `yaml:"write_timeout"`
+	ResponseTimeout string `yaml:"response_timeout"`
+	ReadTimeout     string `yaml:"read_timeout"`
+	RetryDelay      string `yaml:"retry_delay"`
+	MaxRetryDelay   string `yaml:"max_retry_delay"`
+	// TLS configures the handshake with the device.
+	TLS *DeviceTLSConfig `yaml:"tls"`
+	// Capabilities restricts the settings offered for the unit.
+	Capabilities *CapabilitiesConfig `yaml:"capabilities"`
+
+	// node is the device's YAML, decoded again by the driver.
+	node []byte
+}
+
+func (config *DeviceConfig) UnmarshalYAML(data []byte) error {
+	// deviceConfig has no UnmarshalYAML method, avoiding recursion.
+	type deviceConfig DeviceConfig
+	if err := yaml.Unmarshal(data, (*deviceConfig)(config)); err != nil {
+		return err
+	}
+	config.node = append([]byte(nil), data...)
+	return nil
+}
+
+// CapabilitiesConfig overrides the capabilities reported by the driver. Only
+// the given settings are replaced.
+type CapabilitiesConfig struct {
+	Modes           []string `yaml:"modes"`
+	FanModes        []string `yaml:"fan_modes"`
+	SwingModes      []string `yaml:"swing_modes"`
+	PresetModes     []string `yaml:"preset_modes"`
+	MinTemperature  *float64 `yaml:"min_temp"`
+	MaxTemperature  *float64 `yaml:"max_temp"`
+	TemperatureStep *float64 `yaml:"temp_step"`
+}
+
+type DeviceTLSConfig struct {
+	CertFile     string   `yaml:"cert_file"`
+	KeyFile      string   `yaml:"key_file"`
+	CipherSuites []string `yaml:"cipher_suites"`
+	MinVersion   string   `yaml:"min_version"`
+	MaxVersion   string   `yaml:"max_version"`
+	// Fingerprint is the SHA-256 digest of the device certificate.
+	Fingerprint string `yaml:"fingerprint"`
 }
 
 type Device struct {
+	name       string
 	mqtt       *base.MQTT
 	controller base.Controller
 }
 
-func NewDevice(mqtt *base.MQTT, deviceConfig DeviceConfig) (*Device, error) {
-	controller, err := models.NewController(
-		deviceConfig.Model,
-		deviceConfig.Name,
-		deviceConfig.Host,
-		deviceConfig.Port,
-		deviceConfig.DUID,
-		deviceConfig.AuthToken)
+func NewDevice(mqtt *base.MQTT, mqttConfig *MQTTConfig, deviceConfig DeviceConfig) (*Device, error) {
+	qos := mqttConfig.QoS
+	if deviceConfig.QoS != nil {
+		qos = deviceConfig.QoS
+	}
+	qosValue, err := mqttQoS(qos)
+	if err != nil {
+		return nil, fmt.Errorf("Device %s: %s", deviceConfig.Name, err)
+	}
+	retain := true
+	if deviceConfig.Retain != nil {
+		retain = *deviceConfig.Retain
+	} else if mqttConfig.Retain != nil {
+		retain = *mqttConfig.Retain
+	}
 
-	log.Printf("Registering controller %s %s", deviceConfig.Name, deviceConfig.MQTTPrefix)
-	notifier := mqtt.RegisterController(deviceConfig.Name, deviceConfig.MQTTPrefix, controller)
-	controller.SetStateNotifier(notifier)
+	if err := models.Check(deviceConfig.Model); err != nil {
+		return nil, fmt.Errorf("Device %s: %s", deviceConfig.Name, err)
+	}
 
+	connectionOptions, err := newConnectionOptions(deviceConfig)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Device %s: %s", deviceConfig.Name, err)
 	}
+
+	controller, err := models.NewController(deviceConfig.Model, models.Params{
+		Name:              deviceConfig.Name,
+		Host:              deviceConfig.Host,
+		Port:              deviceConfig.Port,
+		DUID:              deviceConfig.DUID,
+		ConnectionOptions: connectionOptions,
+		Decode: func(config interface{}) error {
+			return yaml.Unmarshal(deviceConfig.node, config)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Device %s: %s", deviceConfig.Name, err)
+	}
+	if deviceConfig.Capabilities != nil {
+		capabilities, err := overrideCapabilities(controller.Capabilities(), deviceConfig.Capabilities)
+		if err != nil {
+			controller.Close()
+			return nil, fmt.Errorf("Device %s: %s", deviceConfig.Name, err)
+		}
+		controller = base.OverrideCapabilities(controller, capabilities)
+	}
+
+	log.Printf("Registering controller %s %s", deviceConfig.Name, deviceConfig.MQTTPrefix)
+	notifier := mqtt.RegisterController(base.DeviceInfo{
+		ID:     deviceConfig.Name,
+		Name:   deviceConfig.Name,
+		Prefix: deviceConfig.MQTTPrefix,
+		Model:  deviceConfig.Model,
+		DUID:   deviceConfig.DUID,
+		QoS:    qosValue,
+		Retain: retain,
+	}, controller)
+	controller.SetStateNotifier(notifier)
 	return &Device{
+		name:       deviceConfig.Name,
 		mqtt:       mqtt,
 		controller: controller,
 	}, nil
 }
 
+func (device *Device) Name() string {
+	return device.name
+}
+
 func (device *Device) Run() {
 	device.controller.Connect()
 }
 
-func Load(configFile string) ([]*Device, error) {
+// Stop disconnects from the device, reporting it offline.
+func (device *Device) Stop() {
+	device.controller.Close()
+}
+
+// ConnectionState reports the state of the connection to the device.
+func (device *Device) ConnectionState() base.ConnectionState {
+	return device.controller.ConnectionState()
+}
+
+// Snapshot returns the current state of the device.
+func (device *Device) Snapshot() base.State {
+	return device.controller.Snapshot()
+}
+
+// Capabilities returns the settings supported by the device.
+func (device *Device) Capabilities() base.Capabilities {
+	return device.controller.Capabilities()
+}
+
+func overrideCapabilities(capabilities base.Capabilities, config *CapabilitiesConfig) (base.Capabilities, error) {
+	if config.Modes != nil {
+		var modes []base.Mode
+		for _, name := range config.Modes {
+			mode, err := base.ParseMode(name)
+			if err != nil {
+				return capabilities, err
+			}
+			if !supportsMode(capabilities.Modes, mode) {
+				return capabilities, fmt.Errorf("Unsupported mode %q", name)
+			}
+			modes = append(modes, mode)
+		}
+		capabilities.Modes = modes
+	}
+	settings := []struct {
+		name   string
+		config []string
+		dest   *[]string
+	}{
+		{"fan mode", config.FanModes, &capabilities.FanModes},
+		{"swing mode", config.SwingModes, &capabilities.SwingModes},
+		{"preset mode", config.PresetModes, &capabilities.PresetModes},
+	}
+	for _, setting := range settings {
+		if setting.config == nil {
+			continue
+		}
+		values, err := restrict(setting.name, *setting.dest, setting.config)
+		if err != nil {
+			return capabilities, err
+		}
+		*setting.dest = values
+	}
+	if config.MinTemperature != nil {
+		capabilities.MinTemperature = *config.MinTemperature
+	}
+	if config.MaxTemperature != nil {
+		capabilities.MaxTemperature = *config.MaxTemperature
+	}
+	if config.TemperatureStep != nil {
+		capabilities.TemperatureStep = *config.TemperatureStep
+	}
+	if capabilities.MaxTemperature != 0 && capabilities.MinTemperature > capabilities.MaxTemperature {
+		return capabilities, fmt.Errorf("min_temp is above max_temp")
+	}
+	if capabilities.TemperatureStep < 0 {
+		return capabilities, fmt.Errorf("temp_step must not be negative")
+	}
+	return capabilities, nil
+}
+
+func supportsMode(modes []base.Mode, mode base.Mode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// restrict returns the supported values named, as the driver spells them.
+// Overrides can only remove values, as the driver cannot translate others.
+func restrict(setting string, supported, names []string) ([]string, error) {
+	values := []string{}
+	for _, name := range names {
+		found := false
+		for _, value := range supported {
+			if strings.EqualFold(name, value) {
+				values = append(values, value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unsupported %s %q", setting, name)
+		}
+	}
+	return values, nil
+}
+
+func newConnectionOptions(deviceConfig DeviceConfig) (base.ConnectionOptions, error) {
+	var options base.ConnectionOptions
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"dial_timeout", deviceConfig.DialTimeout, &options.DialTimeout},
+		{"write_timeout", deviceConfig.WriteTimeout, &options.WriteTimeout},
+		{"response_timeout", deviceConfig.ResponseTimeout, &options.ResponseTimeout},
+		{"read_timeout", deviceConfig.ReadTimeout, &options.ReadTimeout},
+		{"retry_delay", deviceConfig.RetryDelay, &options.RetryDelay},
+		{"max_retry_delay", deviceConfig.MaxRetryDelay, &options.MaxRetryDelay},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return options, fmt.Errorf("Invalid %s: %s", d.name, err)
+		}
+		if duration <= 0 {
+			return options, fmt.Errorf("%s must be positive", d.name)
+		}
+		*d.dest = duration
+	}
+	if tlsConfig := deviceConfig.TLS; tlsConfig != nil {
+		options.TLS = base.TLSOptions{
+			CertFile:     tlsConfig.CertFile,
+			KeyFile:      tlsConfig.KeyFile,
+			CipherSuites: tlsConfig.CipherSuites,
+			MinVersion:   tlsConfig.MinVersion,
+			MaxVersion:   tlsConfig.MaxVersion,
+			Fingerprint:  tlsConfig.Fingerprint,
+		}
+	}
+	return options, nil
+}
+
+// Bridge is the set of configured devices along with their MQTT connection.
+type Bridge struct {
+	MQTT    *base.MQTT
+	Devices []*Device
+
+	configs      []DeviceConfig
+	lanDiscovery *LANDiscoveryConfig
+	// cancel stops background work started by Run.
+	cancel context.CancelFunc
+}
+
+func (bridge *Bridge) Run() {
+	for _, device := range bridge.Devices {
+		device.Run()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	bridge.cancel = cancel
+	if bridge.lanDiscovery != nil && bridge.lanDiscovery.Enabled {
+		// Interval was validated by Load.
+		interval, _ := time.ParseDuration(bridge.lanDiscovery.Interval)
+		go bridge.runLANDiscovery(ctx, interval, bridge.lanDiscovery.Publish)
+	}
+}
+
+// Stop disconnects all devices and then the MQTT connection.
+func (bridge *Bridge) Stop() {
+	if bridge.cancel != nil {
+		bridge.cancel()
+	}
+	var wg sync.WaitGroup
+	for _, device := range bridge.Devices {
+		wg.Add(1)
+		go func(device *Device) {
+			defer wg.Done()
+			device.Stop()
+		}(device)
+	}
+	wg.Wait()
+	bridge.MQTT.Close()
+}
+
+func Load(configFile string) (*Bridge, error) {
 	configData, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return nil, err
@@ -75,29 +383,157 @@ func Load(configFile string) ([]*Device, error) {
 	if config.MQTT == nil {
 		return nil, fmt.Errorf("mqtt missing in configuration")
 	}
-	protocol := config.MQTT.Protocol
-	if protocol == "" {
-		protocol = "tcp"
+	mqttOptions, err := newMQTTOptions(config.MQTT)
+	if err != nil {
+		return nil, err
 	}
-	host := config.MQTT.Host
-	if host == "" {
-		return nil, fmt.Errorf("MQTT host not given")
+	if config.LANDiscovery != nil && config.LANDiscovery.Interval != "" {
+		if _, err := time.ParseDuration(config.LANDiscovery.Interval); err != nil {
+			return nil, fmt.Errorf("Invalid lan_discovery interval: %s", err)
+		}
 	}
-	port := config.MQTT.Port
-	if port == "" {
-		port = "1883"
+	mqtt := base.NewMQTT(mqttOptions)
+	for _, id := range config.MQTT.RemovedDevices {
+		mqtt.RemoveDiscovery(id)
 	}
-	mqttBroker := fmt.Sprintf("%s://%s:%s", protocol, config.MQTT.Host, port)
-	mqtt := base.NewMQTT(mqttBroker, "hvac_ip_mqtt_bridge")
 
 	var devices []*Device
 	for _, deviceConfig := range config.Devices {
-		device, err := NewDevice(mqtt, deviceConfig)
+		device, err := NewDevice(mqtt, config.MQTT, deviceConfig)
 		if err != nil {
+			// Releases the gateways registered by the devices already created
+			// and stops the MQTT refresh.
+			for _, device := range devices {
+				device.Stop()
+			}
+			mqtt.Close()
 			return nil, err
 		}
 		devices = append(devices, device)
 	}
 	mqtt.Connect()
-	return devices, nil
+	return &Bridge{
+		MQTT:         mqtt,
+		Devices:      devices,
+		configs:      config.Devices,
+		lanDiscovery: config.LANDiscovery,
+	}, nil
+}
+
+func newMQTTOptions(config *MQTTConfig) (base.MQTTOptions, error) {
+	var options base.MQTTOptions
+	protocol := config.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	secure := false
+	switch protocol {
+	case "tcp", "ws":
+	case "ssl", "tls", "wss":
+		secure = true
+	default:
+		return options, fmt.Errorf("MQTT protocol not supported: %s", protocol)
+	}
+	host := config.Host
+	if host == "" {
+		return options, fmt.Errorf("MQTT host not given")
+	}
+	port := config.Port
+	if port == "" {
+		port = "1883"
+		if secure {
+			port = "8883"
+		}
+	}
+	if _, err := mqttQoS(config.QoS); err != nil {
+		return options, err
+	}
+	if config.Password != "" && config.Username == "" {
+		return options, fmt.Errorf("MQTT password given without username")
+	}
+	var refreshInterval time.Duration
+	if config.RefreshInterval != "" {
+		interval, err := time.ParseDuration(config.RefreshInterval)
+		if err != nil {
+			return options, fmt.Errorf("Invalid MQTT refresh_interval: %s", err)
+		}
+		if interval <= 0 {
+			return options, fmt.Errorf("MQTT refresh_interval must be positive")
+		}
+		refreshInterval = interval
+	}
+	tlsConfig, err := newMQTTTLSConfig(config)
+	if err != nil {
+		return options, err
+	}
+	if tlsConfig != nil && !secure {
+		return options, fmt.Errorf("MQTT TLS options given for non-TLS protocol %s", protocol)
+	}
+
+	discoveryPrefix := ""
+	if config.Discovery == nil || *config.Discovery {
+		discoveryPrefix = config.DiscoveryPrefix
+		if discoveryPrefix == "" {
+			discoveryPrefix = "homeassistant"
+		}
+	}
+	bridgeTopic := config.BridgeTopic
+	if bridgeTopic == "" {
+		bridgeTopic = "hvac_ip_mqtt_bridge/bridge"
+	}
+	return base.MQTTOptions{
+		Broker:          fmt.Sprintf("%s://%s:%s", protocol, host, port),
+		ClientID:        "hvac_ip_mqtt_bridge",
+		Username:        config.Username,
+		Password:        config.Password,
+		TLSConfig:       tlsConfig,
+		DiscoveryPrefix: discoveryPrefix,
+		BridgeTopic:     bridgeTopic,
+		RefreshInterval: refreshInterval,
+	}, nil
+}
+
+func mqttQoS(qos *int) (byte, error) {
+	if qos == nil {
+		return 0, nil
+	}
+	if *qos < 0 || *qos > 2 {
+		return 0, fmt.Errorf("MQTT QoS must be 0, 1 or 2, got %d", *qos)
+	}
+	return byte(*qos), nil
+}
+
+// newMQTTTLSConfig builds the TLS configuration for the broker connection,
+// returning nil if no TLS options are set.
+func newMQTTTLSConfig(config *MQTTConfig) (*tls.Config, error) {
+	if config.CAFile == "" && config.CertFile == "" && config.KeyFile == "" &&
+		config.ServerName == "" && !config.Insecure {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.Insecure,
+	}
+	if config.CAFile != "" {
+		caData, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read MQTT CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("No certificates found in MQTT CA file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("MQTT cert_file and key_file must be given together")
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load MQTT client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
 }
@@ -0,0 +1,138 @@
+package loader
+
+import (
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverrideCapabilities(t *testing.T) {
+	driver := base.Capabilities{
+		Modes:          []base.Mode{base.ModeOff, base.ModeAuto, base.ModeCool, base.ModeHeat},
+		FanModes:       []string{"auto", "low", "medium", "high"},
+		SwingModes:     []string{"off", "vertical"},
+		PresetModes:    []string{"quiet", "boost"},
+		MinTemperature: 16,
+		MaxTemperature: 30,
+	}
+	minTemperature := 18.0
+	for _, test := range []struct {
+		name    string
+		config  CapabilitiesConfig
+		want    base.Capabilities
+		wantErr bool
+	}{
+		{
+			name: "restricted",
+			config: CapabilitiesConfig{
+				Modes:          []string{"off", "cool"},
+				FanModes:       []string{"Auto", "high"},
+				SwingModes:     []string{},
+				MinTemperature: &minTemperature,
+			},
+			want: base.Capabilities{
+				Modes:          []base.Mode{base.ModeOff, base.ModeCool},
+				FanModes:       []string{"auto", "high"},
+				SwingModes:     []string{},
+				PresetModes:    driver.PresetModes,
+				MinTemperature: 18,
+				MaxTemperature: 30,
+			},
+		},
+		{
+			name:   "not overridden",
+			config: CapabilitiesConfig{},
+			want:   driver,
+		},
+		{
+			name:    "unsupported mode",
+			config:  CapabilitiesConfig{Modes: []string{"cool", "dry"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			config:  CapabilitiesConfig{Modes: []string{"frost"}},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported fan mode",
+			config:  CapabilitiesConfig{FanModes: []string{"auto", "turbo"}},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported swing mode",
+			config:  CapabilitiesConfig{SwingModes: []string{"horizontal"}},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported preset mode",
+			config:  CapabilitiesConfig{PresetModes: []string{"eco"}},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := overrideCapabilities(driver, &test.config)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("overrideCapabilities() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("overrideCapabilities() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadReleasesGateways(t *testing.T) {
+	for _, token := range []string{"first-token", "second-token"} {
+		configFile, cleanup := writeConfig(t, `mqtt:
+  host: broker
+devices:
+  - name: bedroom
+    model: samsungac2878
+    host: 10.0.0.9
+    auth_token: `+token+`
+  - name: attic
+    model: frost
+`)
+		defer cleanup()
+		// Without releasing the bedroom gateway, the second load would fail
+		// on the conflicting auth_token instead.
+		_, err := Load(configFile)
+		if err == nil || !strings.Contains(err.Error(), "attic") {
+			t.Errorf("Load with token %s: got error %v, want one for attic", token, err)
+		}
+	}
+}
+
+func TestMQTTRefreshInterval(t *testing.T) {
+	for _, test := range []struct {
+		interval string
+		want     time.Duration
+		wantErr  bool
+	}{
+		{interval: "", want: 0},
+		{interval: "15m", want: 15 * time.Minute},
+		{interval: "0s", wantErr: true},
+		{interval: "-1m", wantErr: true},
+		{interval: "often", wantErr: true},
+	} {
+		options, err := newMQTTOptions(&MQTTConfig{Host: "broker", RefreshInterval: test.interval})
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("refresh_interval %q accepted", test.interval)
+			}
+			continue
+		}
+		if err != nil || options.RefreshInterval != test.want {
+			t.Errorf("refresh_interval %q = %s, %v, want %s", test.interval, options.RefreshInterval, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package loader
+
+import (
+	"bytes"
+	"fmt"
+	yaml "github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+	"io/ioutil"
+)
+
+// UpdateDeviceConfig sets the given values on the device with the given name
+// in the configuration file, adding the device if it is not configured yet.
+// The previous file is kept with a .bak suffix, since comments are not
+// preserved.
+func UpdateDeviceConfig(configFile string, name string, values yaml.MapSlice) error {
+	configData, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	var config Config
+	if err := yaml.Unmarshal(configData, &config); err != nil {
+		return err
+	}
+	file, err := parser.ParseBytes(configData, 0)
+	if err != nil {
+		return err
+	}
+
+	index := -1
+	for i, device := range config.Devices {
+		if device.Name == name {
+			index = i
+		}
+	}
+	newDevices := []yaml.MapSlice{append(yaml.MapSlice{{Key: "name", Value: name}}, values...)}
+	var output []byte
+	if index >= 0 {
+		output, err = mergeConfig(file, fmt.Sprintf("$.devices[%d]", index), values, false)
+	} else if len(config.Devices) > 0 {
+		output, err = mergeConfig(file, "$.devices", newDevices, false)
+	} else if devicesPath, _ := yaml.PathString("$.devices"); hasNode(devicesPath, file) {
+		output, err = mergeConfig(file, "$.devices", newDevices, true)
+	} else {
+		// There is no devices section to merge into, so add one at the end.
+		var devicesData []byte
+		devicesData, err = yaml.Marshal(yaml.MapSlice{{Key: "devices", Value: newDevices}})
+		output = append(bytes.TrimRight(configData, "\n"), '\n')
+		output = append(output, devicesData...)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot update %s: %s", configFile, err)
+	}
+
+	if err := ioutil.WriteFile(configFile+".bak", configData, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configFile, output, 0600)
+}
+
+func hasNode(path *yaml.Path, file *ast.File) bool {
+	_, err := path.FilterFile(file)
+	return err == nil
+}
+
+// mergeConfig merges or replaces the node at path with the value, returning
+// the updated file contents.
+func mergeConfig(file *ast.File, path string, value interface{}, replace bool) ([]byte, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	yamlPath, err := yaml.PathString(path)
+	if err != nil {
+		return nil, err
+	}
+	if replace {
+		err = yamlPath.ReplaceWithReader(file, bytes.NewReader(data))
+	} else {
+		err = yamlPath.MergeFromReader(file, bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(file.String() + "\n"), nil
+}
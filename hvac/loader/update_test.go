@@ -0,0 +1,116 @@
+package loader
+
+import (
+	yaml "github.com/goccy/go-yaml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, data string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(configFile, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return configFile, func() { os.RemoveAll(dir) }
+}
+
+func readConfig(t *testing.T, configFile string) Config {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		t.Fatalf("Cannot parse updated config %s: %s", data, err)
+	}
+	return config
+}
+
+func TestUpdateDeviceConfig(t *testing.T) {
+	const mqtt = "mqtt:\n  host: broker\n"
+	values := yaml.MapSlice{
+		{Key: "model", Value: "samsungac2878"},
+		{Key: "host", Value: "10.0.0.5"},
+		{Key: "auth_token", Value: "new-token"},
+	}
+	tests := []struct {
+		name    string
+		data    string
+		devices []string
+	}{
+		{
+			name:    "no devices section",
+			data:    mqtt,
+			devices: []string{"bedroom"},
+		},
+		{
+			name:    "empty devices section",
+			data:    mqtt + "devices:\n",
+			devices: []string{"bedroom"},
+		},
+		{
+			name:    "other device configured",
+			data:    mqtt + "devices:\n  - name: kitchen\n    model: daikin\n    host: 10.0.0.6\n",
+			devices: []string{"kitchen", "bedroom"},
+		},
+		{
+			name: "device configured",
+			data: mqtt + "devices:\n  - name: bedroom\n    model: samsungac2878\n    host: 10.0.0.4\n" +
+				"    auth_token: old-token\n  - name: kitchen\n    model: daikin\n    host: 10.0.0.6\n",
+			devices: []string{"bedroom", "kitchen"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configFile, cleanup := writeConfig(t, test.data)
+			defer cleanup()
+			if err := UpdateDeviceConfig(configFile, "bedroom", values); err != nil {
+				t.Fatalf("UpdateDeviceConfig failed: %s", err)
+			}
+			config := readConfig(t, configFile)
+			if config.MQTT == nil || config.MQTT.Host != "broker" {
+				t.Errorf("mqtt section lost: %+v", config.MQTT)
+			}
+			var names []string
+			for _, device := range config.Devices {
+				names = append(names, device.Name)
+				if device.Name != "bedroom" {
+					continue
+				}
+				if device.Model != "samsungac2878" || device.Host != "10.0.0.5" {
+					t.Errorf("got device %+v", device)
+				}
+				var token struct {
+					AuthToken string `yaml:"auth_token"`
+				}
+				if err := yaml.Unmarshal(device.node, &token); err != nil || token.AuthToken != "new-token" {
+					t.Errorf("got auth_token %q, error %v", token.AuthToken, err)
+				}
+			}
+			if len(names) != len(test.devices) {
+				t.Fatalf("got devices %q, want %q", names, test.devices)
+			}
+			for i := range names {
+				if names[i] != test.devices[i] {
+					t.Errorf("got devices %q, want %q", names, test.devices)
+				}
+			}
+			backup, err := ioutil.ReadFile(configFile + ".bak")
+			if err != nil || string(backup) != test.data {
+				t.Errorf("got backup %q, error %v", backup, err)
+			}
+		})
+	}
+}
+
+func TestUpdateDeviceConfigMissingFile(t *testing.T) {
+	if err := UpdateDeviceConfig(filepath.Join(os.TempDir(), "missing", "config.yaml"), "bedroom", nil); err == nil {
+		t.Error("updated a missing file")
+	}
+}
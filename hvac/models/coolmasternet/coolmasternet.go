@@ -0,0 +1,291 @@
+package coolmasternet
+
+import (
+	"fmt"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	models.Register("coolmasternet", newFromConfig)
+}
+
+// Config is the coolmasternet specific part of the device configuration. The
+// duid is the UID of the indoor unit on the gateway, such as "L1.100".
+type Config struct {
+	// PollInterval is how often the gateway lists its units, such as "10s".
+	// The units configured on a gateway must have the same setting.
+	PollInterval string `yaml:"poll_interval"`
+	// TemperatureUnit is the scale the gateway is set to, "C" (the default)
+	// or "F".
+	TemperatureUnit string `yaml:"temperature_unit"`
+}
+
+const (
+	defaultPort         = "10102"
+	defaultPollInterval = time.Second * 10
+)
+
+func newFromConfig(params models.Params) (base.Controller, error) {
+	var config Config
+	if err := params.Decode(&config); err != nil {
+		return nil, err
+	}
+	if !uidPattern.MatchString(params.DUID) {
+		return nil, fmt.Errorf("Invalid duid %q: must be the UID of the unit, such as L1.100", params.DUID)
+	}
+	pollInterval := defaultPollInterval
+	if config.PollInterval != "" {
+		var err error
+		pollInterval, err = time.ParseDuration(config.PollInterval)
+		if err != nil || pollInterval <= 0 {
+			return nil, fmt.Errorf("Invalid poll_interval %q", config.PollInterval)
+		}
+	}
+	scale := strings.ToUpper(config.TemperatureUnit)
+	switch scale {
+	case "":
+		scale = "C"
+	case "C", "F":
+	default:
+		return nil, fmt.Errorf("Invalid temperature_unit %q: must be C or F", config.TemperatureUnit)
+	}
+	return NewCoolMasterNet(params.Name, params.Host, params.Port, params.DUID,
+		pollInterval, scale, params.ConnectionOptions)
+}
+
+// CoolMasterNet controls an indoor unit of a VRF system through a
+// CoolAutomation CoolMasterNet gateway.
+type CoolMasterNet struct {
+	name string
+	uid  string
+	// scale is the temperature scale of the gateway, "C" or "F".
+	scale string
+
+	// gateway is the connection shared with other units of the gateway.
+	gateway *gateway
+
+	// mutex guards the fields below, and is held while notifying a row or an
+	// answer so that the notifications keep the gateway's order.
+	mutex    sync.Mutex
+	notifier base.Notifier
+	row      row
+	listed   bool
+	// scaleWarned is set once a row in another scale has been logged.
+	scaleWarned bool
+}
+
+func NewCoolMasterNet(name, host, port, uid string, pollInterval time.Duration,
+	scale string, options base.ConnectionOptions) (*CoolMasterNet, error) {
+	if port == "" {
+		port = defaultPort
+	}
+	gateway, err := getGateway(host, port, pollInterval, options)
+	if err != nil {
+		return nil, err
+	}
+	return &CoolMasterNet{
+		name:    name,
+		uid:     uid,
+		scale:   scale,
+		gateway: gateway,
+	}, nil
+}
+
+func (c *CoolMasterNet) SetStateNotifier(stateNotifier base.StateNotifier) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notifier.SetStateNotifier(stateNotifier)
+}
+
+func (c *CoolMasterNet) ConnectionState() base.ConnectionState {
+	return c.gateway.connection.State()
+}
+
+func (c *CoolMasterNet) Connect() {
+	c.mutex.Lock()
+	c.notifier.SetOnline(false)
+	c.mutex.Unlock()
+	c.gateway.units.AddUnit(c.uid, c)
+}
+
+func (c *CoolMasterNet) Close() {
+	log.Printf("Closing %s", c.name)
+	// Removed unlocked: closing the last unit waits for the gateway, which
+	// may be handing this unit a row.
+	c.gateway.units.RemoveUnit(c.uid, c)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notifier.SetOnline(false)
+}
+
+func (c *CoolMasterNet) handleRow(r row) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if r.scale != "" && r.scale != c.scale && !c.scaleWarned {
+		log.Printf("%s (%s) reports temperatures in %s, but temperature_unit is %s", c.name, c.uid, r.scale, c.scale)
+		c.scaleWarned = true
+	}
+	c.row = r
+	c.listed = true
+	c.notifier.SetOnline(true)
+	c.notifier.UpdateState(c.snapshot())
+}
+
+// missing marks the unit offline when the gateway no longer lists it.
+func (c *CoolMasterNet) missing() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.notifier.Online() {
+		log.Printf("%s (%s) is not listed by the gateway", c.name, c.uid)
+	}
+	c.notifier.SetOnline(false)
+}
+
+func (c *CoolMasterNet) connectionLost() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notifier.SetOnline(false)
+}
+
+// handleOutcome reports the answer to the unit's last command. An empty
+// error means all its command lines succeeded.
+func (c *CoolMasterNet) handleOutcome(outcome *base.CommandOutcome, err string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	status := "OK"
+	if err != "" {
+		status = err
+	}
+	c.notifier.UpdateCommandResult(outcome.Result, status, err == "")
+}
+
+func (c *CoolMasterNet) Snapshot() base.State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.snapshot()
+}
+
+func (c *CoolMasterNet) snapshot() base.State {
+	if !c.listed {
+		return base.State{}
+	}
+	r := c.row
+	state := base.State{
+		Power:              r.power,
+		Mode:               base.Mode(modeRowTable.FromDevice(r.mode)),
+		FanMode:            fanModeRowTable.FromDevice(r.fanSpeed),
+		Setpoint:           r.setpoint,
+		CurrentTemperature: r.temperature,
+		Extras: map[string]string{
+			"failure": r.failure,
+			"filter":  strconv.FormatBool(r.filter),
+			"demand":  r.demand,
+		},
+	}
+	switch state.EffectiveMode() {
+	case base.ModeOff:
+		state.Action = base.ActionOff
+	case base.ModeFanOnly:
+		state.Action = base.ActionFan
+	default:
+		// Demand tells whether the unit is asking the outdoor unit for
+		// heating or cooling.
+		if r.demand == "0" {
+			state.Action = base.ActionIdle
+			break
+		}
+		switch state.Mode {
+		case base.ModeCool:
+			state.Action = base.ActionCooling
+		case base.ModeHeat:
+			state.Action = base.ActionHeating
+		case base.ModeDry:
+			state.Action = base.ActionDrying
+		}
+	}
+	return state
+}
+
+func (c *CoolMasterNet) Capabilities() base.Capabilities {
+	capabilities := base.Capabilities{
+		Modes:              base.Modes,
+		FanModes:           fanModeCommandTable.MQTTValues(),
+		MinTemperature:     16,
+		MaxTemperature:     30,
+		TemperatureStep:    1,
+		TemperatureUnit:    c.scale,
+		CurrentTemperature: true,
+	}
+	if c.scale == "F" {
+		capabilities.MinTemperature = 61
+		capabilities.MaxTemperature = 86
+	}
+	return capabilities
+}
+
+func (c *CoolMasterNet) SetPower(on bool) {
+	value := "OFF"
+	command := "off"
+	if on {
+		value = "ON"
+		command = "on"
+	}
+	c.sendCommands("power", value, command+" "+c.uid)
+}
+
+func (c *CoolMasterNet) SetMode(mode base.Mode) {
+	if mode == base.ModeOff {
+		c.sendCommands("mode", string(mode), "off "+c.uid)
+		return
+	}
+	c.sendCommands("mode", string(mode),
+		modeCommandTable.ToDevice(string(mode))+" "+c.uid,
+		"on "+c.uid)
+}
+
+func (c *CoolMasterNet) SetFanMode(fanMode string) {
+	c.sendCommands("fan_mode", fanMode, "fspeed "+c.uid+" "+fanModeCommandTable.ToDevice(fanMode))
+}
+
+func (c *CoolMasterNet) SetSwingMode(swingMode string) {
+	c.notSupported("swing_mode", swingMode)
+}
+
+func (c *CoolMasterNet) SetPresetMode(presetMode string) {
+	c.notSupported("preset_mode", presetMode)
+}
+
+func (c *CoolMasterNet) SetTemperature(temperature float64) {
+	value := strconv.FormatFloat(temperature, 'f', -1, 64)
+	c.sendCommands("temperature", value, "temp "+c.uid+" "+value)
+}
+
+// sendCommands sends the command lines through the gateway. The result is
+// reported when the gateway answers the last one.
+func (c *CoolMasterNet) sendCommands(command, value string, lines ...string) {
+	result := base.CommandResult{
+		Command: command,
+		Value:   value,
+	}
+	if err := c.gateway.sendCommands(c, result, lines...); err != nil {
+		log.Printf("Command %s for %s failed: %s", strings.Join(lines, ", "), c.name, err)
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.notifier.UpdateCommandResult(result, err.Error(), false)
+	}
+}
+
+func (c *CoolMasterNet) notSupported(command, value string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notifier.UpdateCommandResult(base.CommandResult{
+		Command: command,
+		Value:   value,
+	}, "Not supported", false)
+}
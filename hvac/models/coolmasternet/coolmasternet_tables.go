@@ -0,0 +1,120 @@
+package coolmasternet
+
+import (
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// modeRowTable maps modes to the ls column, and modeCommandTable to the
+// command selecting them. Haux, heating with the auxiliary heater, is
+// reported as heat.
+var modeRowTable = base.Translations{
+	{MQTT: "auto", Device: "Auto"},
+	{MQTT: "cool", Device: "Cool"},
+	{MQTT: "dry", Device: "Dry"},
+	{MQTT: "fan_only", Device: "Fan"},
+	{MQTT: "heat", Device: "Heat"},
+	{MQTT: "heat", Device: "Haux"},
+}
+
+var modeCommandTable = base.Translations{
+	{MQTT: "auto", Device: "auto"},
+	{MQTT: "cool", Device: "cool"},
+	{MQTT: "dry", Device: "dry"},
+	{MQTT: "fan_only", Device: "fan"},
+	{MQTT: "heat", Device: "heat"},
+}
+
+var fanModeRowTable = base.Translations{
+	{MQTT: "auto", Device: "Auto"},
+	{MQTT: "very_low", Device: "VLow"},
+	{MQTT: "low", Device: "Low"},
+	{MQTT: "medium", Device: "Med"},
+	{MQTT: "high", Device: "High"},
+	{MQTT: "top", Device: "Top"},
+}
+
+var fanModeCommandTable = base.Translations{
+	{MQTT: "auto", Device: "a"},
+	{MQTT: "very_low", Device: "v"},
+	{MQTT: "low", Device: "l"},
+	{MQTT: "medium", Device: "m"},
+	{MQTT: "high", Device: "h"},
+	{MQTT: "top", Device: "t"},
+}
+
+// row is a line of the ls command, such as
+// "L1.100 ON  22C 24C Low  Cool OK   - 1".
+type row struct {
+	uid         string
+	power       bool
+	setpoint    *float64
+	temperature *float64
+	fanSpeed    string
+	mode        string
+	failure     string
+	filter      bool
+	demand      string
+	// scale is the temperature scale of the row, "C" or "F".
+	scale string
+}
+
+var uidPattern = regexp.MustCompile(`^[A-Za-z][0-9]+\.[0-9]+$`)
+
+func parseRow(line string) (row, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 6 || !uidPattern.MatchString(fields[0]) {
+		return row{}, false
+	}
+	r := row{
+		uid:         fields[0],
+		setpoint:    parseTemperature(fields[2]),
+		temperature: parseTemperature(fields[3]),
+		scale:       temperatureScale(fields[2]),
+		fanSpeed:    fields[4],
+		mode:        fields[5],
+	}
+	switch strings.ToUpper(fields[1]) {
+	case "ON":
+		r.power = true
+	case "OFF":
+	default:
+		return row{}, false
+	}
+	if len(fields) > 6 {
+		r.failure = fields[6]
+	}
+	if len(fields) > 7 {
+		r.filter = fields[7] == "#"
+	}
+	if len(fields) > 8 {
+		r.demand = fields[8]
+	}
+	return r, true
+}
+
+// temperatureScale returns the scale of a temperature such as "22C", or ""
+// if it has none.
+func temperatureScale(value string) string {
+	if value == "" {
+		return ""
+	}
+	switch scale := strings.ToUpper(value[len(value)-1:]); scale {
+	case "C", "F":
+		return scale
+	}
+	return ""
+}
+
+// parseTemperature parses temperatures such as "22C" or "71.5F", in the
+// scale the gateway is set to.
+func parseTemperature(value string) *float64 {
+	value = strings.TrimRight(value, "CFcf")
+	temperature, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	return &temperature
+}
@@ -0,0 +1,250 @@
+package coolmasternet
+
+import (
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base/basetest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRow(t *testing.T) {
+	for _, test := range []struct {
+		line                  string
+		want                  row
+		setpoint, temperature float64
+		ok                    bool
+	}{
+		{
+			line:        "L1.100 ON  22C 24C Low  Cool OK   - 1",
+			want:        row{uid: "L1.100", power: true, fanSpeed: "Low", mode: "Cool", failure: "OK", demand: "1", scale: "C"},
+			setpoint:    22,
+			temperature: 24,
+			ok:          true,
+		},
+		{
+			line:        "L1.101 OFF 71.5F 70F High Haux OK   # 0",
+			want:        row{uid: "L1.101", fanSpeed: "High", mode: "Haux", failure: "OK", filter: true, demand: "0", scale: "F"},
+			setpoint:    71.5,
+			temperature: 70,
+			ok:          true,
+		},
+		{
+			line:        "L2.003 ON  20C 19C Auto Dry",
+			want:        row{uid: "L2.003", power: true, fanSpeed: "Auto", mode: "Dry", scale: "C"},
+			setpoint:    20,
+			temperature: 19,
+			ok:          true,
+		},
+		{line: "L1.100 ON  22C 24C Low"},
+		{line: "L1.100 STANDBY 22C 24C Low Cool OK - 1"},
+		{line: "ls L1.100"},
+		{line: "OK"},
+		{line: "Unsupported Feature"},
+	} {
+		got, ok := parseRow(test.line)
+		if ok != test.ok {
+			t.Errorf("parseRow(%q) ok = %v, want %v", test.line, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got.setpoint == nil || *got.setpoint != test.setpoint ||
+			got.temperature == nil || *got.temperature != test.temperature {
+			t.Errorf("parseRow(%q) temperatures = %v, %v, want %v, %v", test.line,
+				got.setpoint, got.temperature, test.setpoint, test.temperature)
+		}
+		got.setpoint, got.temperature = nil, nil
+		if got != test.want {
+			t.Errorf("parseRow(%q) = %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
+
+// newTestGateway returns a gateway using a fake connection, with a unit for
+// each of the UIDs.
+func newTestGateway(t *testing.T, uids ...string) (*gateway, *basetest.Connection, []*CoolMasterNet, []*basetest.Recorder) {
+	connection := &basetest.Connection{}
+	g := newGateway("fake", t.Name(), time.Hour, base.ConnectionOptions{}, connection)
+	var units []*CoolMasterNet
+	var recorders []*basetest.Recorder
+	for _, uid := range uids {
+		unit := &CoolMasterNet{name: uid, uid: uid, scale: "C", gateway: g}
+		notifier := basetest.NewRecorder(unit)
+		unit.Connect()
+		t.Cleanup(unit.Close)
+		units = append(units, unit)
+		recorders = append(recorders, notifier)
+	}
+	return g, connection, units, recorders
+}
+
+func TestCommandAnswered(t *testing.T) {
+	g, connection, units, recorders := newTestGateway(t, "L1.100")
+	units[0].SetMode(base.ModeHeat)
+	wantSent := []string{"heat L1.100\n", "on L1.100\n", "ls L1.100\n"}
+	if sent := connection.TakeSent(); !reflect.DeepEqual(sent, wantSent) {
+		t.Fatalf("Sent %q, want %q", sent, wantSent)
+	}
+	connection.Deliver(">heat L1.100", "OK", ">on L1.100")
+	if len(recorders[0].Results()) != 0 {
+		t.Fatalf("Result reported before the last command was answered: %+v", recorders[0].Results())
+	}
+	connection.Deliver("OK")
+	if results := recorders[0].Results(); len(results) != 1 ||
+		!results[0].Success || results[0].Status != "OK" ||
+		results[0].Command != "mode" || results[0].Value != "heat" {
+		t.Fatalf("Results = %+v, want one successful mode result", results)
+	}
+	connection.Deliver(">ls L1.100", "L1.100 ON  22C 24C Low  Haux OK   - 1", "OK")
+	states := recorders[0].States()
+	if len(states) != 1 {
+		t.Fatalf("States = %+v, want one", states)
+	}
+	if state := states[0]; !state.Power || state.Mode != base.ModeHeat ||
+		state.FanMode != "low" || state.Action != base.ActionHeating {
+		t.Errorf("State = %+v, want heating at low fan speed", state)
+	}
+	if availability := recorders[0].Availability(); !reflect.DeepEqual(availability, []bool{false, true}) {
+		t.Errorf("Availability = %v, want [false true]", availability)
+	}
+	if g.pending.Current() != nil {
+		t.Errorf("Command %q still pending", g.pending.Current().Message)
+	}
+}
+
+func TestCommandFailed(t *testing.T) {
+	g, connection, units, recorders := newTestGateway(t, "L1.100")
+	units[0].SetMode(base.ModeCool)
+	connection.TakeSent()
+	connection.Deliver(">cool L1.100", "Unsupported Feature", ">on L1.100", "OK")
+	if results := recorders[0].Results(); len(results) != 1 ||
+		results[0].Success || results[0].Status != "Unsupported Feature" {
+		t.Fatalf("Results = %+v, want one failed result", results)
+	}
+	if command := g.pending.Current(); command == nil || command.Message != "ls L1.100" {
+		t.Errorf("Pending command = %+v, want the read back", command)
+	}
+}
+
+func TestCommandsOfUnitsAnsweredInOrder(t *testing.T) {
+	_, connection, units, recorders := newTestGateway(t, "L1.100", "L1.101")
+	units[0].SetFanMode("high")
+	units[1].SetTemperature(23)
+	wantSent := []string{"fspeed L1.100 h\n", "ls L1.100\n", "temp L1.101 23\n", "ls L1.101\n"}
+	if sent := connection.TakeSent(); !reflect.DeepEqual(sent, wantSent) {
+		t.Fatalf("Sent %q, want %q", sent, wantSent)
+	}
+	connection.Deliver(">fspeed L1.100 h", "OK", ">ls L1.100", "L1.100 ON  22C 24C High Cool OK   - 1", "OK",
+		">temp L1.101 23", "Temperature out of range")
+	if results := recorders[0].Results(); len(results) != 1 || !results[0].Success || results[0].Command != "fan_mode" {
+		t.Errorf("Results of L1.100 = %+v, want one successful fan_mode result", results)
+	}
+	if results := recorders[1].Results(); len(results) != 1 || results[0].Success || results[0].Command != "temperature" {
+		t.Errorf("Results of L1.101 = %+v, want one failed temperature result", results)
+	}
+	if len(recorders[0].States()) != 1 || len(recorders[1].States()) != 0 {
+		t.Errorf("Row of L1.100 routed to %d and %d states, want 1 and 0",
+			len(recorders[0].States()), len(recorders[1].States()))
+	}
+}
+
+func TestPollRoutesRowsAndMarksMissingUnits(t *testing.T) {
+	g, connection, _, recorders := newTestGateway(t, "L1.100", "L1.101")
+	g.poll()
+	// A poll is not repeated while the previous one is unanswered.
+	g.poll()
+	if sent := connection.TakeSent(); !reflect.DeepEqual(sent, []string{"ls\n"}) {
+		t.Fatalf("Sent %q, want one ls", sent)
+	}
+	connection.Deliver(">ls",
+		"L1.100 ON  22C 24C Low  Cool OK   - 1",
+		"L1.101 OFF 25C 26C Auto Fan  OK   - 0",
+		"L1.102 ON  20C 21C Auto Cool OK   - 1",
+		"OK")
+	if states := recorders[0].States(); len(states) != 1 || states[0].Mode != base.ModeCool {
+		t.Errorf("States of L1.100 = %+v, want one in cool mode", states)
+	}
+	if states := recorders[1].States(); len(states) != 1 || states[0].Mode != base.ModeFanOnly || states[0].Power {
+		t.Errorf("States of L1.101 = %+v, want one powered off in fan mode", states)
+	}
+
+	g.poll()
+	connection.TakeSent()
+	connection.Deliver(">ls", "L1.100 ON  22C 24C Low  Cool OK   - 1", "OK")
+	if availability := recorders[0].Availability(); !reflect.DeepEqual(availability, []bool{false, true}) {
+		t.Errorf("Availability of L1.100 = %v, want [false true]", availability)
+	}
+	if availability := recorders[1].Availability(); !reflect.DeepEqual(availability, []bool{false, true, false}) {
+		t.Errorf("Availability of L1.101 = %v, want [false true false]", availability)
+	}
+}
+
+func TestReadExpectedWhileAnswerPending(t *testing.T) {
+	g, connection, _, _ := newTestGateway(t, "L1.100")
+	g.poll()
+	connection.Deliver(">ls", "L1.100 ON  22C 24C Low  Cool OK   - 1")
+	if reads := connection.ExpectedReads(); reads != 2 {
+		t.Errorf("Reads expected during the answer = %d, want 2", reads)
+	}
+	connection.Deliver("OK")
+	if reads := connection.ExpectedReads(); reads != 2 {
+		t.Errorf("Reads expected after the answer = %d, want 2", reads)
+	}
+}
+
+func TestConnectionLostFailsPendingCommands(t *testing.T) {
+	g, connection, units, recorders := newTestGateway(t, "L1.100")
+	connection.Deliver("L1.100 ON  22C 24C Low  Cool OK   - 1")
+	units[0].SetPower(false)
+	connection.TakeSent()
+	g.OnConnectionLost()
+	if results := recorders[0].Results(); len(results) != 1 || results[0].Success || results[0].Status != "Connection lost" {
+		t.Errorf("Results = %+v, want one failed with Connection lost", results)
+	}
+	if availability := recorders[0].Availability(); !reflect.DeepEqual(availability, []bool{false, true, false}) {
+		t.Errorf("Availability = %v, want [false true false]", availability)
+	}
+	if g.pending.Current() != nil {
+		t.Errorf("Command %q still pending", g.pending.Current().Message)
+	}
+}
+
+func TestGatewaySharedByUnits(t *testing.T) {
+	options := base.ConnectionOptions{ReadTimeout: time.Second}
+	g, err := getGateway("fake", t.Name(), time.Second, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gateways.Remove(g.address(), g)
+	if other, err := getGateway("fake", t.Name(), time.Second, options); err != nil || other != g {
+		t.Errorf("Second unit got %p, %v, want the shared gateway", other, err)
+	}
+	if _, err := getGateway("fake", t.Name(), time.Minute, options); err == nil {
+		t.Errorf("Conflicting poll_interval accepted")
+	}
+	if _, err := getGateway("fake", t.Name(), time.Second, base.ConnectionOptions{}); err == nil {
+		t.Errorf("Conflicting connection options accepted")
+	}
+}
+
+func TestCapabilitiesFollowScale(t *testing.T) {
+	for _, test := range []struct {
+		scale    string
+		min, max float64
+	}{
+		{"C", 16, 30},
+		{"F", 61, 86},
+	} {
+		unit := &CoolMasterNet{scale: test.scale}
+		capabilities := unit.Capabilities()
+		if capabilities.MinTemperature != test.min || capabilities.MaxTemperature != test.max ||
+			capabilities.TemperatureUnit != test.scale {
+			t.Errorf("Capabilities in %s = %+v, want %v-%v%s", test.scale, capabilities, test.min, test.max, test.scale)
+		}
+		if err := capabilities.CheckTemperature(72); (err == nil) != (test.scale == "F") {
+			t.Errorf("CheckTemperature(72) in %s = %v", test.scale, err)
+		}
+	}
+}
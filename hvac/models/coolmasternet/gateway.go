@@ -0,0 +1,244 @@
+package coolmasternet
+
+import (
+	"context"
+	"fmt"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gateway is a connection to a CoolMasterNet shared by all the indoor units
+// configured at its address. It polls them all with a single ls command and
+// routes the rows to the units by UID.
+type gateway struct {
+	host         string
+	port         string
+	pollInterval time.Duration
+	// options are the connection options of the first unit. Other units of
+	// the gateway must use the same ones.
+	options    base.ConnectionOptions
+	connection base.Connection
+	// units are the connected units, by UID.
+	units *base.SharedConnection
+
+	// cancel stops the polling started with the connection.
+	cancel context.CancelFunc
+	done   chan struct{}
+	// pending are the command lines awaiting their answer, as the gateway
+	// answers them one after the other.
+	pending base.PendingCommands
+
+	mutex sync.Mutex
+	// seen are the UIDs listed in answer to the pending poll.
+	seen map[string]bool
+}
+
+// pollLine lists all the units.
+const pollLine = "ls"
+
+var gateways base.Gateways
+
+func newGateway(host, port string, pollInterval time.Duration, options base.ConnectionOptions, connection base.Connection) *gateway {
+	g := &gateway{
+		host:         host,
+		port:         port,
+		pollInterval: pollInterval,
+		options:      options,
+		connection:   connection,
+	}
+	g.units = base.NewSharedConnection(g.open, g.close, func() {
+		gateways.Remove(g.address(), g)
+	})
+	return g
+}
+
+func (g *gateway) address() string {
+	return g.host + ":" + g.port
+}
+
+// getGateway returns the gateway for the given host and port, creating it
+// with the given poll interval and options if this is its first unit. Units
+// sharing a gateway must agree on its poll interval and options.
+func getGateway(host, port string, pollInterval time.Duration, options base.ConnectionOptions) (*gateway, error) {
+	key := host + ":" + port
+	g, err := gateways.Get(key, func(existing interface{}) (interface{}, error) {
+		if existing != nil {
+			g := existing.(*gateway)
+			if pollInterval != g.pollInterval {
+				return nil, fmt.Errorf("Conflicting poll_interval for units at %s", key)
+			}
+			if !reflect.DeepEqual(options, g.options) {
+				return nil, fmt.Errorf("Conflicting connection options for units at %s", key)
+			}
+			return g, nil
+		}
+		return newGateway(host, port, pollInterval, options,
+			base.NewTCPSocketConnection(options, base.NewLineFramer)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g.(*gateway), nil
+}
+
+// open connects and starts polling, when the first unit is added.
+func (g *gateway) open() {
+	g.connection.Connect(g.host, g.port, g)
+	ctx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+	g.done = make(chan struct{})
+	go g.pollLoop(ctx, g.done)
+}
+
+// close stops polling and closes the connection, after the last unit is
+// removed.
+func (g *gateway) close() {
+	g.cancel()
+	<-g.done
+	g.connection.Close()
+}
+
+func (g *gateway) unitFor(uid string) *CoolMasterNet {
+	if unit := g.units.Unit(uid); unit != nil {
+		return unit.(*CoolMasterNet)
+	}
+	return nil
+}
+
+func (g *gateway) allUnits() []*CoolMasterNet {
+	var units []*CoolMasterNet
+	for _, unit := range g.units.Units() {
+		units = append(units, unit.(*CoolMasterNet))
+	}
+	return units
+}
+
+func (g *gateway) pollLoop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(g.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.poll()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll lists all the units, unless the previous list is still unanswered.
+func (g *gateway) poll() {
+	if g.pending.Has(pollLine) {
+		return
+	}
+	g.mutex.Lock()
+	g.seen = make(map[string]bool)
+	g.mutex.Unlock()
+	g.pending.Send(&base.PendingCommand{Message: pollLine}, g.sendLine)
+}
+
+// sendCommands sends the command lines of the unit, reporting the outcome
+// once all are answered.
+func (g *gateway) sendCommands(unit *CoolMasterNet, result base.CommandResult, lines ...string) error {
+	if err := g.pending.SendCommand(unit, result, lines, g.sendLine); err != nil {
+		return err
+	}
+	// Read back the unit's state. The next poll does if this fails.
+	g.pending.Send(&base.PendingCommand{Message: "ls " + unit.uid, Unit: unit}, g.sendLine)
+	return nil
+}
+
+func (g *gateway) sendLine(line string) error {
+	log.Printf("Sending to %s:%s: %s", g.host, g.port, line)
+	return g.connection.SendMessage([]byte(line + "\n"))
+}
+
+func (g *gateway) OnConnectionEstablished() {
+	log.Printf("Established connection to %s:%s", g.host, g.port)
+	go g.poll()
+}
+
+func (g *gateway) OnConnectionLost() {
+	log.Printf("Lost connection to %s:%s", g.host, g.port)
+	for _, command := range g.pending.Clear() {
+		if command.Outcome != nil && command.Last {
+			command.Unit.(*CoolMasterNet).handleOutcome(command.Outcome, "Connection lost")
+		}
+	}
+	for _, unit := range g.allUnits() {
+		unit.connectionLost()
+	}
+}
+
+func (g *gateway) HandleMessage(message []byte) {
+	defer g.expectAnswer()
+	// The prompt is not followed by a newline, so it starts the next line.
+	line := strings.TrimSpace(strings.TrimLeft(string(message), ">"))
+	if line == "" {
+		return
+	}
+	if row, ok := parseRow(line); ok {
+		if command := g.pending.Current(); command != nil && command.Message == pollLine {
+			g.mutex.Lock()
+			g.seen[strings.ToUpper(row.uid)] = true
+			g.mutex.Unlock()
+		}
+		if unit := g.unitFor(row.uid); unit != nil {
+			unit.handleRow(row)
+		}
+		return
+	}
+	command := g.pending.Current()
+	if command == nil {
+		log.Printf("Received from %s:%s: %s", g.host, g.port, line)
+		return
+	}
+	if strings.EqualFold(line, command.Message) {
+		// Echo of the command.
+		return
+	}
+	g.pending.Answered(nil)
+	if line == "OK" {
+		g.commandSucceeded(command)
+		return
+	}
+	log.Printf("Command %q to %s:%s failed: %s", command.Message, g.host, g.port, line)
+	if command.Outcome != nil {
+		if command.Outcome.Err == "" {
+			command.Outcome.Err = line
+		}
+		if command.Last {
+			command.Unit.(*CoolMasterNet).handleOutcome(command.Outcome, command.Outcome.Err)
+		}
+	}
+}
+
+// expectAnswer keeps the read deadline armed while a command awaits the
+// rest of its answer, as the connection clears it before each line.
+func (g *gateway) expectAnswer() {
+	if g.pending.Current() != nil {
+		g.connection.ExpectRead()
+	}
+}
+
+func (g *gateway) commandSucceeded(command *base.PendingCommand) {
+	if command.Message == pollLine {
+		// Units missing from the list are disconnected from the gateway.
+		g.mutex.Lock()
+		seen := g.seen
+		g.mutex.Unlock()
+		for _, unit := range g.allUnits() {
+			if !seen[strings.ToUpper(unit.uid)] {
+				unit.missing()
+			}
+		}
+	}
+	if command.Outcome != nil && command.Last {
+		command.Unit.(*CoolMasterNet).handleOutcome(command.Outcome, command.Outcome.Err)
+	}
+}
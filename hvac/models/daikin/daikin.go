@@ -0,0 +1,34 @@
+package daikin
+
+import (
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+)
+
+// modeTable maps modes to the adapter's mode values. Auto is also reported
+// as 0 or 7 by some units.
+var modeTable = base.Translations{
+	{MQTT: "auto", Device: "1"},
+	{MQTT: "auto", Device: "0"},
+	{MQTT: "auto", Device: "7"},
+	{MQTT: "dry", Device: "2"},
+	{MQTT: "cool", Device: "3"},
+	{MQTT: "heat", Device: "4"},
+	{MQTT: "fan_only", Device: "6"},
+}
+
+var fanModeTable = base.Translations{
+	{MQTT: "auto", Device: "A"},
+	{MQTT: "quiet", Device: "B"},
+	{MQTT: "1", Device: "3"},
+	{MQTT: "2", Device: "4"},
+	{MQTT: "3", Device: "5"},
+	{MQTT: "4", Device: "6"},
+	{MQTT: "5", Device: "7"},
+}
+
+var swingModeTable = base.Translations{
+	{MQTT: "off", Device: "0"},
+	{MQTT: "vertical", Device: "1"},
+	{MQTT: "horizontal", Device: "2"},
+	{MQTT: "both", Device: "3"},
+}
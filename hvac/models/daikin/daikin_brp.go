@@ -0,0 +1,433 @@
+package daikin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	models.Register("daikin_brp", newFromConfig)
+}
+
+// Config is the daikin_brp specific part of the device configuration.
+type Config struct {
+	// Key is the key printed on BRP072C adapters, which only accept HTTPS
+	// requests from registered clients. Plain HTTP is used without a key.
+	Key string `yaml:"key"`
+	// UUID identifies the bridge to the adapter when registering with the
+	// key. A random one is used if not given.
+	UUID string `yaml:"uuid"`
+	// PollInterval is how often the state is read, such as "30s".
+	PollInterval string `yaml:"poll_interval"`
+}
+
+const defaultPollInterval = time.Second * 30
+
+func newFromConfig(params models.Params) (base.Controller, error) {
+	var config Config
+	if err := params.Decode(&config); err != nil {
+		return nil, err
+	}
+	pollInterval := defaultPollInterval
+	if config.PollInterval != "" {
+		var err error
+		pollInterval, err = time.ParseDuration(config.PollInterval)
+		if err != nil || pollInterval <= 0 {
+			return nil, fmt.Errorf("Invalid poll_interval %q", config.PollInterval)
+		}
+	}
+	return NewDaikinBRP(params.Name, params.Host, params.Port, config.Key, config.UUID,
+		pollInterval, params.ConnectionOptions)
+}
+
+// DaikinBRP controls a unit through a BRP069 or BRP072 Wi-Fi adapter.
+type DaikinBRP struct {
+	name    string
+	baseURL string
+	key     string
+	uuid    string
+	options base.ConnectionOptions
+	poller  *base.Poller
+	client  *http.Client
+
+	// registered is only used by the polling goroutine, which makes all the
+	// requests to the adapter.
+	registered bool
+
+	// mutex guards the fields below and the poller's state.
+	mutex    sync.Mutex
+	notifier base.Notifier
+	// control and sensors are the last values read from the adapter.
+	control map[string]string
+	sensors map[string]string
+	// unknownMode is the last mode value logged as unknown.
+	unknownMode string
+}
+
+func NewDaikinBRP(name, host, port, key, uuid string, pollInterval time.Duration,
+	options base.ConnectionOptions) (*DaikinBRP, error) {
+	scheme := "http"
+	if key != "" {
+		scheme = "https"
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	if uuid == "" {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		uuid = hex.EncodeToString(random)
+	}
+	uuid = strings.ToLower(strings.Replace(uuid, "-", "", -1))
+	tlsConfig, err := base.NewTLSConfig(options.TLS)
+	if err != nil {
+		return nil, err
+	}
+	options = options.WithDefaults()
+	c := &DaikinBRP{
+		name:    name,
+		baseURL: scheme + "://" + host,
+		key:     key,
+		uuid:    uuid,
+		options: options,
+		client: &http.Client{
+			Timeout: options.ResponseTimeout,
+			Transport: &http.Transport{
+				DialContext:     (&net.Dialer{Timeout: options.DialTimeout}).DialContext,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+	c.poller = base.NewPoller(pollInterval, &c.mutex, &c.notifier, c.poll, c.apply)
+	return c, nil
+}
+
+func (c *DaikinBRP) SetStateNotifier(stateNotifier base.StateNotifier) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notifier.SetStateNotifier(stateNotifier)
+}
+
+func (c *DaikinBRP) ConnectionState() base.ConnectionState {
+	return c.poller.State()
+}
+
+func (c *DaikinBRP) Connect() {
+	c.poller.Start()
+}
+
+func (c *DaikinBRP) Close() {
+	log.Printf("Closing %s", c.name)
+	c.poller.Stop()
+}
+
+// poll reads the control and sensor state, marking the device offline if
+// the adapter cannot be reached.
+func (c *DaikinBRP) poll(ctx context.Context) {
+	control, sensors, err := c.readState(ctx)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Polling %s failed: %s", c.name, err)
+		c.requestFailed(err)
+		return
+	}
+	c.control = control
+	c.sensors = sensors
+	if mode := control["mode"]; modeTable.FromDevice(mode) == "" && mode != c.unknownMode {
+		log.Printf("%s reports unknown mode %q", c.name, mode)
+		c.unknownMode = mode
+	}
+	c.poller.Succeeded()
+	c.notifier.UpdateState(c.snapshot())
+}
+
+func (c *DaikinBRP) readState(ctx context.Context) (control, sensors map[string]string, err error) {
+	if c.key != "" && !c.registered {
+		if _, err := c.request(ctx, "/common/register_terminal", url.Values{"key": {c.key}}); err != nil {
+			return nil, nil, fmt.Errorf("registering with key: %s", err)
+		}
+		c.registered = true
+	}
+	control, err = c.request(ctx, "/aircon/get_control_info", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	sensors, err = c.request(ctx, "/aircon/get_sensor_info", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return control, sensors, nil
+}
+
+func (c *DaikinBRP) requestFailed(err error) {
+	// The adapter may have been reset and forgotten the registration.
+	c.registered = false
+	c.poller.Failed(err)
+}
+
+// request sends a GET request to the adapter and parses its response, which
+// is a comma-separated list of key=value pairs starting with ret=OK.
+func (c *DaikinBRP) request(ctx context.Context, path string, query url.Values) (map[string]string, error) {
+	requestURL := c.baseURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.key != "" {
+		request.Header.Set("X-Daikin-uuid", c.uuid)
+	}
+	log.Printf("Requesting %s", requestURL)
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", path, response.Status)
+	}
+	values := parseResponse(string(body))
+	if values["ret"] != "OK" {
+		return values, &retError{values["ret"]}
+	}
+	return values, nil
+}
+
+// retError is an error status reported by the adapter, such as "PARAM NG".
+type retError struct {
+	ret string
+}
+
+func (e *retError) Error() string {
+	return e.ret
+}
+
+func parseResponse(body string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(strings.TrimSpace(body), ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := url.QueryUnescape(parts[1])
+		if err != nil {
+			value = parts[1]
+		}
+		values[parts[0]] = value
+	}
+	return values
+}
+
+func (c *DaikinBRP) Snapshot() base.State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.snapshot()
+}
+
+func (c *DaikinBRP) snapshot() base.State {
+	if c.control == nil {
+		return base.State{}
+	}
+	state := base.State{
+		Power: c.control["pow"] == "1",
+		// An unknown mode is left out rather than published as another.
+		Mode:               base.Mode(modeTable.FromDevice(c.control["mode"])),
+		FanMode:            fanModeTable.FromDevice(c.control["f_rate"]),
+		SwingMode:          swingModeTable.FromDevice(c.control["f_dir"]),
+		Setpoint:           parseNumber(c.control["stemp"]),
+		CurrentTemperature: parseNumber(c.sensors["htemp"]),
+		Humidity:           parseNumber(c.sensors["hhum"]),
+		Extras:             make(map[string]string),
+	}
+	for _, key := range []string{"otemp", "cmpfreq", "err"} {
+		if value, ok := c.sensors[key]; ok {
+			state.Extras[key] = value
+		}
+	}
+	state.Action = action(state, c.sensors["cmpfreq"])
+	return state
+}
+
+// action derives what the unit is doing from the compressor frequency, when
+// the adapter reports it.
+func action(state base.State, compressorFrequency string) base.Action {
+	switch state.EffectiveMode() {
+	case base.ModeOff:
+		return base.ActionOff
+	case base.ModeFanOnly:
+		return base.ActionFan
+	}
+	frequency, err := strconv.ParseFloat(compressorFrequency, 64)
+	if err == nil && frequency == 0 {
+		return base.ActionIdle
+	}
+	switch state.Mode {
+	case base.ModeCool:
+		return base.ActionCooling
+	case base.ModeHeat:
+		return base.ActionHeating
+	case base.ModeDry:
+		return base.ActionDrying
+	}
+	return base.ActionIdle
+}
+
+// parseNumber parses a temperature or humidity, which are "-" or "--" when
+// not available.
+func parseNumber(value string) *float64 {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	return &number
+}
+
+func (c *DaikinBRP) Capabilities() base.Capabilities {
+	return base.Capabilities{
+		Modes:              base.Modes,
+		FanModes:           fanModeTable.MQTTValues(),
+		SwingModes:         base.SwingModes,
+		MinTemperature:     10,
+		MaxTemperature:     32,
+		TemperatureStep:    0.5,
+		CurrentTemperature: true,
+		Humidity:           true,
+	}
+}
+
+func (c *DaikinBRP) SetPower(on bool) {
+	value := "OFF"
+	if on {
+		value = "ON"
+	}
+	c.sendCommand("power", value, func(control url.Values) {
+		control.Set("pow", boolValue(on))
+	})
+}
+
+func (c *DaikinBRP) SetMode(mode base.Mode) {
+	c.sendCommand("mode", string(mode), func(control url.Values) {
+		if mode == base.ModeOff {
+			control.Set("pow", "0")
+			return
+		}
+		value := modeTable.ToDevice(string(mode))
+		control.Set("pow", "1")
+		control.Set("mode", value)
+		// The adapter remembers the setpoint and humidity of each mode.
+		if stemp := c.control["dt"+value]; stemp != "" {
+			control.Set("stemp", stemp)
+		}
+		if shum := c.control["dh"+value]; shum != "" {
+			control.Set("shum", shum)
+		}
+	})
+}
+
+func (c *DaikinBRP) SetFanMode(fanMode string) {
+	c.sendCommand("fan_mode", fanMode, func(control url.Values) {
+		control.Set("f_rate", fanModeTable.ToDevice(fanMode))
+	})
+}
+
+func (c *DaikinBRP) SetSwingMode(swingMode string) {
+	c.sendCommand("swing_mode", swingMode, func(control url.Values) {
+		control.Set("f_dir", swingModeTable.ToDevice(swingMode))
+	})
+}
+
+func (c *DaikinBRP) SetPresetMode(presetMode string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notifier.UpdateCommandResult(base.CommandResult{
+		Command: "preset_mode",
+		Value:   presetMode,
+	}, "Unsupported", false)
+}
+
+func (c *DaikinBRP) SetTemperature(temperature float64) {
+	value := strconv.FormatFloat(temperature, 'f', 1, 64)
+	c.sendCommand("temperature", value, func(control url.Values) {
+		control.Set("stemp", value)
+	})
+}
+
+func (c *DaikinBRP) sendCommand(command, value string, change func(control url.Values)) {
+	c.poller.Send(base.CommandResult{
+		Command: command,
+		Value:   value,
+	}, change)
+}
+
+// apply sets the control of the command, reading back the state once it
+// is accepted.
+func (c *DaikinBRP) apply(ctx context.Context, command *base.PolledCommand) {
+	if c.setControl(ctx, command.Result, command.Change.(func(control url.Values))) {
+		c.poll(ctx)
+	}
+}
+
+// setControl changes the control settings read last, as the adapter
+// requires all of them to be sent, returning whether it succeeded.
+func (c *DaikinBRP) setControl(ctx context.Context, result base.CommandResult, change func(control url.Values)) bool {
+	c.mutex.Lock()
+	if c.control == nil {
+		c.notifier.UpdateCommandResult(result, base.ErrNotConnected.Error(), false)
+		c.mutex.Unlock()
+		return false
+	}
+	control := url.Values{}
+	for _, key := range []string{"pow", "mode", "stemp", "shum", "f_rate", "f_dir"} {
+		control.Set(key, c.control[key])
+	}
+	change(control)
+	c.mutex.Unlock()
+
+	requestCtx, cancel := context.WithTimeout(ctx, c.options.WriteTimeout)
+	defer cancel()
+	_, err := c.request(requestCtx, "/aircon/set_control_info", control)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		log.Printf("Command %s %s for %s failed: %s", result.Command, result.Value, c.name, err)
+		if _, ok := err.(*retError); !ok {
+			c.requestFailed(err)
+		}
+		c.notifier.UpdateCommandResult(result, err.Error(), false)
+		return false
+	}
+	c.notifier.UpdateCommandResult(result, "OK", true)
+	return true
+}
+
+func boolValue(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
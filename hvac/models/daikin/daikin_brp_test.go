@@ -0,0 +1,306 @@
+package daikin
+
+import (
+	"fmt"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base/basetest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAdapter serves the adapter's HTTP API from its control settings.
+type fakeAdapter struct {
+	mutex   sync.Mutex
+	control url.Values
+	// key, if set, must be registered before the state can be read.
+	key        string
+	registered map[string]bool
+	// setRet is returned by set_control_info if not empty.
+	setRet string
+	sets   []url.Values
+	// hold, if set, delays set_control_info until closed.
+	hold chan struct{}
+}
+
+func newFakeAdapter() *fakeAdapter {
+	return &fakeAdapter{
+		control: url.Values{
+			"pow":    {"1"},
+			"mode":   {"3"},
+			"stemp":  {"24.0"},
+			"shum":   {"0"},
+			"f_rate": {"A"},
+			"f_dir":  {"0"},
+			"dt4":    {"21.0"},
+			"dh4":    {"0"},
+		},
+		registered: make(map[string]bool),
+	}
+}
+
+func (a *fakeAdapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.hold != nil && r.URL.Path == "/aircon/set_control_info" {
+		<-a.hold
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	query := r.URL.Query()
+	if r.URL.Path == "/common/register_terminal" {
+		if query.Get("key") != a.key {
+			fmt.Fprint(w, "ret=PARAM NG")
+			return
+		}
+		a.registered[r.Header.Get("X-Daikin-uuid")] = true
+		fmt.Fprint(w, "ret=OK")
+		return
+	}
+	if a.key != "" && !a.registered[r.Header.Get("X-Daikin-uuid")] {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/aircon/get_control_info":
+		fmt.Fprint(w, "ret=OK,"+encode(a.control))
+	case "/aircon/get_sensor_info":
+		fmt.Fprint(w, "ret=OK,htemp=23.5,hhum=-,otemp=12.0,err=0,cmpfreq=30")
+	case "/aircon/set_control_info":
+		a.sets = append(a.sets, query)
+		if a.setRet != "" {
+			fmt.Fprint(w, "ret="+a.setRet)
+			return
+		}
+		for key := range query {
+			a.control.Set(key, query.Get(key))
+		}
+		fmt.Fprint(w, "ret=OK,adv=")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func encode(values url.Values) string {
+	var pairs []string
+	for key := range values {
+		pairs = append(pairs, key+"="+values.Get(key))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (a *fakeAdapter) lastSet() url.Values {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.sets) == 0 {
+		return nil
+	}
+	return a.sets[len(a.sets)-1]
+}
+
+func newTestDaikin(t *testing.T, server *httptest.Server, key string) (*DaikinBRP, *basetest.Recorder) {
+	host, port := basetest.HostPort(t, server.Listener.Addr())
+	c, err := NewDaikinBRP("test", host, port, key, "", time.Hour, base.ConnectionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, basetest.NewRecorder(c)
+}
+
+func TestDaikinState(t *testing.T) {
+	server := httptest.NewServer(newFakeAdapter())
+	defer server.Close()
+	c, notifier := newTestDaikin(t, server, "")
+	c.Connect()
+	defer c.Close()
+	state, _ := notifier.WaitFor(t, 1, 0)
+	if !state.Power || state.Mode != base.ModeCool || state.FanMode != "auto" || state.SwingMode != "off" {
+		t.Errorf("got state %+v", state)
+	}
+	if state.Setpoint == nil || *state.Setpoint != 24 || state.CurrentTemperature == nil || *state.CurrentTemperature != 23.5 {
+		t.Errorf("got temperatures in %+v", state)
+	}
+	if state.Humidity != nil || state.Action != base.ActionCooling || state.Extras["otemp"] != "12.0" {
+		t.Errorf("got state %+v", state)
+	}
+	// The adapter reports hhum, "-" without a humidity sensor.
+	if !c.Capabilities().Humidity {
+		t.Errorf("got capabilities %+v without humidity", c.Capabilities())
+	}
+}
+
+func TestDaikinUnknownMode(t *testing.T) {
+	adapter := newFakeAdapter()
+	adapter.control.Set("mode", "9")
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+	c, notifier := newTestDaikin(t, server, "")
+	c.Connect()
+	defer c.Close()
+	state, _ := notifier.WaitFor(t, 1, 0)
+	if !state.Power || state.Mode != "" {
+		t.Errorf("got state %+v, want no mode", state)
+	}
+}
+
+func TestDaikinCommands(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(c *DaikinBRP)
+		want map[string]string
+	}{
+		{
+			name: "mode restores the mode's setpoint",
+			send: func(c *DaikinBRP) { c.SetMode(base.ModeHeat) },
+			want: map[string]string{"pow": "1", "mode": "4", "stemp": "21.0", "f_rate": "A"},
+		},
+		{
+			name: "off",
+			send: func(c *DaikinBRP) { c.SetMode(base.ModeOff) },
+			want: map[string]string{"pow": "0", "mode": "3", "stemp": "24.0"},
+		},
+		{
+			name: "fan mode",
+			send: func(c *DaikinBRP) { c.SetFanMode("quiet") },
+			want: map[string]string{"f_rate": "B", "mode": "3"},
+		},
+		{
+			name: "fan speed",
+			send: func(c *DaikinBRP) { c.SetFanMode("5") },
+			want: map[string]string{"f_rate": "7"},
+		},
+		{
+			name: "swing mode",
+			send: func(c *DaikinBRP) { c.SetSwingMode("both") },
+			want: map[string]string{"f_dir": "3", "f_rate": "A"},
+		},
+		{
+			name: "temperature",
+			send: func(c *DaikinBRP) { c.SetTemperature(22.5) },
+			want: map[string]string{"stemp": "22.5", "pow": "1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			adapter := newFakeAdapter()
+			server := httptest.NewServer(adapter)
+			defer server.Close()
+			c, notifier := newTestDaikin(t, server, "")
+			c.Connect()
+			defer c.Close()
+			notifier.WaitFor(t, 1, 0)
+			test.send(c)
+			state, result := notifier.WaitFor(t, 2, 1)
+			if !result.Success {
+				t.Errorf("got result %+v", result)
+			}
+			set := adapter.lastSet()
+			for key, value := range test.want {
+				if set.Get(key) != value {
+					t.Errorf("sent %s=%q, want %q", key, set.Get(key), value)
+				}
+			}
+			if test.want["f_rate"] != "" && state.FanMode != fanModeTable.FromDevice(test.want["f_rate"]) {
+				t.Errorf("state after command is %+v", state)
+			}
+		})
+	}
+}
+
+func TestDaikinCommandRejected(t *testing.T) {
+	adapter := newFakeAdapter()
+	adapter.setRet = "PARAM NG"
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+	c, notifier := newTestDaikin(t, server, "")
+	c.Connect()
+	defer c.Close()
+	notifier.WaitFor(t, 1, 0)
+	c.SetTemperature(50)
+	_, result := notifier.WaitFor(t, 1, 1)
+	if result.Success || result.Status != "PARAM NG" || result.Command != "temperature" {
+		t.Errorf("got result %+v", result)
+	}
+	// A rejected command does not mean the adapter is unreachable.
+	if state := c.ConnectionState(); !state.Connected {
+		t.Errorf("got connection state %+v", state)
+	}
+}
+
+func TestDaikinCommandDoesNotBlock(t *testing.T) {
+	adapter := newFakeAdapter()
+	adapter.hold = make(chan struct{})
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+	c, notifier := newTestDaikin(t, server, "")
+	c.Connect()
+	defer c.Close()
+	notifier.WaitFor(t, 1, 0)
+	sent := make(chan struct{})
+	go func() {
+		c.SetTemperature(22)
+		c.SetFanMode("quiet")
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("commands blocked on the adapter")
+	}
+	c.Snapshot()
+	close(adapter.hold)
+	_, result := notifier.WaitFor(t, 3, 2)
+	if !result.Success || result.Command != "fan_mode" {
+		t.Errorf("got result %+v", result)
+	}
+}
+
+func TestDaikinCommandNotConnected(t *testing.T) {
+	server := httptest.NewServer(newFakeAdapter())
+	defer server.Close()
+	c, notifier := newTestDaikin(t, server, "")
+	c.SetPower(true)
+	_, result := notifier.WaitFor(t, 0, 1)
+	if result.Success || result.Status != base.ErrNotConnected.Error() {
+		t.Errorf("got result %+v", result)
+	}
+}
+
+func TestDaikinRegistersKey(t *testing.T) {
+	adapter := newFakeAdapter()
+	adapter.key = "0123456789abcdef"
+	server := httptest.NewTLSServer(adapter)
+	defer server.Close()
+	c, notifier := newTestDaikin(t, server, adapter.key)
+	c.Connect()
+	defer c.Close()
+	state, _ := notifier.WaitFor(t, 1, 0)
+	if state.Mode != base.ModeCool {
+		t.Errorf("got state %+v", state)
+	}
+	adapter.mutex.Lock()
+	defer adapter.mutex.Unlock()
+	if !adapter.registered[c.uuid] {
+		t.Errorf("uuid %s not registered", c.uuid)
+	}
+}
+
+func TestDaikinWrongKey(t *testing.T) {
+	adapter := newFakeAdapter()
+	adapter.key = "0123456789abcdef"
+	server := httptest.NewTLSServer(adapter)
+	defer server.Close()
+	c, _ := newTestDaikin(t, server, "fedcba9876543210")
+	c.Connect()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.ConnectionState().Failures == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Close()
+	state := c.ConnectionState()
+	if state.Connected || !strings.Contains(state.LastError, "PARAM NG") {
+		t.Errorf("got connection state %+v", state)
+	}
+}
@@ -0,0 +1,596 @@
+package gree
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	models.Register("gree", newFromConfig)
+}
+
+// Config is the gree specific part of the device configuration. The duid is
+// the unit's MAC address, which is found by scanning the host if not given.
+type Config struct {
+	// Key is the device key. The unit is bound to obtain it if not given.
+	Key string `yaml:"key"`
+	// Encryption is "ecb" or "gcm". It is detected if not given.
+	Encryption string `yaml:"encryption"`
+	// StateFile keeps the keys obtained by binding. Defaults to gree_keys.json.
+	StateFile string `yaml:"state_file"`
+	// PollInterval is how often the state is read, such as "10s".
+	PollInterval string `yaml:"poll_interval"`
+}
+
+const (
+	defaultPort         = "7000"
+	defaultStateFile    = "gree_keys.json"
+	defaultPollInterval = time.Second * 10
+)
+
+func newFromConfig(params models.Params) (base.Controller, error) {
+	var config Config
+	if err := params.Decode(&config); err != nil {
+		return nil, err
+	}
+	encryption := Encryption(strings.ToLower(config.Encryption))
+	switch encryption {
+	case "", EncryptionECB, EncryptionGCM:
+	default:
+		return nil, fmt.Errorf("Unknown encryption %q", config.Encryption)
+	}
+	if config.Key != "" && len(config.Key) != 16 {
+		return nil, fmt.Errorf("key must be 16 characters long")
+	}
+	pollInterval := defaultPollInterval
+	if config.PollInterval != "" {
+		var err error
+		pollInterval, err = time.ParseDuration(config.PollInterval)
+		if err != nil || pollInterval <= 0 {
+			return nil, fmt.Errorf("Invalid poll_interval %q", config.PollInterval)
+		}
+	}
+	stateFile := config.StateFile
+	if stateFile == "" {
+		stateFile = defaultStateFile
+	}
+	return NewGree(params.Name, params.Host, params.Port, params.DUID, config.Key,
+		encryption, stateFile, pollInterval, params.ConnectionOptions), nil
+}
+
+// statusColumns are the unit settings read on every poll.
+var statusColumns = []string{
+	"Pow", "Mod", "SetTem", "TemUn", "TemSen", "WdSpd", "Tur", "Quiet",
+	"SwhSlp", "SwUpDn", "SwingLfRig", "Lig", "Health", "Air", "Blo", "SvSt",
+}
+
+// Gree controls a unit speaking the Gree UDP protocol.
+type Gree struct {
+	name       string
+	address    string
+	key        string
+	encryption Encryption
+	stateFile  string
+	options    base.ConnectionOptions
+	poller     *base.Poller
+
+	// mac and cipher are only used by the polling goroutine, which makes
+	// all the exchanges with the unit. cipher encrypts with the device key,
+	// once known.
+	mac    string
+	cipher packCipher
+
+	// mutex guards the fields below and the poller's state.
+	mutex    sync.Mutex
+	notifier base.Notifier
+	// values are the last known column values.
+	values map[string]int
+}
+
+func NewGree(name, host, port, mac, key string, encryption Encryption, stateFile string,
+	pollInterval time.Duration, options base.ConnectionOptions) *Gree {
+	if port == "" {
+		port = defaultPort
+	}
+	c := &Gree{
+		name:       name,
+		address:    net.JoinHostPort(host, port),
+		mac:        normalizeMAC(mac),
+		key:        key,
+		encryption: encryption,
+		stateFile:  stateFile,
+		options:    options.WithDefaults(),
+		values:     make(map[string]int),
+	}
+	c.poller = base.NewPoller(pollInterval, &c.mutex, &c.notifier, c.poll, c.setColumns)
+	return c
+}
+
+func normalizeMAC(mac string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "").Replace(mac))
+}
+
+func (c *Gree) SetStateNotifier(stateNotifier base.StateNotifier) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notifier.SetStateNotifier(stateNotifier)
+}
+
+func (c *Gree) ConnectionState() base.ConnectionState {
+	return c.poller.State()
+}
+
+func (c *Gree) Connect() {
+	c.poller.Start()
+}
+
+func (c *Gree) Close() {
+	log.Printf("Closing %s", c.name)
+	c.poller.Stop()
+}
+
+// packet is the outer, unencrypted JSON of all messages.
+type packet struct {
+	T    string `json:"t"`
+	I    int    `json:"i"`
+	UID  int    `json:"uid"`
+	CID  string `json:"cid"`
+	TCID string `json:"tcid"`
+	Pack string `json:"pack"`
+	Tag  string `json:"tag,omitempty"`
+}
+
+// pack is the decrypted content of a packet.
+type pack struct {
+	T    string        `json:"t"`
+	MAC  string        `json:"mac"`
+	CID  string        `json:"cid"`
+	Name string        `json:"name"`
+	Ver  string        `json:"ver"`
+	Key  string        `json:"key"`
+	R    int           `json:"r"`
+	Cols []string      `json:"cols"`
+	Dat  []interface{} `json:"dat"`
+	Opt  []string      `json:"opt"`
+	P    []interface{} `json:"p"`
+	Val  []interface{} `json:"val"`
+}
+
+// errDecrypt marks responses that could not be decrypted, suggesting a
+// wrong key or encryption.
+var errDecrypt = errors.New("cannot decrypt response")
+
+// send sends a request and returns the first response packet. It gives up
+// when ctx is done.
+func (c *Gree) send(ctx context.Context, request interface{}) (*packet, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: c.options.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "udp", c.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(c.options.ResponseTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	// Closing the socket interrupts the read when ctx is done first.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	if _, err := conn.Write(data); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		var response packet
+		if err := json.Unmarshal(buf[:n], &response); err != nil {
+			log.Printf("Ignoring invalid packet from %s: %s", c.name, string(buf[:n]))
+			continue
+		}
+		return &response, nil
+	}
+}
+
+// exchange sends an encrypted request and decrypts the response.
+func (c *Gree) exchange(ctx context.Context, cipher packCipher, i int, request interface{}) (*pack, error) {
+	plain, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, tag, err := cipher.encrypt(plain)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.send(ctx, packet{
+		T:    "pack",
+		I:    i,
+		CID:  "app",
+		TCID: c.mac,
+		Pack: encrypted,
+		Tag:  tag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := cipher.decrypt(response.Pack, response.Tag)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	var result pack
+	if err := json.Unmarshal(decrypted, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// scan asks the unit for its MAC address and tells which encryption it
+// uses, from whether its response has a GCM tag.
+func (c *Gree) scan(ctx context.Context) (string, Encryption, error) {
+	response, err := c.send(ctx, map[string]string{"t": "scan"})
+	if err != nil {
+		return "", "", err
+	}
+	encryption := EncryptionECB
+	if response.Tag != "" {
+		encryption = EncryptionGCM
+	}
+	cipher, err := genericCipher(encryption)
+	if err != nil {
+		return "", "", err
+	}
+	decrypted, err := cipher.decrypt(response.Pack, response.Tag)
+	if err != nil {
+		return "", "", errDecrypt
+	}
+	var device pack
+	if err := json.Unmarshal(decrypted, &device); err != nil {
+		return "", "", err
+	}
+	mac := device.MAC
+	if mac == "" {
+		mac = device.CID
+	}
+	log.Printf("Found %s: MAC %s, version %s", c.name, mac, device.Ver)
+	return normalizeMAC(mac), encryption, nil
+}
+
+// bind requests the device key, trying each encryption in turn.
+func (c *Gree) bind(ctx context.Context, encryptions []Encryption) (boundKey, error) {
+	var err error
+	for _, encryption := range encryptions {
+		var cipher packCipher
+		cipher, err = genericCipher(encryption)
+		if err != nil {
+			return boundKey{}, err
+		}
+		var response *pack
+		response, err = c.exchange(ctx, cipher, 1, map[string]interface{}{
+			"mac": c.mac,
+			"t":   "bind",
+			"uid": 0,
+		})
+		if ctx.Err() != nil {
+			return boundKey{}, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Binding %s with %s encryption failed: %s", c.name, encryption, err)
+			continue
+		}
+		if response.T != "bindok" || response.Key == "" {
+			err = fmt.Errorf("binding refused: %s %d", response.T, response.R)
+			continue
+		}
+		return boundKey{Key: response.Key, Encryption: encryption}, nil
+	}
+	return boundKey{}, err
+}
+
+// ensureKey finds the unit's MAC address and key, binding it if the key is
+// neither configured nor stored.
+func (c *Gree) ensureKey(ctx context.Context) error {
+	if c.cipher != nil {
+		return nil
+	}
+	encryption := c.encryption
+	if c.mac == "" || encryption == "" {
+		mac, detected, err := c.scan(ctx)
+		if err != nil {
+			return fmt.Errorf("scanning: %s", err)
+		}
+		if c.mac == "" {
+			c.mac = mac
+		}
+		if encryption == "" {
+			encryption = detected
+		}
+	}
+
+	key := boundKey{Key: c.key, Encryption: encryption}
+	if key.Key == "" {
+		stored, ok := loadKey(c.stateFile, c.mac)
+		if ok && (c.encryption == "" || stored.Encryption == c.encryption) {
+			key = stored
+		} else {
+			encryptions := []Encryption{encryption}
+			if c.encryption == "" {
+				// Some units answer scans without a tag but bind with GCM,
+				// so the other encryption is tried after the detected one.
+				other := EncryptionGCM
+				if encryption == EncryptionGCM {
+					other = EncryptionECB
+				}
+				encryptions = append(encryptions, other)
+			}
+			var err error
+			key, err = c.bind(ctx, encryptions)
+			if err != nil {
+				return fmt.Errorf("binding: %s", err)
+			}
+			log.Printf("Bound %s with %s encryption", c.name, key.Encryption)
+			if err := storeKey(c.stateFile, c.mac, key); err != nil {
+				log.Printf("Cannot store key of %s in %s: %s", c.name, c.stateFile, err)
+			}
+		}
+	}
+	cipher, err := newPackCipher(key.Encryption, key.Key)
+	if err != nil {
+		return err
+	}
+	c.cipher = cipher
+	return nil
+}
+
+// poll reads the unit's status, marking it offline if it does not answer.
+func (c *Gree) poll(ctx context.Context) {
+	response, err := c.readStatus(ctx)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Polling %s failed: %s", c.name, err)
+		c.requestFailed(err)
+		return
+	}
+	c.updateValues(response.Cols, response.Dat)
+	c.poller.Succeeded()
+	c.notifier.UpdateState(c.snapshot())
+}
+
+func (c *Gree) readStatus(ctx context.Context) (*pack, error) {
+	if err := c.ensureKey(ctx); err != nil {
+		return nil, err
+	}
+	response, err := c.exchange(ctx, c.cipher, 0, map[string]interface{}{
+		"cols": statusColumns,
+		"mac":  c.mac,
+		"t":    "status",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.T != "dat" {
+		return nil, fmt.Errorf("unexpected status response %q", response.T)
+	}
+	return response, nil
+}
+
+func (c *Gree) requestFailed(err error) {
+	if err == errDecrypt && c.key == "" {
+		// The unit was reset or rebound elsewhere, so bind it again.
+		log.Printf("Forgetting key of %s", c.name)
+		c.cipher = nil
+		storeKey(c.stateFile, c.mac, boundKey{})
+	}
+	c.poller.Failed(err)
+}
+
+func (c *Gree) updateValues(columns []string, values []interface{}) {
+	for i, column := range columns {
+		if i >= len(values) {
+			break
+		}
+		if value, ok := intValue(values[i]); ok {
+			c.values[column] = value
+		}
+	}
+}
+
+func intValue(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int(v), true
+	case string:
+		number, err := strconv.Atoi(v)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+func (c *Gree) Snapshot() base.State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.snapshot()
+}
+
+func (c *Gree) snapshot() base.State {
+	if len(c.values) == 0 {
+		return base.State{}
+	}
+	state := base.State{
+		Power:      c.values["Pow"] == 1,
+		Mode:       base.Mode(modeTable.FromDevice(c.values["Mod"])),
+		FanMode:    fanModeTable.FromDevice(c.values["WdSpd"]),
+		SwingMode:  swingMode(c.values["SwUpDn"], c.values["SwingLfRig"]),
+		PresetMode: presetMode(c.values),
+		Setpoint:   base.Float(float64(c.values["SetTem"])),
+		Extras:     make(map[string]string),
+	}
+	if sensor, ok := c.values["TemSen"]; ok && sensor != 0 {
+		// Most units report the room temperature offset by 40 degrees.
+		if sensor >= 40 {
+			sensor -= 40
+		}
+		state.CurrentTemperature = base.Float(float64(sensor))
+	}
+	for _, column := range []string{"Lig", "Health", "Air", "Blo", "SvSt"} {
+		if value, ok := c.values[column]; ok {
+			state.Extras[column] = strconv.Itoa(value)
+		}
+	}
+	switch state.EffectiveMode() {
+	case base.ModeOff:
+		state.Action = base.ActionOff
+	case base.ModeFanOnly:
+		state.Action = base.ActionFan
+	case base.ModeCool:
+		state.Action = base.ActionCooling
+	case base.ModeHeat:
+		state.Action = base.ActionHeating
+	case base.ModeDry:
+		state.Action = base.ActionDrying
+	}
+	return state
+}
+
+func (c *Gree) Capabilities() base.Capabilities {
+	return base.Capabilities{
+		Modes:              base.Modes,
+		FanModes:           fanModeTable.MQTTValues(),
+		SwingModes:         base.SwingModes,
+		PresetModes:        []string{"quiet", "boost", "sleep"},
+		MinTemperature:     16,
+		MaxTemperature:     30,
+		TemperatureStep:    1,
+		CurrentTemperature: true,
+	}
+}
+
+func (c *Gree) SetPower(on bool) {
+	value := "OFF"
+	if on {
+		value = "ON"
+	}
+	c.sendCommand("power", value, map[string]int{"Pow": boolValue(on)})
+}
+
+func (c *Gree) SetMode(mode base.Mode) {
+	if mode == base.ModeOff {
+		c.sendCommand("mode", string(mode), map[string]int{"Pow": 0})
+		return
+	}
+	c.sendCommand("mode", string(mode), map[string]int{
+		"Pow": 1,
+		"Mod": modeTable.ToDevice(string(mode)),
+	})
+}
+
+func (c *Gree) SetFanMode(fanMode string) {
+	c.sendCommand("fan_mode", fanMode, map[string]int{"WdSpd": fanModeTable.ToDevice(fanMode)})
+}
+
+func (c *Gree) SetSwingMode(swingMode string) {
+	vertical := swingMode == "vertical" || swingMode == "both"
+	horizontal := swingMode == "horizontal" || swingMode == "both"
+	c.sendCommand("swing_mode", swingMode, map[string]int{
+		"SwUpDn":     boolValue(vertical),
+		"SwingLfRig": boolValue(horizontal),
+	})
+}
+
+func (c *Gree) SetPresetMode(presetMode string) {
+	c.sendCommand("preset_mode", presetMode, map[string]int{
+		"Quiet":  boolValue(presetMode == "quiet"),
+		"Tur":    boolValue(presetMode == "boost"),
+		"SwhSlp": boolValue(presetMode == "sleep"),
+	})
+}
+
+func (c *Gree) SetTemperature(temperature float64) {
+	value := int(temperature + 0.5)
+	c.sendCommand("temperature", strconv.Itoa(value), map[string]int{
+		"SetTem": value,
+		"TemUn":  0,
+	})
+}
+
+func (c *Gree) sendCommand(command, value string, columns map[string]int) {
+	c.poller.Send(base.CommandResult{
+		Command: command,
+		Value:   value,
+	}, columns)
+}
+
+// setColumns sets the columns of the command, reporting whether the unit
+// accepted them.
+func (c *Gree) setColumns(ctx context.Context, command *base.PolledCommand) {
+	result := command.Result
+	columns := command.Change.(map[string]int)
+	if err := c.ensureKey(ctx); err != nil {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.notifier.UpdateCommandResult(result, err.Error(), false)
+		return
+	}
+	var options []string
+	var values []int
+	for column, value := range columns {
+		options = append(options, column)
+		values = append(values, value)
+	}
+	response, err := c.exchange(ctx, c.cipher, 0, map[string]interface{}{
+		"opt": options,
+		"p":   values,
+		"t":   "cmd",
+	})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		log.Printf("Command %s %s for %s failed: %s", result.Command, result.Value, c.name, err)
+		if ctx.Err() == nil {
+			c.requestFailed(err)
+		}
+		c.notifier.UpdateCommandResult(result, err.Error(), false)
+		return
+	}
+	if response.T != "res" || response.R != 200 {
+		c.notifier.UpdateCommandResult(result, fmt.Sprintf("Refused: %d", response.R), false)
+		return
+	}
+	applied := response.Val
+	if len(applied) == 0 {
+		applied = response.P
+	}
+	c.updateValues(response.Opt, applied)
+	c.notifier.UpdateCommandResult(result, "OK", true)
+	c.notifier.UpdateState(c.snapshot())
+}
@@ -0,0 +1,55 @@
+package gree
+
+import (
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+)
+
+var modeTable = base.CodeTranslations{
+	{MQTT: "auto", Code: 0},
+	{MQTT: "cool", Code: 1},
+	{MQTT: "dry", Code: 2},
+	{MQTT: "fan_only", Code: 3},
+	{MQTT: "heat", Code: 4},
+}
+
+var fanModeTable = base.CodeTranslations{
+	{MQTT: "auto", Code: 0},
+	{MQTT: "low", Code: 1},
+	{MQTT: "medium_low", Code: 2},
+	{MQTT: "medium", Code: 3},
+	{MQTT: "medium_high", Code: 4},
+	{MQTT: "high", Code: 5},
+}
+
+// swingMode combines the vertical and horizontal swing settings. Values
+// other than 0 and 1 are fixed louver positions.
+func swingMode(vertical, horizontal int) string {
+	switch {
+	case vertical == 1 && horizontal == 1:
+		return "both"
+	case vertical == 1:
+		return "vertical"
+	case horizontal == 1:
+		return "horizontal"
+	}
+	return "off"
+}
+
+func presetMode(values map[string]int) string {
+	switch {
+	case values["Tur"] == 1:
+		return "boost"
+	case values["Quiet"] != 0:
+		return "quiet"
+	case values["SwhSlp"] == 1:
+		return "sleep"
+	}
+	return "none"
+}
+
+func boolValue(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,350 @@
+package gree
+
+import (
+	"encoding/json"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base/basetest"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testMAC = "f4911e000001"
+	testKey = "0123456789abcdef"
+)
+
+// fakeUnit emulates a unit answering on a UDP socket. It answers scans with
+// scanEncryption and binds only with bindEncryption, as some units answer
+// scans without a GCM tag but bind with GCM.
+type fakeUnit struct {
+	conn           *net.UDPConn
+	scanEncryption Encryption
+	bindEncryption Encryption
+
+	mutex sync.Mutex
+	// silent units read requests without answering.
+	silent bool
+	values map[string]int
+	// binds are the encryptions of the bind requests received.
+	binds []Encryption
+}
+
+func newFakeUnit(t *testing.T, scanEncryption, bindEncryption Encryption) *fakeUnit {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &fakeUnit{
+		conn:           conn,
+		scanEncryption: scanEncryption,
+		bindEncryption: bindEncryption,
+		values: map[string]int{
+			"Pow": 1, "Mod": 1, "SetTem": 24, "TemSen": 63, "WdSpd": 0, "SwUpDn": 0,
+		},
+	}
+	go u.serve()
+	return u
+}
+
+func (u *fakeUnit) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		u.mutex.Lock()
+		silent := u.silent
+		u.mutex.Unlock()
+		if silent {
+			continue
+		}
+		var request packet
+		if err := json.Unmarshal(buf[:n], &request); err != nil {
+			continue
+		}
+		if response := u.handle(request); response != nil {
+			data, _ := json.Marshal(response)
+			u.conn.WriteToUDP(data, addr)
+		}
+	}
+}
+
+func (u *fakeUnit) handle(request packet) *packet {
+	if request.T == "scan" {
+		return u.reply(u.scanEncryption, "", map[string]interface{}{
+			"t": "dev", "mac": testMAC, "ver": "V1.0",
+		})
+	}
+	if request.I == 1 {
+		encryption := EncryptionECB
+		if request.Tag != "" {
+			encryption = EncryptionGCM
+		}
+		u.mutex.Lock()
+		u.binds = append(u.binds, encryption)
+		u.mutex.Unlock()
+		if encryption != u.bindEncryption {
+			return nil
+		}
+		var bind pack
+		if !u.decrypt(encryption, "", request, &bind) || bind.T != "bind" || bind.MAC != testMAC {
+			return nil
+		}
+		return u.reply(encryption, "", map[string]interface{}{
+			"t": "bindok", "mac": testMAC, "key": testKey, "r": 200,
+		})
+	}
+	var command pack
+	if !u.decrypt(u.bindEncryption, testKey, request, &command) {
+		return nil
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	switch command.T {
+	case "status":
+		var values []interface{}
+		for _, column := range command.Cols {
+			values = append(values, u.values[column])
+		}
+		return u.reply(u.bindEncryption, testKey, map[string]interface{}{
+			"t": "dat", "mac": testMAC, "r": 200, "cols": command.Cols, "dat": values,
+		})
+	case "cmd":
+		for i, column := range command.Opt {
+			value, _ := intValue(command.P[i])
+			u.values[column] = value
+		}
+		return u.reply(u.bindEncryption, testKey, map[string]interface{}{
+			"t": "res", "mac": testMAC, "r": 200, "opt": command.Opt, "p": command.P, "val": command.P,
+		})
+	}
+	return nil
+}
+
+func (u *fakeUnit) cipher(encryption Encryption, key string) packCipher {
+	if key == "" {
+		cipher, _ := genericCipher(encryption)
+		return cipher
+	}
+	cipher, _ := newPackCipher(encryption, key)
+	return cipher
+}
+
+func (u *fakeUnit) decrypt(encryption Encryption, key string, request packet, v interface{}) bool {
+	plain, err := u.cipher(encryption, key).decrypt(request.Pack, request.Tag)
+	return err == nil && json.Unmarshal(plain, v) == nil
+}
+
+func (u *fakeUnit) reply(encryption Encryption, key string, response map[string]interface{}) *packet {
+	plain, _ := json.Marshal(response)
+	encrypted, tag, _ := u.cipher(encryption, key).encrypt(plain)
+	return &packet{T: "pack", I: 0, CID: testMAC, TCID: "app", Pack: encrypted, Tag: tag}
+}
+
+func (u *fakeUnit) bindsSent() []Encryption {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return append([]Encryption(nil), u.binds...)
+}
+
+func (u *fakeUnit) value(column string) int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.values[column]
+}
+
+func newTestGree(t *testing.T, unit *fakeUnit, encryption Encryption) (*Gree, *basetest.Recorder, func()) {
+	dir, err := ioutil.TempDir("", "gree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port := basetest.HostPort(t, unit.conn.LocalAddr())
+	c := NewGree("test", host, port, "", "", encryption, filepath.Join(dir, "keys.json"),
+		time.Hour, base.ConnectionOptions{ResponseTimeout: 200 * time.Millisecond})
+	return c, basetest.NewRecorder(c), func() {
+		unit.conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGreeBind(t *testing.T) {
+	tests := []struct {
+		name           string
+		scanEncryption Encryption
+		bindEncryption Encryption
+		configured     Encryption
+		binds          []Encryption
+	}{
+		{
+			name:           "ecb",
+			scanEncryption: EncryptionECB,
+			bindEncryption: EncryptionECB,
+			binds:          []Encryption{EncryptionECB},
+		},
+		{
+			name:           "gcm",
+			scanEncryption: EncryptionGCM,
+			bindEncryption: EncryptionGCM,
+			binds:          []Encryption{EncryptionGCM},
+		},
+		{
+			name:           "ecb scan, gcm bind",
+			scanEncryption: EncryptionECB,
+			bindEncryption: EncryptionGCM,
+			binds:          []Encryption{EncryptionECB, EncryptionGCM},
+		},
+		{
+			name:           "gcm configured",
+			scanEncryption: EncryptionECB,
+			bindEncryption: EncryptionGCM,
+			configured:     EncryptionGCM,
+			binds:          []Encryption{EncryptionGCM},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			unit := newFakeUnit(t, test.scanEncryption, test.bindEncryption)
+			c, notifier, cleanup := newTestGree(t, unit, test.configured)
+			defer cleanup()
+			c.Connect()
+			state, _ := notifier.WaitFor(t, 1, 0)
+			c.Close()
+			if !state.Power || state.Mode != base.ModeCool || state.FanMode != "auto" {
+				t.Errorf("got state %+v", state)
+			}
+			if state.Setpoint == nil || *state.Setpoint != 24 ||
+				state.CurrentTemperature == nil || *state.CurrentTemperature != 23 {
+				t.Errorf("got temperatures in %+v", state)
+			}
+			if binds := unit.bindsSent(); !reflect.DeepEqual(binds, test.binds) {
+				t.Errorf("bound with %v, want %v", binds, test.binds)
+			}
+			key, ok := loadKey(c.stateFile, testMAC)
+			if !ok || key.Key != testKey || key.Encryption != test.bindEncryption {
+				t.Errorf("stored key %+v", key)
+			}
+		})
+	}
+}
+
+func TestGreeCommands(t *testing.T) {
+	unit := newFakeUnit(t, EncryptionGCM, EncryptionGCM)
+	c, notifier, cleanup := newTestGree(t, unit, "")
+	defer cleanup()
+	c.Connect()
+	defer c.Close()
+	notifier.WaitFor(t, 1, 0)
+
+	c.SetMode(base.ModeHeat)
+	state, result := notifier.WaitFor(t, 2, 1)
+	if !result.Success || result.Command != "mode" {
+		t.Errorf("got result %+v", result)
+	}
+	if state.Mode != base.ModeHeat || unit.value("Mod") != 4 || unit.value("Pow") != 1 {
+		t.Errorf("got state %+v, unit mode %d", state, unit.value("Mod"))
+	}
+
+	c.SetSwingMode("vertical")
+	state, _ = notifier.WaitFor(t, 3, 2)
+	if state.SwingMode != "vertical" || unit.value("SwUpDn") != 1 || unit.value("SwingLfRig") != 0 {
+		t.Errorf("got state %+v", state)
+	}
+
+	c.SetTemperature(21.6)
+	state, _ = notifier.WaitFor(t, 4, 3)
+	if state.Setpoint == nil || *state.Setpoint != 22 || unit.value("SetTem") != 22 {
+		t.Errorf("got state %+v", state)
+	}
+}
+
+func TestGreeCloseWhileWaiting(t *testing.T) {
+	unit := newFakeUnit(t, EncryptionECB, EncryptionECB)
+	unit.mutex.Lock()
+	unit.silent = true
+	unit.mutex.Unlock()
+	c, _, cleanup := newTestGree(t, unit, "")
+	defer cleanup()
+	c.options.ResponseTimeout = time.Minute
+	c.Connect()
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited for the unit to answer")
+	}
+}
+
+func TestGreeCommandNotConnected(t *testing.T) {
+	unit := newFakeUnit(t, EncryptionECB, EncryptionECB)
+	c, notifier, cleanup := newTestGree(t, unit, "")
+	defer cleanup()
+	c.SetPower(true)
+	_, result := notifier.WaitFor(t, 0, 1)
+	if result.Success || result.Status != base.ErrNotConnected.Error() {
+		t.Errorf("got result %+v", result)
+	}
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	plains := []string{
+		`{"t":"scan"}`,
+		// A multiple of the block size, padded with a whole block.
+		`{"mac":"f4911e000001","t":"bind","uid":0}`[:32],
+		"",
+	}
+	for _, encryption := range []Encryption{EncryptionECB, EncryptionGCM} {
+		for _, key := range []string{"", testKey} {
+			var cipher packCipher
+			var err error
+			if key == "" {
+				cipher, err = genericCipher(encryption)
+			} else {
+				cipher, err = newPackCipher(encryption, key)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, plain := range plains {
+				encrypted, tag, err := cipher.encrypt([]byte(plain))
+				if err != nil {
+					t.Fatalf("%s: encrypting %q: %s", encryption, plain, err)
+				}
+				if (tag != "") != (encryption == EncryptionGCM) {
+					t.Errorf("%s: got tag %q", encryption, tag)
+				}
+				decrypted, err := cipher.decrypt(encrypted, tag)
+				if err != nil || string(decrypted) != plain {
+					t.Errorf("%s: %q decrypted to %q, error %v", encryption, plain, decrypted, err)
+				}
+			}
+		}
+	}
+}
+
+func TestCipherWrongKey(t *testing.T) {
+	for _, encryption := range []Encryption{EncryptionECB, EncryptionGCM} {
+		generic, _ := genericCipher(encryption)
+		device, _ := newPackCipher(encryption, testKey)
+		encrypted, tag, _ := generic.encrypt([]byte(`{"t":"scan"}`))
+		if decrypted, err := device.decrypt(encrypted, tag); err == nil && string(decrypted) == `{"t":"scan"}` {
+			t.Errorf("%s: decrypted with the wrong key", encryption)
+		}
+	}
+	gcm, _ := newPackCipher(EncryptionGCM, testKey)
+	encrypted, _, _ := gcm.encrypt([]byte(`{"t":"status"}`))
+	if _, err := gcm.decrypt(encrypted, "AAAAAAAAAAAAAAAAAAAAAA=="); err == nil {
+		t.Error("gcm: decrypted with a wrong tag")
+	}
+}
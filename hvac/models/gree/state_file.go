@@ -0,0 +1,65 @@
+package gree
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// boundKey is the device key obtained by binding, kept across restarts so
+// that units need not be bound again.
+type boundKey struct {
+	Key        string     `json:"key"`
+	Encryption Encryption `json:"encryption"`
+}
+
+var stateFileMutex sync.Mutex
+
+// loadKey returns the key stored for the MAC address in the state file.
+func loadKey(stateFile, mac string) (boundKey, bool) {
+	stateFileMutex.Lock()
+	defer stateFileMutex.Unlock()
+	keys, err := readKeys(stateFile)
+	if err != nil {
+		return boundKey{}, false
+	}
+	key, ok := keys[mac]
+	return key, ok && key.Key != ""
+}
+
+// storeKey records the key of the MAC address in the state file, keeping
+// the keys of other units. An empty key removes the MAC address.
+func storeKey(stateFile, mac string, key boundKey) error {
+	stateFileMutex.Lock()
+	defer stateFileMutex.Unlock()
+	keys, err := readKeys(stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if keys == nil {
+		keys = make(map[string]boundKey)
+	}
+	if key.Key == "" {
+		delete(keys, mac)
+	} else {
+		keys[mac] = key
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(stateFile, data, 0600)
+}
+
+func readKeys(stateFile string) (map[string]boundKey, error) {
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	var keys map[string]boundKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
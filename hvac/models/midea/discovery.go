@@ -0,0 +1,144 @@
+package midea
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// discoveryPort is where units answer discovery requests.
+const discoveryPort = "6445"
+
+// discoveryRequest is the probe broadcast by the Midea app.
+var discoveryRequest = []byte{
+	0x5a, 0x5a, 0x01, 0x11, 0x48, 0x00, 0x92, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x75, 0xbd, 0x6b, 0x3e, 0x4f, 0x8b, 0x76, 0x2e,
+	0x84, 0x9c, 0x6e, 0x57, 0x8d, 0x65, 0x90, 0x03,
+	0x6e, 0x9d, 0x43, 0x42, 0xa5, 0x0f, 0x1f, 0x56,
+	0x9e, 0xb8, 0xec, 0x91, 0x8e, 0x92, 0xe5, 0xe3,
+}
+
+// DiscoveredDevice is a Midea unit that answered the discovery request.
+type DiscoveredDevice struct {
+	Host string `json:"host"`
+	Port string `json:"port"`
+	// ID is the device id, configured as the duid.
+	ID      string `json:"id"`
+	Version int    `json:"version"`
+	// Type is the appliance type, "ac" for air conditioners.
+	Type         string `json:"type"`
+	SerialNumber string `json:"serial_number"`
+	SSID         string `json:"ssid"`
+}
+
+// Discover broadcasts the discovery request and collects the answers until
+// the context is done.
+func Discover(ctx context.Context) ([]DiscoveredDevice, error) {
+	return discover(ctx, net.JoinHostPort("255.255.255.255", discoveryPort), false)
+}
+
+// probe asks a single unit for its device id and protocol version.
+func probe(ctx context.Context, host string, timeout time.Duration) (DiscoveredDevice, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	devices, err := discover(ctx, net.JoinHostPort(host, discoveryPort), true)
+	if err != nil {
+		return DiscoveredDevice{}, err
+	}
+	if len(devices) == 0 {
+		return DiscoveredDevice{}, fmt.Errorf("no answer from %s", host)
+	}
+	return devices[0], nil
+}
+
+func discover(ctx context.Context, address string, single bool) ([]DiscoveredDevice, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(discoveryRequest, addr); err != nil {
+		return nil, err
+	}
+
+	var devices []DiscoveredDevice
+	seen := make(map[string]bool)
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return devices, nil
+			}
+			return devices, err
+		}
+		device, err := parseDiscoveryResponse(buf[:n])
+		if err != nil {
+			continue
+		}
+		if udp, ok := from.(*net.UDPAddr); ok {
+			device.Host = udp.IP.String()
+		}
+		if seen[device.ID] {
+			continue
+		}
+		seen[device.ID] = true
+		devices = append(devices, device)
+		if single {
+			return devices, nil
+		}
+	}
+}
+
+func parseDiscoveryResponse(data []byte) (DiscoveredDevice, error) {
+	device := DiscoveredDevice{Version: 2}
+	if len(data) >= 2 && data[0] == 0x83 && data[1] == 0x70 {
+		// Version 3 units wrap the packet into an 8370 header.
+		if len(data) < 8+packetHeaderSize+packetSumSize+16 {
+			return device, errors.New("short discovery response")
+		}
+		device.Version = 3
+		data = data[8 : len(data)-16]
+	}
+	if len(data) < packetHeaderSize+packetSumSize || data[0] != 0x5a || data[1] != 0x5a {
+		return device, errors.New("not a discovery response")
+	}
+	reply, err := decryptFrame(data[packetHeaderSize : len(data)-packetSumSize])
+	if err != nil {
+		return device, err
+	}
+	if len(reply) < 41 {
+		return device, errors.New("short discovery reply")
+	}
+	id := make([]byte, 8)
+	copy(id, data[20:26])
+	device.ID = strconv.FormatUint(binary.LittleEndian.Uint64(id), 10)
+	device.Host = fmt.Sprintf("%d.%d.%d.%d", reply[3], reply[2], reply[1], reply[0])
+	device.Port = strconv.Itoa(int(binary.LittleEndian.Uint32(reply[4:8])))
+	device.SerialNumber = strings.TrimRight(string(reply[8:40]), "\x00")
+	if end := 41 + int(reply[40]); end <= len(reply) {
+		device.SSID = string(reply[41:end])
+	}
+	// The access point of the unit is named like net_ac_XXXX.
+	if parts := strings.Split(device.SSID, "_"); len(parts) > 2 {
+		device.Type = strings.ToLower(parts[1])
+	}
+	return device, nil
+}
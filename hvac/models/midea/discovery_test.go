@@ -0,0 +1,66 @@
+package midea
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// discoveryResponse builds the answer of a unit with the given device id,
+// wrapped into an 8370 header for version 3 units.
+func discoveryResponse(id uint64, version int) []byte {
+	reply := make([]byte, 41)
+	copy(reply[0:4], []byte{10, 1, 168, 192})
+	binary.LittleEndian.PutUint32(reply[4:8], 6444)
+	copy(reply[8:40], "000000P0000000Q1F0C9D153F7AB0000")
+	ssid := "net_ac_F7AB"
+	reply[40] = byte(len(ssid))
+	reply = append(reply, ssid...)
+
+	packet := make([]byte, packetHeaderSize)
+	packet[0], packet[1] = 0x5a, 0x5a
+	binary.LittleEndian.PutUint64(packet[20:28], id)
+	packet = append(packet, encryptFrame(reply)...)
+	packet = append(packet, packetSum(packet)...)
+	if version == 2 {
+		return packet
+	}
+	message := []byte{0x83, 0x70, 0, 0, 0x20, 0, 0, 0}
+	message = append(message, packet...)
+	return append(message, make([]byte, 16)...)
+}
+
+func TestParseDiscoveryResponse(t *testing.T) {
+	for _, version := range []int{2, 3} {
+		device, err := parseDiscoveryResponse(discoveryResponse(0x1234567890, version))
+		if err != nil {
+			t.Fatalf("version %d: %s", version, err)
+		}
+		want := DiscoveredDevice{
+			Host:         "192.168.1.10",
+			Port:         "6444",
+			ID:           "78187493520",
+			Version:      version,
+			Type:         "ac",
+			SerialNumber: "000000P0000000Q1F0C9D153F7AB0000",
+			SSID:         "net_ac_F7AB",
+		}
+		if device != want {
+			t.Errorf("version %d: got %+v, want %+v", version, device, want)
+		}
+	}
+}
+
+func TestParseDiscoveryResponseInvalid(t *testing.T) {
+	valid := discoveryResponse(1, 2)
+	for name, data := range map[string][]byte{
+		"empty":          nil,
+		"short 8370":     {0x83, 0x70, 0, 0},
+		"not 5a5a":       append([]byte{0x00, 0x00}, valid[2:]...),
+		"truncated":      valid[:packetHeaderSize+packetSumSize+8],
+		"request echoed": discoveryRequest,
+	} {
+		if device, err := parseDiscoveryResponse(data); err == nil {
+			t.Errorf("%s: parsed %+v", name, device)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package midea
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	applianceAirConditioner = 0xac
+	frameTypeSet            = 0x02
+	frameTypeQuery          = 0x03
+	frameHeaderSize         = 10
+	packetHeaderSize        = 40
+	packetSumSize           = 16
+	// statusResponse starts the body of frames reporting the unit's state.
+	statusResponse = 0xc0
+)
+
+// crc8 is the CRC-8/MAXIM checksum closing frame bodies.
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8c
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// newFrame builds an AA frame for the air conditioner, adding the message id
+// and CRC to the body.
+func newFrame(frameType byte, body []byte, messageID byte) []byte {
+	body = append(append([]byte(nil), body...), messageID)
+	body = append(body, crc8(body))
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(body)+1)
+	frame[0] = 0xaa
+	frame[1] = byte(frameHeaderSize + len(body))
+	frame[2] = applianceAirConditioner
+	frame[9] = frameType
+	frame = append(frame, body...)
+	var sum byte
+	for _, b := range frame[1:] {
+		sum += b
+	}
+	return append(frame, -sum)
+}
+
+// frameBody returns the body of a received AA frame, without its CRC and
+// checksum.
+func frameBody(frame []byte) ([]byte, error) {
+	if len(frame) < frameHeaderSize+2 || frame[0] != 0xaa {
+		return nil, errors.New("not a frame")
+	}
+	if int(frame[1])+1 != len(frame) {
+		return nil, fmt.Errorf("Frame length %d does not match %d", frame[1], len(frame))
+	}
+	var sum byte
+	for _, b := range frame[1:] {
+		sum += b
+	}
+	if sum != 0 {
+		return nil, errors.New("frame checksum mismatch")
+	}
+	return frame[frameHeaderSize : len(frame)-2], nil
+}
+
+// newPacket wraps an encrypted frame into a 5A5A packet addressed to the
+// device.
+func newPacket(deviceID uint64, messageID uint32, frame []byte, now time.Time) []byte {
+	packet := make([]byte, packetHeaderSize)
+	packet[0], packet[1] = 0x5a, 0x5a
+	packet[2], packet[3] = 0x01, 0x11
+	packet[6] = 0x20
+	binary.LittleEndian.PutUint32(packet[8:12], messageID)
+	copy(packet[12:20], packetTime(now))
+	binary.LittleEndian.PutUint64(packet[20:28], deviceID)
+	packet = append(packet, encryptFrame(frame)...)
+	binary.LittleEndian.PutUint16(packet[4:6], uint16(len(packet)+packetSumSize))
+	return append(packet, packetSum(packet)...)
+}
+
+// packetTime encodes the time as its decimal digit pairs, least significant
+// first.
+func packetTime(now time.Time) []byte {
+	digits := now.Format("20060102150405") + fmt.Sprintf("%02d", now.Nanosecond()/1e7)
+	var encoded []byte
+	for i := 0; i+1 < len(digits); i += 2 {
+		encoded = append([]byte{(digits[i]-'0')*10 + digits[i+1] - '0'}, encoded...)
+	}
+	return encoded
+}
+
+// packetFrame checks a received 5A5A packet and returns its decrypted frame.
+func packetFrame(packet []byte) ([]byte, error) {
+	if len(packet) < packetHeaderSize+packetSumSize || packet[0] != 0x5a || packet[1] != 0x5a {
+		return nil, errors.New("not a 5A5A packet")
+	}
+	length := int(binary.LittleEndian.Uint16(packet[4:6]))
+	if length != len(packet) {
+		return nil, fmt.Errorf("Packet length %d does not match %d", length, len(packet))
+	}
+	sum := packetSum(packet[:length-packetSumSize])
+	for i, b := range sum {
+		if packet[length-packetSumSize+i] != b {
+			return nil, errors.New("packet checksum mismatch")
+		}
+	}
+	return decryptFrame(packet[packetHeaderSize : length-packetSumSize])
+}
+
+// queryStatus asks for the unit's state, with the indoor temperature.
+func queryStatus() []byte {
+	return []byte{
+		0x41, 0x81, 0x00, 0xff, 0x03, 0xff, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x03,
+	}
+}
+
+// status is the unit's state, as reported by and sent to it.
+type status struct {
+	power       bool
+	mode        byte
+	setpoint    float64
+	fanSpeed    byte
+	swing       byte
+	turbo       bool
+	eco         bool
+	sleep       bool
+	indoor      *float64
+	outdoor     *float64
+	displayOn   bool
+	errorCode   byte
+	initialized bool
+}
+
+// setStatus builds the body of the command applying the state.
+func setStatus(s status) []byte {
+	body := make([]byte, 25)
+	body[0] = 0x40
+	body[1] = 0x02
+	if s.power {
+		body[1] |= 0x01
+	}
+	whole, fraction := math.Modf(s.setpoint)
+	temperature := int(whole)
+	if temperature >= 17 && temperature <= 30 {
+		body[2] = byte(temperature-16) & 0x0f
+	} else {
+		// Setpoints out of the nibble range go in their own byte.
+		body[19] = byte(temperature-12) & 0x1f
+	}
+	if fraction > 0 {
+		body[2] |= 0x10
+	}
+	body[2] |= (s.mode & 0x07) << 5
+	body[3] = s.fanSpeed
+	body[4], body[5] = 0x7f, 0x7f
+	body[7] = 0x30 | s.swing&0x0f
+	if s.turbo {
+		body[8] = 0x20
+		body[10] |= 0x02
+	}
+	if s.eco {
+		body[9] = 0x80
+	}
+	if s.sleep {
+		body[10] |= 0x01
+	}
+	return body
+}
+
+// parseStatus decodes the body of a status response.
+func parseStatus(body []byte) (status, error) {
+	if len(body) < 14 || body[0] != statusResponse {
+		return status{}, errors.New("not a status response")
+	}
+	s := status{
+		power:       body[1]&0x01 != 0,
+		mode:        body[2] >> 5 & 0x07,
+		setpoint:    float64(body[2]&0x0f) + 16,
+		fanSpeed:    body[3] & 0x7f,
+		swing:       body[7] & 0x0f,
+		turbo:       body[8]&0x20 != 0 || body[10]&0x02 != 0,
+		eco:         body[9]&0x10 != 0,
+		sleep:       body[10]&0x01 != 0,
+		initialized: true,
+	}
+	if body[2]&0x10 != 0 {
+		s.setpoint += 0.5
+	}
+	if alternate := body[13] & 0x1f; alternate != 0 {
+		s.setpoint = float64(alternate) + 12
+		if body[2]&0x10 != 0 {
+			s.setpoint += 0.5
+		}
+	}
+	var decimals byte
+	if len(body) > 15 {
+		decimals = body[15]
+	}
+	s.indoor = sensorTemperature(body[11], decimals&0x0f)
+	s.outdoor = sensorTemperature(body[12], decimals>>4)
+	if len(body) > 16 {
+		s.errorCode = body[16]
+	}
+	if len(body) > 14 {
+		s.displayOn = body[14]&0x70 != 0x70
+	}
+	return s, nil
+}
+
+// sensorTemperature decodes a temperature sent as twice its value plus 50.
+// Newer units add the tenths of a degree separately.
+func sensorTemperature(value, tenths byte) *float64 {
+	if value == 0 || value == 0xff {
+		return nil
+	}
+	temperature := float64(int(value)-50) / 2
+	if tenths != 0 {
+		whole := math.Trunc(temperature)
+		if temperature >= 0 {
+			temperature = whole + float64(tenths)/10
+		} else {
+			temperature = whole - float64(tenths)/10
+		}
+	}
+	return &temperature
+}
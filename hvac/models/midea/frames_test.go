@@ -0,0 +1,210 @@
+package midea
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCRC8(t *testing.T) {
+	// The check value of CRC-8/MAXIM.
+	if got := crc8([]byte("123456789")); got != 0xa1 {
+		t.Errorf("got %#x, want 0xa1", got)
+	}
+	if got := crc8(nil); got != 0 {
+		t.Errorf("got %#x for no data, want 0", got)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	body := queryStatus()
+	frame := newFrame(frameTypeQuery, body, 7)
+	if frame[0] != 0xaa || int(frame[1])+1 != len(frame) || frame[2] != applianceAirConditioner || frame[9] != frameTypeQuery {
+		t.Fatalf("got frame header % x", frame[:frameHeaderSize])
+	}
+	if crc := frame[len(frame)-2]; crc != crc8(append(append([]byte(nil), body...), 7)) {
+		t.Errorf("got crc %#x", crc)
+	}
+	got, err := frameBody(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The message id stays at the end of the body.
+	if want := append(append([]byte(nil), body...), 7); !bytes.Equal(got, want) {
+		t.Errorf("got body % x, want % x", got, want)
+	}
+
+	corrupted := append([]byte(nil), frame...)
+	corrupted[12] ^= 0x01
+	if _, err := frameBody(corrupted); err == nil {
+		t.Error("accepted a frame with a wrong checksum")
+	}
+	if _, err := frameBody(frame[:len(frame)-1]); err == nil {
+		t.Error("accepted a truncated frame")
+	}
+	if _, err := frameBody([]byte{0x5a, 0x5a}); err == nil {
+		t.Error("accepted a short frame")
+	}
+}
+
+func TestPacketTime(t *testing.T) {
+	now := time.Date(2026, 10, 17, 15, 43, 2, 370000000, time.UTC)
+	want := []byte{37, 2, 43, 15, 17, 10, 26, 20}
+	if got := packetTime(now); !bytes.Equal(got, want) {
+		t.Errorf("got % d, want % d", got, want)
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	frame := newFrame(frameTypeSet, setStatus(status{power: true, setpoint: 22}), 3)
+	now := time.Date(2026, 10, 17, 15, 43, 2, 0, time.UTC)
+	packet := newPacket(0x123456789a, 3, frame, now)
+	if packet[0] != 0x5a || packet[1] != 0x5a || int(packet[4])|int(packet[5])<<8 != len(packet) {
+		t.Fatalf("got packet header % x", packet[:packetHeaderSize])
+	}
+	if !bytes.Equal(packet[20:28], []byte{0x9a, 0x78, 0x56, 0x34, 0x12, 0, 0, 0}) {
+		t.Errorf("got device id % x", packet[20:28])
+	}
+	got, err := packetFrame(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, frame) {
+		t.Errorf("got frame % x, want % x", got, frame)
+	}
+	packet[packetHeaderSize] ^= 0x01
+	if _, err := packetFrame(packet); err == nil {
+		t.Error("accepted a packet with a wrong checksum")
+	}
+}
+
+func TestSplitPackets(t *testing.T) {
+	frame := newFrame(frameTypeQuery, queryStatus(), 1)
+	first := newPacket(1, 1, frame, time.Now())
+	second := newPacket(1, 2, frame, time.Now())
+	packets := splitPackets(append(append(append([]byte(nil), first...), second...), 0x00))
+	if len(packets) != 2 || !bytes.Equal(packets[0], first) || !bytes.Equal(packets[1], second) {
+		t.Errorf("got %d packets", len(packets))
+	}
+}
+
+func TestSetStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status status
+		want   map[int]byte
+	}{
+		{
+			name:   "cool",
+			status: status{power: true, mode: 2, setpoint: 24, fanSpeed: 60, swing: 0x0c},
+			want:   map[int]byte{0: 0x40, 1: 0x03, 2: 2<<5 | 8, 3: 60, 7: 0x3c, 19: 0},
+		},
+		{
+			name:   "half degree",
+			status: status{power: true, mode: 4, setpoint: 21.5},
+			want:   map[int]byte{2: 4<<5 | 0x10 | 5, 19: 0},
+		},
+		{
+			name:   "setpoint below the nibble range",
+			status: status{mode: 1, setpoint: 16},
+			want:   map[int]byte{1: 0x02, 2: 1 << 5, 19: 4},
+		},
+		{
+			name:   "presets",
+			status: status{power: true, turbo: true, eco: true, sleep: true, setpoint: 26},
+			want:   map[int]byte{8: 0x20, 9: 0x80, 10: 0x03},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := setStatus(test.status)
+			if len(body) != 25 {
+				t.Fatalf("got %d bytes", len(body))
+			}
+			for i, want := range test.want {
+				if body[i] != want {
+					t.Errorf("got byte %d %#x, want %#x", i, body[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	body := make([]byte, 22)
+	body[0] = statusResponse
+	body[1] = 0x01
+	body[2] = 2<<5 | 0x10 | 7
+	body[3] = 80
+	body[7] = 0x0c
+	body[8] = 0x20
+	body[9] = 0x10
+	body[11] = 50 + 2*23
+	body[12] = 50 + 2*12
+	body[14] = 0x70
+	body[15] = 0x34
+	body[16] = 5
+	s, err := parseStatus(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.power || s.mode != 2 || s.setpoint != 23.5 || s.fanSpeed != 80 || s.swing != 0x0c ||
+		!s.turbo || !s.eco || s.sleep || s.displayOn || s.errorCode != 5 || !s.initialized {
+		t.Errorf("got status %+v", s)
+	}
+	if s.indoor == nil || *s.indoor != 23.4 || s.outdoor == nil || *s.outdoor != 12.3 {
+		t.Errorf("got temperatures %v, %v", s.indoor, s.outdoor)
+	}
+
+	// Setpoints outside the nibble range are sent in their own byte.
+	body[13] = 30 - 12
+	body[2] = 4 << 5
+	if s, _ := parseStatus(body); s.setpoint != 30 || s.mode != 4 {
+		t.Errorf("got status %+v", s)
+	}
+
+	if _, err := parseStatus(setStatus(s)); err == nil {
+		t.Error("parsed a set command as a status")
+	}
+	if _, err := parseStatus(body[:10]); err == nil {
+		t.Error("parsed a short status")
+	}
+}
+
+func TestStatusRoundTrip(t *testing.T) {
+	sent := status{power: true, mode: 3, setpoint: 25.5, fanSpeed: 40, swing: 0x03, sleep: true}
+	body := setStatus(sent)
+	body[0] = statusResponse
+	got, err := parseStatus(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.power != sent.power || got.mode != sent.mode || got.setpoint != sent.setpoint ||
+		got.fanSpeed != sent.fanSpeed || got.swing != sent.swing || got.sleep != sent.sleep {
+		t.Errorf("sent %+v, got %+v", sent, got)
+	}
+}
+
+func TestSensorTemperature(t *testing.T) {
+	tests := []struct {
+		value, tenths byte
+		want          *float64
+	}{
+		{0, 0, nil},
+		{0xff, 0, nil},
+		{50 + 2*21, 0, float(21)},
+		{50 + 43, 0, float(21.5)},
+		{50 + 43, 7, float(21.7)},
+		{50 - 2*3, 2, float(-3.2)},
+	}
+	for _, test := range tests {
+		got := sensorTemperature(test.value, test.tenths)
+		if (got == nil) != (test.want == nil) || got != nil && *got != *test.want {
+			t.Errorf("sensorTemperature(%d, %d) = %v, want %v", test.value, test.tenths, got, test.want)
+		}
+	}
+}
+
+func float(value float64) *float64 {
+	return &value
+}
@@ -0,0 +1,525 @@
+package midea
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	models.Register("midea", newFromConfig)
+}
+
+// Config is the midea specific part of the device configuration. The duid is
+// the decimal device id, which is found by probing the host if not given.
+type Config struct {
+	// Token and Key authenticate with version 3 units. Both are hex strings
+	// obtained from the Midea cloud.
+	Token string `yaml:"token"`
+	Key   string `yaml:"key"`
+	// PollInterval is how often the state is read, such as "30s".
+	PollInterval string `yaml:"poll_interval"`
+}
+
+const (
+	defaultPort         = "6444"
+	defaultPollInterval = time.Second * 30
+	tokenSize           = 64
+	keySize             = 32
+)
+
+func newFromConfig(params models.Params) (base.Controller, error) {
+	var config Config
+	if err := params.Decode(&config); err != nil {
+		return nil, err
+	}
+	if (config.Token == "") != (config.Key == "") {
+		return nil, fmt.Errorf("token and key must be given together")
+	}
+	var token, key []byte
+	if config.Token != "" {
+		var err error
+		token, err = hex.DecodeString(config.Token)
+		if err != nil || len(token) != tokenSize {
+			return nil, fmt.Errorf("token must be %d hex digits", tokenSize*2)
+		}
+		key, err = hex.DecodeString(config.Key)
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("key must be %d hex digits", keySize*2)
+		}
+	}
+	var deviceID uint64
+	if params.DUID != "" {
+		var err error
+		deviceID, err = strconv.ParseUint(params.DUID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid duid %q: must be the decimal device id", params.DUID)
+		}
+	}
+	pollInterval := defaultPollInterval
+	if config.PollInterval != "" {
+		var err error
+		pollInterval, err = time.ParseDuration(config.PollInterval)
+		if err != nil || pollInterval <= 0 {
+			return nil, fmt.Errorf("Invalid poll_interval %q", config.PollInterval)
+		}
+	}
+	return NewMidea(params.Name, params.Host, params.Port, deviceID, token, key,
+		pollInterval, params.ConnectionOptions), nil
+}
+
+// Midea controls an air conditioner speaking the Midea LAN protocol, either
+// version 2 or version 3 with its token authentication.
+type Midea struct {
+	name    string
+	host    string
+	port    string
+	token   []byte
+	key     []byte
+	options base.ConnectionOptions
+	poller  *base.Poller
+
+	// deviceID, conn, session and messageID are only used by the polling
+	// goroutine, which makes all the exchanges with the unit. session is set
+	// on version 3 connections once authenticated.
+	deviceID  uint64
+	conn      net.Conn
+	session   *session
+	messageID uint32
+
+	// mutex guards the fields below and the poller's state.
+	mutex    sync.Mutex
+	notifier base.Notifier
+	status   status
+}
+
+func NewMidea(name, host, port string, deviceID uint64, token, key []byte,
+	pollInterval time.Duration, options base.ConnectionOptions) *Midea {
+	if port == "" {
+		port = defaultPort
+	}
+	c := &Midea{
+		name:     name,
+		host:     host,
+		port:     port,
+		deviceID: deviceID,
+		token:    token,
+		key:      key,
+		options:  options.WithDefaults(),
+	}
+	c.poller = base.NewPoller(pollInterval, &c.mutex, &c.notifier, c.poll, c.applyStatus)
+	return c
+}
+
+func (c *Midea) SetStateNotifier(stateNotifier base.StateNotifier) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notifier.SetStateNotifier(stateNotifier)
+}
+
+func (c *Midea) ConnectionState() base.ConnectionState {
+	return c.poller.State()
+}
+
+func (c *Midea) Connect() {
+	c.poller.Start()
+}
+
+func (c *Midea) Close() {
+	log.Printf("Closing %s", c.name)
+	c.poller.Stop()
+	// The polling goroutine has returned, so the connection can be closed.
+	c.disconnect()
+}
+
+// interruptOnCancel closes the connection when ctx is done before stop is
+// called, interrupting a blocked read or write.
+func interruptOnCancel(ctx context.Context, conn net.Conn) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+// ensureConnected connects to the unit, finding its device id first and
+// authenticating on version 3 units.
+func (c *Midea) ensureConnected(ctx context.Context) error {
+	if c.conn != nil {
+		return nil
+	}
+	if c.deviceID == 0 {
+		device, err := probe(ctx, c.host, c.options.ResponseTimeout)
+		if err != nil {
+			return fmt.Errorf("probing: %s", err)
+		}
+		if device.Version == 3 && c.token == nil {
+			return fmt.Errorf("version 3 unit %s needs token and key", device.ID)
+		}
+		c.deviceID, _ = strconv.ParseUint(device.ID, 10, 64)
+		log.Printf("Found %s: id %s, version %d, serial number %s", c.name, device.ID, device.Version, device.SerialNumber)
+	}
+	dialer := net.Dialer{Timeout: c.options.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.host, c.port))
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	if c.token == nil {
+		return nil
+	}
+	stop := interruptOnCancel(ctx, conn)
+	defer stop()
+	if err := c.authenticate(); err != nil {
+		c.disconnect()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// authenticate performs the version 3 handshake, agreeing on the key of the
+// session.
+func (c *Midea) authenticate() error {
+	s := &session{}
+	request, err := s.encode8370(c.token, msgHandshakeRequest)
+	if err != nil {
+		return err
+	}
+	if err := c.write(request); err != nil {
+		return err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.options.ResponseTimeout))
+	message, err := c.readMessage()
+	if err != nil {
+		return err
+	}
+	msgType, data, err := s.decode8370(message)
+	if err != nil {
+		return err
+	}
+	if msgType != msgHandshakeResponse {
+		return fmt.Errorf("Unexpected handshake response type %d", msgType)
+	}
+	if len(data) > handshakeResponseSize {
+		data = data[:handshakeResponseSize]
+	}
+	s.tcpKey, err = handshakeKey(data, c.key)
+	if err != nil {
+		return err
+	}
+	c.session = s
+	log.Printf("Authenticated with %s", c.name)
+	return nil
+}
+
+func (c *Midea) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = nil
+	c.session = nil
+}
+
+func (c *Midea) write(data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// readMessage reads one 5A5A packet or 8370 message, using the length in
+// its header.
+func (c *Midea) readMessage() ([]byte, error) {
+	header := make([]byte, headerSize8370)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	var length int
+	switch {
+	case header[0] == 0x83 && header[1] == 0x70:
+		length = int(binary.BigEndian.Uint16(header[2:4])) + 8
+	case header[0] == 0x5a && header[1] == 0x5a:
+		length = int(binary.LittleEndian.Uint16(header[4:6]))
+	default:
+		return nil, fmt.Errorf("Unexpected message header % x", header)
+	}
+	if length < len(header) {
+		return nil, fmt.Errorf("Invalid message length %d", length)
+	}
+	message := make([]byte, length)
+	copy(message, header)
+	if _, err := io.ReadFull(c.conn, message[len(header):]); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// request sends a frame to the unit and returns the status it answers with.
+func (c *Midea) request(ctx context.Context, frameType byte, body []byte) (status, error) {
+	if err := c.ensureConnected(ctx); err != nil {
+		return status{}, err
+	}
+	stop := interruptOnCancel(ctx, c.conn)
+	defer stop()
+	s, err := c.exchange(frameType, body)
+	if err != nil && ctx.Err() != nil {
+		return status{}, ctx.Err()
+	}
+	return s, err
+}
+
+func (c *Midea) exchange(frameType byte, body []byte) (status, error) {
+	c.messageID++
+	frame := newFrame(frameType, body, byte(c.messageID))
+	message := newPacket(c.deviceID, c.messageID, frame, time.Now())
+	if c.session != nil {
+		var err error
+		message, err = c.session.encode8370(message, msgEncryptedRequest)
+		if err != nil {
+			return status{}, err
+		}
+	}
+	if err := c.write(message); err != nil {
+		c.disconnect()
+		return status{}, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.options.ResponseTimeout))
+	for {
+		message, err := c.readMessage()
+		if err != nil {
+			c.disconnect()
+			return status{}, err
+		}
+		packets := [][]byte{message}
+		if c.session != nil {
+			_, data, err := c.session.decode8370(message)
+			if err != nil {
+				c.disconnect()
+				return status{}, err
+			}
+			packets = splitPackets(data)
+		}
+		for _, packet := range packets {
+			frame, err := packetFrame(packet)
+			if err != nil {
+				log.Printf("Ignoring invalid packet from %s: %s", c.name, err)
+				continue
+			}
+			body, err := frameBody(frame)
+			if err != nil {
+				log.Printf("Ignoring invalid frame from %s: %s", c.name, err)
+				continue
+			}
+			if s, err := parseStatus(body); err == nil {
+				return s, nil
+			}
+		}
+	}
+}
+
+// splitPackets splits the concatenated 5A5A packets of an 8370 message.
+func splitPackets(data []byte) [][]byte {
+	var packets [][]byte
+	for len(data) >= 6 {
+		length := int(binary.LittleEndian.Uint16(data[4:6]))
+		if length < 6 || length > len(data) {
+			break
+		}
+		packets = append(packets, data[:length])
+		data = data[length:]
+	}
+	return packets
+}
+
+// poll reads the unit's status, marking it offline if it does not answer.
+func (c *Midea) poll(ctx context.Context) {
+	s, err := c.request(ctx, frameTypeQuery, queryStatus())
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Polling %s failed: %s", c.name, err)
+		c.poller.Failed(err)
+		return
+	}
+	c.status = s
+	c.poller.Succeeded()
+	c.notifier.UpdateState(c.snapshot())
+}
+
+func (c *Midea) Snapshot() base.State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.snapshot()
+}
+
+func (c *Midea) snapshot() base.State {
+	s := c.status
+	if !s.initialized {
+		return base.State{}
+	}
+	state := base.State{
+		Power:              s.power,
+		Mode:               base.Mode(modeTable.FromDevice(int(s.mode))),
+		FanMode:            fanModeTable.FromDevice(int(s.fanSpeed)),
+		SwingMode:          swingModeTable.FromDevice(int(s.swing)),
+		PresetMode:         presetMode(s),
+		Setpoint:           base.Float(s.setpoint),
+		CurrentTemperature: s.indoor,
+		Extras: map[string]string{
+			"display":    strconv.FormatBool(s.displayOn),
+			"error_code": strconv.Itoa(int(s.errorCode)),
+		},
+	}
+	if s.outdoor != nil {
+		state.Extras["outdoor_temperature"] = strconv.FormatFloat(*s.outdoor, 'f', -1, 64)
+	}
+	switch state.EffectiveMode() {
+	case base.ModeOff:
+		state.Action = base.ActionOff
+	case base.ModeFanOnly:
+		state.Action = base.ActionFan
+	case base.ModeCool:
+		state.Action = base.ActionCooling
+	case base.ModeHeat:
+		state.Action = base.ActionHeating
+	case base.ModeDry:
+		state.Action = base.ActionDrying
+	}
+	return state
+}
+
+func (c *Midea) Capabilities() base.Capabilities {
+	return base.Capabilities{
+		Modes:              base.Modes,
+		FanModes:           fanModeTable.MQTTValues(),
+		SwingModes:         base.SwingModes,
+		PresetModes:        []string{"eco", "boost", "sleep"},
+		MinTemperature:     16,
+		MaxTemperature:     30,
+		TemperatureStep:    0.5,
+		CurrentTemperature: true,
+	}
+}
+
+func (c *Midea) SetPower(on bool) {
+	value := "OFF"
+	if on {
+		value = "ON"
+	}
+	c.sendCommand("power", value, func(s *status) {
+		s.power = on
+	})
+}
+
+func (c *Midea) SetMode(mode base.Mode) {
+	c.sendCommand("mode", string(mode), func(s *status) {
+		if mode == base.ModeOff {
+			s.power = false
+			return
+		}
+		s.power = true
+		s.mode = byte(modeTable.ToDevice(string(mode)))
+	})
+}
+
+func (c *Midea) SetFanMode(fanMode string) {
+	c.sendCommand("fan_mode", fanMode, func(s *status) {
+		s.fanSpeed = byte(fanModeTable.ToDevice(fanMode))
+	})
+}
+
+func (c *Midea) SetSwingMode(swingMode string) {
+	c.sendCommand("swing_mode", swingMode, func(s *status) {
+		s.swing = byte(swingModeTable.ToDevice(swingMode))
+	})
+}
+
+func (c *Midea) SetPresetMode(presetMode string) {
+	c.sendCommand("preset_mode", presetMode, func(s *status) {
+		s.turbo = presetMode == "boost"
+		s.eco = presetMode == "eco"
+		s.sleep = presetMode == "sleep"
+	})
+}
+
+func (c *Midea) SetTemperature(temperature float64) {
+	value := math.Round(temperature*2) / 2
+	c.sendCommand("temperature", strconv.FormatFloat(value, 'f', -1, 64), func(s *status) {
+		s.setpoint = value
+	})
+}
+
+func (c *Midea) sendCommand(command, value string, change func(s *status)) {
+	c.poller.Send(base.CommandResult{
+		Command: command,
+		Value:   value,
+	}, change)
+}
+
+// applyStatus applies the change to the unit's current state and sends the
+// whole state, as the unit expects, reporting whether it was accepted.
+func (c *Midea) applyStatus(ctx context.Context, command *base.PolledCommand) {
+	result := command.Result
+	// The status is only changed by this goroutine, so it stays current
+	// while the mutex is released.
+	c.mutex.Lock()
+	current := c.status
+	c.mutex.Unlock()
+	if !current.initialized {
+		s, err := c.request(ctx, frameTypeQuery, queryStatus())
+		c.mutex.Lock()
+		if err != nil {
+			if ctx.Err() == nil {
+				c.poller.Failed(err)
+			}
+			c.notifier.UpdateCommandResult(result, err.Error(), false)
+			c.mutex.Unlock()
+			return
+		}
+		c.status = s
+		c.mutex.Unlock()
+		current = s
+	}
+	s := current
+	command.Change.(func(s *status))(&s)
+	applied, err := c.request(ctx, frameTypeSet, setStatus(s))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		log.Printf("Command %s %s for %s failed: %s", result.Command, result.Value, c.name, err)
+		if ctx.Err() == nil {
+			c.poller.Failed(err)
+		}
+		c.notifier.UpdateCommandResult(result, err.Error(), false)
+		return
+	}
+	// Some units leave the sensor readings out of the set response.
+	if applied.indoor == nil {
+		applied.indoor = current.indoor
+	}
+	if applied.outdoor == nil {
+		applied.outdoor = current.outdoor
+	}
+	c.status = applied
+	c.notifier.UpdateCommandResult(result, "OK", true)
+	c.notifier.UpdateState(c.snapshot())
+}
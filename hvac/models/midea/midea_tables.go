@@ -0,0 +1,42 @@
+package midea
+
+import (
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+)
+
+var modeTable = base.CodeTranslations{
+	{MQTT: "auto", Code: 1},
+	{MQTT: "cool", Code: 2},
+	{MQTT: "dry", Code: 3},
+	{MQTT: "heat", Code: 4},
+	{MQTT: "fan_only", Code: 5},
+}
+
+// fanModeTable maps fan modes to speeds in percent, auto being 102.
+var fanModeTable = base.CodeTranslations{
+	{MQTT: "auto", Code: 102},
+	{MQTT: "silent", Code: 20},
+	{MQTT: "low", Code: 40},
+	{MQTT: "medium", Code: 60},
+	{MQTT: "high", Code: 80},
+	{MQTT: "full", Code: 100},
+}
+
+var swingModeTable = base.CodeTranslations{
+	{MQTT: "off", Code: 0x0},
+	{MQTT: "vertical", Code: 0xc},
+	{MQTT: "horizontal", Code: 0x3},
+	{MQTT: "both", Code: 0xf},
+}
+
+func presetMode(s status) string {
+	switch {
+	case s.turbo:
+		return "boost"
+	case s.eco:
+		return "eco"
+	case s.sleep:
+		return "sleep"
+	}
+	return "none"
+}
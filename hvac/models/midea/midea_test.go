@@ -0,0 +1,149 @@
+package midea
+
+import (
+	"encoding/binary"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base/basetest"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testDeviceID = 0x1234567890
+
+// fakeUnit emulates a version 2 unit on a TCP listener.
+type fakeUnit struct {
+	listener net.Listener
+
+	mutex sync.Mutex
+	// silent units read requests without answering.
+	silent   bool
+	power    bool
+	mode     byte
+	setpoint byte
+}
+
+func newFakeUnit(t *testing.T) *fakeUnit {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &fakeUnit{listener: listener, power: true, mode: 2, setpoint: 24}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(conn)
+		}
+	}()
+	return u
+}
+
+func (u *fakeUnit) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 6)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		packet := make([]byte, binary.LittleEndian.Uint16(header[4:6]))
+		copy(packet, header)
+		if _, err := io.ReadFull(conn, packet[6:]); err != nil {
+			return
+		}
+		frame, err := packetFrame(packet)
+		if err != nil {
+			return
+		}
+		body, err := frameBody(frame)
+		if err != nil {
+			return
+		}
+		u.mutex.Lock()
+		silent := u.silent
+		if body[0] == 0x40 {
+			u.power = body[1]&0x01 != 0
+			u.mode = body[2] >> 5 & 0x07
+			u.setpoint = body[2]&0x0f + 16
+		}
+		response := make([]byte, 16)
+		response[0] = statusResponse
+		if u.power {
+			response[1] = 0x01
+		}
+		response[2] = u.mode<<5 | (u.setpoint-16)&0x0f
+		response[11] = 50 + 2*22
+		u.mutex.Unlock()
+		if silent {
+			continue
+		}
+		messageID := binary.LittleEndian.Uint32(packet[8:12])
+		conn.Write(newPacket(testDeviceID, messageID, newFrame(frame[9], response, byte(messageID)), time.Now()))
+	}
+}
+
+func newTestMidea(t *testing.T, unit *fakeUnit, options base.ConnectionOptions) (*Midea, *basetest.Recorder) {
+	host, port := basetest.HostPort(t, unit.listener.Addr())
+	c := NewMidea("test", host, port, testDeviceID, nil, nil, time.Hour, options)
+	return c, basetest.NewRecorder(c)
+}
+
+func TestMideaCommands(t *testing.T) {
+	unit := newFakeUnit(t)
+	defer unit.listener.Close()
+	c, notifier := newTestMidea(t, unit, base.ConnectionOptions{})
+	c.Connect()
+	defer c.Close()
+	state, _ := notifier.WaitFor(t, 1, 0)
+	if !state.Power || state.Mode != base.ModeCool || state.Setpoint == nil || *state.Setpoint != 24 ||
+		state.CurrentTemperature == nil || *state.CurrentTemperature != 22 {
+		t.Errorf("got state %+v", state)
+	}
+
+	c.SetMode(base.ModeHeat)
+	c.SetTemperature(21)
+	state, result := notifier.WaitFor(t, 3, 2)
+	if !result.Success || result.Command != "temperature" {
+		t.Errorf("got result %+v", result)
+	}
+	if state.Mode != base.ModeHeat || state.Setpoint == nil || *state.Setpoint != 21 ||
+		state.CurrentTemperature == nil || *state.CurrentTemperature != 22 {
+		t.Errorf("got state %+v", state)
+	}
+}
+
+func TestMideaCloseWhileWaiting(t *testing.T) {
+	unit := newFakeUnit(t)
+	defer unit.listener.Close()
+	unit.silent = true
+	c, notifier := newTestMidea(t, unit, base.ConnectionOptions{ResponseTimeout: time.Minute})
+	c.Connect()
+	sent := make(chan struct{})
+	go func() {
+		c.SetPower(false)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("command blocked on the unit")
+	}
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited for the unit to answer")
+	}
+	_, result := notifier.WaitFor(t, 0, 1)
+	if result.Success {
+		t.Errorf("got result %+v", result)
+	}
+}
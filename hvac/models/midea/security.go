@@ -0,0 +1,171 @@
+package midea
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+)
+
+// signKey is shared by all units. Its MD5 hash is the AES key of the frames
+// carried in 5A5A packets, and it salts the packets' checksum.
+const signKey = "xhdiwjnchekd4d512chdjx5d8e4c394D2D7S"
+
+var frameKey = md5.Sum([]byte(signKey))
+
+// encryptFrame encrypts a frame with AES-128 ECB and PKCS#7 padding.
+func encryptFrame(plain []byte) []byte {
+	block, _ := aes.NewCipher(frameKey[:])
+	return base.EncryptECB(block, plain)
+}
+
+func decryptFrame(data []byte) ([]byte, error) {
+	block, _ := aes.NewCipher(frameKey[:])
+	return base.DecryptECB(block, data)
+}
+
+// packetSum is the checksum closing 5A5A packets.
+func packetSum(data []byte) []byte {
+	sum := md5.Sum(append(append([]byte(nil), data...), signKey...))
+	return sum[:]
+}
+
+// 8370 message types.
+const (
+	msgHandshakeRequest   = 0x0
+	msgHandshakeResponse  = 0x1
+	msgEncryptedResponse  = 0x3
+	msgEncryptedRequest   = 0x6
+	headerSize8370        = 6
+	handshakeResponseSize = 64
+)
+
+// session holds the state of an authenticated v3 connection.
+type session struct {
+	// tcpKey is agreed in the handshake and encrypts the 8370 messages.
+	tcpKey   []byte
+	sequence uint16
+}
+
+// handshakeKey derives the session key from the handshake response, which is
+// the key encrypted with the device key followed by its SHA-256 hash.
+func handshakeKey(response, key []byte) ([]byte, error) {
+	if bytes.Equal(response, []byte("ERROR")) {
+		return nil, errors.New("authentication refused, check token and key")
+	}
+	if len(response) != handshakeResponseSize {
+		return nil, fmt.Errorf("Invalid handshake response length %d", len(response))
+	}
+	plain, err := cbcDecrypt(response[:32], key)
+	if err != nil {
+		return nil, err
+	}
+	sign := sha256.Sum256(plain)
+	if !bytes.Equal(sign[:], response[32:]) {
+		return nil, errors.New("handshake response signature mismatch")
+	}
+	tcpKey := make([]byte, len(plain))
+	for i := range plain {
+		tcpKey[i] = plain[i] ^ key[i]
+	}
+	return tcpKey, nil
+}
+
+// encode8370 wraps data into an 8370 message. Requests other than the
+// handshake are padded, signed and encrypted with the session key.
+func (s *session) encode8370(data []byte, msgType byte) ([]byte, error) {
+	size := len(data)
+	padding := 0
+	encrypted := msgType == msgEncryptedRequest || msgType == msgEncryptedResponse
+	if encrypted {
+		if (size+2)%16 != 0 {
+			padding = 16 - (size+2)%16
+			random := make([]byte, padding)
+			rand.Read(random)
+			data = append(append([]byte(nil), data...), random...)
+		}
+		size += padding + sha256.Size
+	}
+	header := []byte{0x83, 0x70, 0, 0, 0x20, byte(padding<<4) | msgType}
+	binary.BigEndian.PutUint16(header[2:4], uint16(size))
+	body := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(body, s.sequence)
+	s.sequence++
+	body = append(body, data...)
+	if !encrypted {
+		return append(header, body...), nil
+	}
+	sign := sha256.Sum256(append(append([]byte(nil), header...), body...))
+	ciphertext, err := cbcEncrypt(body, s.tcpKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(header, ciphertext...), sign[:]...), nil
+}
+
+// decode8370 unwraps a complete 8370 message, returning its type and data.
+func (s *session) decode8370(message []byte) (byte, []byte, error) {
+	if len(message) < headerSize8370+2 || message[0] != 0x83 || message[1] != 0x70 {
+		return 0, nil, errors.New("not an 8370 message")
+	}
+	header := message[:headerSize8370]
+	if header[4] != 0x20 {
+		return 0, nil, fmt.Errorf("Unexpected 8370 header byte %#x", header[4])
+	}
+	padding := int(header[5] >> 4)
+	msgType := header[5] & 0xf
+	data := message[headerSize8370:]
+	if msgType == msgEncryptedRequest || msgType == msgEncryptedResponse {
+		if len(data) < sha256.Size {
+			return 0, nil, errors.New("truncated 8370 message")
+		}
+		sign := data[len(data)-sha256.Size:]
+		plain, err := cbcDecrypt(data[:len(data)-sha256.Size], s.tcpKey)
+		if err != nil {
+			return 0, nil, err
+		}
+		expected := sha256.Sum256(append(append([]byte(nil), header...), plain...))
+		if !bytes.Equal(expected[:], sign) {
+			return 0, nil, errors.New("8370 message signature mismatch")
+		}
+		if padding > len(plain)-2 {
+			return 0, nil, errors.New("invalid 8370 padding")
+		}
+		data = plain[:len(plain)-padding]
+	}
+	// Skip the sequence number.
+	return msgType, data[2:], nil
+}
+
+// cbcEncrypt encrypts whole blocks with AES-256 CBC and a zero IV.
+func cbcEncrypt(data, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("data is not a multiple of the block size")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, make([]byte, block.BlockSize())).CryptBlocks(out, data)
+	return out, nil
+}
+
+func cbcDecrypt(data, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("data is not a multiple of the block size")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, make([]byte, block.BlockSize())).CryptBlocks(out, data)
+	return out, nil
+}
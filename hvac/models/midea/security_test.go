@@ -0,0 +1,109 @@
+package midea
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{0x5c}, 32)
+
+func TestEncode8370RoundTrip(t *testing.T) {
+	sender := &session{tcpKey: testKey}
+	receiver := &session{tcpKey: testKey}
+	for _, size := range []int{0, 13, 14, 30, 100} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		message, err := sender.encode8370(data, msgEncryptedRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message[0] != 0x83 || message[1] != 0x70 || int(message[2])<<8|int(message[3])+8 != len(message) {
+			t.Fatalf("%d bytes: got header % x for %d bytes", size, message[:headerSize8370], len(message))
+		}
+		msgType, got, err := receiver.decode8370(message)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		if msgType != msgEncryptedRequest || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: got type %d, data % x", size, msgType, got)
+		}
+	}
+	if sender.sequence != 5 {
+		t.Errorf("got sequence %d, want 5", sender.sequence)
+	}
+}
+
+func TestEncode8370Handshake(t *testing.T) {
+	token := bytes.Repeat([]byte{0xab}, tokenSize)
+	message, err := (&session{}).encode8370(token, msgHandshakeRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handshake is sent in the clear, after the sequence number.
+	if len(message) != headerSize8370+2+tokenSize || !bytes.Equal(message[headerSize8370+2:], token) {
+		t.Errorf("got message % x", message)
+	}
+	msgType, data, err := (&session{}).decode8370(message)
+	if err != nil || msgType != msgHandshakeRequest || !bytes.Equal(data, token) {
+		t.Errorf("got type %d, data % x, error %v", msgType, data, err)
+	}
+}
+
+func TestDecode8370Tampered(t *testing.T) {
+	s := &session{tcpKey: testKey}
+	message, err := s.encode8370([]byte("status request"), msgEncryptedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), message...)
+	tampered[headerSize8370] ^= 0x01
+	if _, _, err := s.decode8370(tampered); err == nil {
+		t.Error("decoded a tampered message")
+	}
+	other := &session{tcpKey: bytes.Repeat([]byte{0x11}, 32)}
+	if _, _, err := other.decode8370(message); err == nil {
+		t.Error("decoded a message with the wrong key")
+	}
+	if _, _, err := s.decode8370(message[:4]); err == nil {
+		t.Error("decoded a truncated message")
+	}
+}
+
+func TestHandshakeKey(t *testing.T) {
+	tcpKey := bytes.Repeat([]byte{0x3c}, 32)
+	plain := make([]byte, 32)
+	for i := range plain {
+		plain[i] = tcpKey[i] ^ testKey[i]
+	}
+	encrypted, err := cbcEncrypt(plain, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := sha256.Sum256(plain)
+	got, err := handshakeKey(append(encrypted, sign[:]...), testKey)
+	if err != nil || !bytes.Equal(got, tcpKey) {
+		t.Errorf("got key % x, error %v", got, err)
+	}
+
+	sign[0] ^= 0x01
+	if _, err := handshakeKey(append(encrypted, sign[:]...), testKey); err == nil {
+		t.Error("accepted a wrong signature")
+	}
+	if _, err := handshakeKey([]byte("ERROR"), testKey); err == nil {
+		t.Error("accepted a refusal")
+	}
+}
+
+func TestFrameEncryption(t *testing.T) {
+	for _, size := range []int{1, 15, 16, 17} {
+		plain := bytes.Repeat([]byte{0xaa}, size)
+		encrypted := encryptFrame(plain)
+		if len(encrypted)%16 != 0 || len(encrypted) <= size {
+			t.Errorf("%d bytes encrypted to %d", size, len(encrypted))
+		}
+		got, err := decryptFrame(encrypted)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: got % x, error %v", size, got, err)
+		}
+	}
+}
@@ -3,15 +3,73 @@ package models
 import (
 	"fmt"
 	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
-	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models/samsung"
+	"sort"
+	"strings"
+	"sync"
 )
 
-func NewController(
-	model string, name string,
-	host, port, duid, authToken string) (base.Controller, error) {
-	switch model {
-	case "samsungac2878":
-		return samsung.NewSamsungAC2878(name, host, port, duid, authToken), nil
+// Params are the settings common to all devices, passed to the driver
+// creating the controller.
+type Params struct {
+	Name              string
+	Host              string
+	Port              string
+	DUID              string
+	ConnectionOptions base.ConnectionOptions
+	// Decode decodes the device's configuration into the driver's own
+	// configuration type.
+	Decode func(config interface{}) error
+}
+
+// Factory creates a controller for a configured device.
+type Factory func(params Params) (base.Controller, error)
+
+var (
+	mutex     sync.Mutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a driver available under the model name. Drivers register
+// themselves from an init function.
+func Register(model string, factory Factory) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := factories[model]; ok {
+		panic("models: model registered twice: " + model)
+	}
+	factories[model] = factory
+}
+
+// Models returns the names of the registered models, sorted.
+func Models() []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var models []string
+	for model := range factories {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
+
+// Check returns an error listing the supported models if the model is not
+// registered.
+func Check(model string) error {
+	mutex.Lock()
+	_, ok := factories[model]
+	mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("Model not supported: %q, supported models: %s", model, strings.Join(Models(), ", "))
+	}
+	return nil
+}
+
+func NewController(model string, params Params) (base.Controller, error) {
+	if err := Check(model); err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("Model not supported: %s", model)
+	mutex.Lock()
+	factory := factories[model]
+	mutex.Unlock()
+	return factory(params)
 }
@@ -0,0 +1,109 @@
+package samsung
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// DiscoveredDevice is a Samsung unit that answered the discovery request.
+type DiscoveredDevice struct {
+	Host     string `json:"host"`
+	DUID     string `json:"duid"`
+	Model    string `json:"model"`
+	Nickname string `json:"nickname,omitempty"`
+}
+
+// discoveryRequest asks the units on the network to announce themselves.
+const discoveryRequest = "NOTIFY * HTTP/1.1\r\n" +
+	"HOST: 239.255.255.250:1900\r\n" +
+	"CACHE-CONTROL: max-age=20\r\n" +
+	"SERVER: AIR CONDITIONER\r\n" +
+	"\r\n" +
+	"SPEC_VER: MSpec-1.00\r\n" +
+	"SERVICE_NAME: ControlServer-MLib\r\n" +
+	"MESSAGE_TYPE: CONTROLLER_START\r\n" +
+	"\r\n"
+
+var discoveryAddresses = []string{
+	"255.255.255.255:1900",
+	"239.255.255.250:1900",
+}
+
+// Discover broadcasts a discovery request on the local network and collects
+// the units answering until the context is done.
+func Discover(ctx context.Context) ([]DiscoveredDevice, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	for _, address := range discoveryAddresses {
+		addr, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.WriteTo([]byte(discoveryRequest), addr); err != nil {
+			return nil, err
+		}
+	}
+
+	var devices []DiscoveredDevice
+	seen := make(map[string]bool)
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return devices, nil
+			}
+			return devices, err
+		}
+		device, ok := parseDiscoveryResponse(string(buf[:n]))
+		if !ok {
+			continue
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			device.Host = udpAddr.IP.String()
+		}
+		if seen[device.DUID] {
+			continue
+		}
+		seen[device.DUID] = true
+		devices = append(devices, device)
+	}
+}
+
+// NormalizeDUID returns the DUID of a unit given as its MAC address, such
+// as "f8:04:2e:aa:bb:cc", in the form units report it.
+func NormalizeDUID(duid string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(strings.TrimSpace(duid)))
+}
+
+// parseDiscoveryResponse extracts the unit description from the headers of
+// a discovery response.
+func parseDiscoveryResponse(response string) (DiscoveredDevice, bool) {
+	var device DiscoveredDevice
+	for _, line := range strings.Split(response, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.ToUpper(strings.TrimSpace(parts[0])) {
+		case "MAC_ADDR":
+			device.DUID = NormalizeDUID(value)
+		case "MODELCODE":
+			device.Model = value
+		case "NICKNAME":
+			device.Nickname = value
+		}
+	}
+	return device, device.DUID != ""
+}
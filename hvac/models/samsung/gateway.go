@@ -0,0 +1,212 @@
+package samsung
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"log"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// gateway is a connection to a host:port shared by all the units answering
+// on it, such as the indoor units of a multi-split system. It authenticates
+// once per connection and routes messages to the units by DUID.
+type gateway struct {
+	host      string
+	port      string
+	authToken string
+	// options are the connection options of the first unit. Other units at
+	// the same address must use the same ones.
+	options    base.ConnectionOptions
+	connection base.Connection
+	// units are the connected units, by DUID.
+	units *base.SharedConnection
+	// pending are the DeviceControl requests awaiting a response, which
+	// names their DUID or else answers the oldest.
+	pending base.PendingCommands
+}
+
+var gateways base.Gateways
+
+func newGateway(host, port, authToken string, options base.ConnectionOptions, connection base.Connection) *gateway {
+	g := &gateway{
+		host:       host,
+		port:       port,
+		authToken:  authToken,
+		options:    options,
+		connection: connection,
+	}
+	g.units = base.NewSharedConnection(
+		func() { g.connection.Connect(g.host, g.port, g) },
+		func() { g.connection.Close() },
+		func() { gateways.Remove(g.address(), g) })
+	return g
+}
+
+func (g *gateway) address() string {
+	return g.host + ":" + g.port
+}
+
+// getGateway returns the gateway for the given host and port, creating it
+// with the given token and options if this is its first unit. Units sharing
+// a gateway must agree on its token and connection options.
+func getGateway(host, port, authToken string, options base.ConnectionOptions) (*gateway, error) {
+	key := host + ":" + port
+	g, err := gateways.Get(key, func(existing interface{}) (interface{}, error) {
+		if existing != nil {
+			g := existing.(*gateway)
+			if authToken != "" && g.authToken != "" && authToken != g.authToken {
+				return nil, fmt.Errorf("Conflicting auth_token for units at %s", key)
+			}
+			if !reflect.DeepEqual(options, g.options) {
+				return nil, fmt.Errorf("Conflicting connection options for units at %s", key)
+			}
+			if g.authToken == "" {
+				g.authToken = authToken
+			}
+			return g, nil
+		}
+		connection, err := base.NewTLSSocketConnection(
+			withDefaultTLSOptions(options), base.NewXMLFramer)
+		if err != nil {
+			return nil, err
+		}
+		return newGateway(host, port, authToken, options, connection), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g.(*gateway), nil
+}
+
+// unitFor returns the unit with the given DUID. Messages without a known
+// DUID go to the only unit, if there is just one, as units configured
+// without a duid rely on that.
+func (g *gateway) unitFor(duid string) *SamsungAC2878 {
+	if unit := g.units.Unit(duid); unit != nil {
+		return unit.(*SamsungAC2878)
+	}
+	if units := g.units.Units(); len(units) == 1 {
+		return units[0].(*SamsungAC2878)
+	}
+	log.Printf("No unit with DUID %q at %s:%s", duid, g.host, g.port)
+	return nil
+}
+
+func (g *gateway) allUnits() []*SamsungAC2878 {
+	var units []*SamsungAC2878
+	for _, unit := range g.units.Units() {
+		units = append(units, unit.(*SamsungAC2878))
+	}
+	return units
+}
+
+// sendCommands sends the DeviceControl requests of an MQTT command of the
+// unit. The outcome is reported when the last one is answered.
+func (g *gateway) sendCommands(unit *SamsungAC2878, result base.CommandResult, messages ...string) error {
+	return g.pending.SendCommand(unit, result, messages, func(message string) error {
+		log.Printf("sending request to %s [%s]\n", unit.name, message)
+		return g.connection.SendMessage([]byte(message))
+	})
+}
+
+// commandAnswered returns the request a DeviceControl response is for: the
+// oldest of the unit with the given DUID or, without one, the oldest of all.
+func (g *gateway) commandAnswered(duid string) *base.PendingCommand {
+	if duid == "" {
+		return g.pending.Answered(nil)
+	}
+	if unit := g.unitFor(duid); unit != nil {
+		return g.pending.Answered(unit)
+	}
+	return nil
+}
+
+func (g *gateway) OnConnectionEstablished() {
+	log.Printf("Established connection to %s:%s", g.host, g.port)
+	g.connection.ExpectRead()
+}
+
+func (g *gateway) OnConnectionLost() {
+	log.Printf("Lost connection to %s:%s", g.host, g.port)
+	pending := g.pending.Clear()
+	for _, unit := range g.allUnits() {
+		unit.connectionLost()
+	}
+	for _, command := range pending {
+		if command.Last {
+			command.Unit.(*SamsungAC2878).handleOutcome(command.Outcome, "ConnectionLost")
+		}
+	}
+}
+
+func (g *gateway) HandleMessage(message []byte) {
+	log.Printf("Received message from %s:%s: %s", g.host, g.port, string(message))
+
+	if strings.TrimSpace(string(message)) == "DPLUG-1.6" {
+		log.Printf("Connection hello received from %s:%s", g.host, g.port)
+		g.connection.ExpectRead()
+		return
+	}
+	var update Update
+	if err := xml.Unmarshal(message, &update); err == nil {
+		g.handleUpdate(&update)
+		return
+	}
+	var response Response
+	if err := xml.Unmarshal(message, &response); err == nil {
+		g.handleResponse(&response)
+		return
+	}
+}
+
+func (g *gateway) handleUpdate(update *Update) {
+	switch update.Type {
+	case "InvalidateAccount":
+		g.sendMessage(authenticateTemplate, map[string]string{
+			"token": g.authToken,
+		})
+	case "Status":
+		if unit := g.unitFor(update.Status.DUID); unit != nil {
+			unit.handleUpdateStatus(&update.Status)
+		}
+	default:
+		log.Printf("Error: %s:%s unknown update type %s", g.host, g.port, update.Type)
+	}
+}
+
+func (g *gateway) handleResponse(response *Response) {
+	switch response.Type {
+	case "AuthToken":
+		for _, unit := range g.allUnits() {
+			unit.handleAuthToken(response.Status)
+		}
+	case "DeviceState":
+		if unit := g.unitFor(response.DeviceState.Device.DUID); unit != nil {
+			unit.handleDeviceState(&response.DeviceState)
+		}
+	case "DeviceControl":
+		if command := g.commandAnswered(response.DUID); command != nil {
+			command.Unit.(*SamsungAC2878).handleDeviceControl(command, response.Status)
+		} else {
+			log.Printf("Unexpected DeviceControl response from %s:%s: %s", g.host, g.port, response.Status)
+		}
+	default:
+		log.Printf("Error: %s:%s got unknown response %s", g.host, g.port, response.Type)
+	}
+}
+
+func (g *gateway) sendMessage(messageTemplate *template.Template, data map[string]string) error {
+	message := renderMessage(messageTemplate, data)
+	log.Printf("sending request to %s:%s [%s]\n", g.host, g.port, string(message))
+	return g.connection.SendMessage(message)
+}
+
+func renderMessage(messageTemplate *template.Template, data map[string]string) []byte {
+	var buf bytes.Buffer
+	messageTemplate.Execute(&buf, data)
+	return buf.Bytes()
+}
@@ -1,58 +1,103 @@
 package samsung
 
 import (
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"sort"
 	"strings"
 )
 
-type translationEntry struct {
-	mqtt string
-	ac   string
-}
-
-func toAc(value string, table []translationEntry) string {
-	for _, e := range table {
-		if strings.ToLower(value) == strings.ToLower(e.mqtt) {
-			return e.ac
-		}
+// toAc passes values missing from the table through unchanged.
+func toAc(value string, table base.Translations) string {
+	if ac := table.ToDevice(value); ac != "" {
+		return ac
 	}
 	return value
 }
 
-func fromAc(value string, table []translationEntry) string {
-	for _, e := range table {
-		if strings.ToLower(value) == strings.ToLower(e.ac) {
-			return e.mqtt
-		}
+func fromAc(value string, table base.Translations) string {
+	if mqtt := table.FromDevice(value); mqtt != "" {
+		return mqtt
 	}
 	return strings.ToLower(value)
 }
 
-var powerModeTable = []translationEntry{
-	{"ON", "On"},
-	{"off", "Off"},
+var powerModeTable = base.Translations{
+	{MQTT: "ON", Device: "On"},
+	{MQTT: "off", Device: "Off"},
 }
 
 func PowerModeToAC(mode string) string   { return toAc(mode, powerModeTable) }
 func PowerModeFromAC(mode string) string { return fromAc(mode, powerModeTable) }
 
-var opModeTable = []translationEntry{
-	{"cool", "Cool"},
-	{"heat", "Heat"},
-	{"dry", "Dry"},
-	{"auto", "Auto"},
-	{"fan_only", "Wind"},
-	{"off", "Off"},
+// PowerModeFromBool returns the MQTT power value for a power state.
+func PowerModeFromBool(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
+
+var opModeTable = base.Translations{
+	{MQTT: "cool", Device: "Cool"},
+	{MQTT: "heat", Device: "Heat"},
+	{MQTT: "dry", Device: "Dry"},
+	{MQTT: "auto", Device: "Auto"},
+	{MQTT: "fan_only", Device: "Wind"},
+	{MQTT: "off", Device: "Off"},
 }
 
 func OpModeToAC(mode string) string   { return toAc(mode, opModeTable) }
 func OpModeFromAC(mode string) string { return fromAc(mode, opModeTable) }
 
-var fanModeTable = []translationEntry{
-	{"auto", "Auto"},
-	{"low", "Low"},
-	{"medium", "Mid"},
-	{"high", "Turbo"},
+var fanModeTable = base.Translations{
+	{MQTT: "auto", Device: "Auto"},
+	{MQTT: "low", Device: "Low"},
+	{MQTT: "medium", Device: "Mid"},
+	{MQTT: "high", Device: "Turbo"},
 }
 
 func FanModeToAC(mode string) string   { return toAc(mode, fanModeTable) }
 func FanModeFromAC(mode string) string { return fromAc(mode, fanModeTable) }
+
+var swingModeTable = base.Translations{
+	{MQTT: "off", Device: "Fixed"},
+	{MQTT: "vertical", Device: "SwingUD"},
+	{MQTT: "horizontal", Device: "SwingLR"},
+	{MQTT: "both", Device: "Rotation"},
+}
+
+func SwingModeToAC(mode string) string   { return toAc(mode, swingModeTable) }
+func SwingModeFromAC(mode string) string { return fromAc(mode, swingModeTable) }
+
+// defaultPresetModeTable maps Home Assistant preset modes to AC_FUN_COMODE
+// values. It can be replaced per device in the configuration.
+var defaultPresetModeTable = base.Translations{
+	{MQTT: "none", Device: "Off"},
+	{MQTT: "quiet", Device: "Quiet"},
+	{MQTT: "sleep", Device: "Sleep"},
+	{MQTT: "smart", Device: "Smart"},
+	{MQTT: "softcool", Device: "SoftCool"},
+	{MQTT: "boost", Device: "TurboMode"},
+	{MQTT: "windfree", Device: "WindMode1"},
+}
+
+// newPresetModeTable builds a preset translation table from the configured
+// preset to device value mapping, falling back to the default table.
+func newPresetModeTable(presets map[string]string) base.Translations {
+	if len(presets) == 0 {
+		return defaultPresetModeTable
+	}
+	var table base.Translations
+	if _, ok := presets["none"]; !ok {
+		table = append(table, base.Translation{MQTT: "none", Device: "Off"})
+	}
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		table = append(table, base.Translation{MQTT: name, Device: presets[name]})
+	}
+	return table
+}
@@ -1,64 +1,177 @@
 package samsung
 
 import (
-	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/models"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
 
+// maxMissedPolls is the number of unanswered state polls after which the
+// device is reported offline.
+const maxMissedPolls = 2
+
+func init() {
+	models.Register("samsungac2878", newFromConfig)
+}
+
+// Config is the samsungac2878 specific part of the device configuration.
+type Config struct {
+	AuthToken string `yaml:"auth_token"`
+	// Presets maps Home Assistant preset modes to AC_FUN_COMODE values.
+	Presets map[string]string `yaml:"presets"`
+	// ActionDeadband is the temperature difference from the setpoint within
+	// which the unit is reported idle. Defaults to 0.5 degrees.
+	ActionDeadband *float64 `yaml:"action_deadband"`
+	// CompressorAttribute names a device attribute reporting whether the
+	// compressor is running.
+	CompressorAttribute string `yaml:"compressor_attribute"`
+}
+
+func newFromConfig(params models.Params) (base.Controller, error) {
+	var config Config
+	if err := params.Decode(&config); err != nil {
+		return nil, err
+	}
+	actionDeadband := 0.5
+	if config.ActionDeadband != nil {
+		actionDeadband = *config.ActionDeadband
+		if actionDeadband < 0 {
+			return nil, fmt.Errorf("action_deadband must not be negative")
+		}
+	}
+	return NewSamsungAC2878(params.Name, params.Host, params.Port, params.DUID,
+		config.AuthToken, config.Presets, actionDeadband,
+		config.CompressorAttribute, params.ConnectionOptions)
+}
+
 type SamsungAC2878 struct {
-	name      string
-	host      string
-	port      string
-	authToken string
-	duid      string
+	name string
+	duid string
+	// presetModeTable translates preset modes to AC_FUN_COMODE values.
+	presetModeTable base.Translations
+	// actionDeadband is how far in degrees the current temperature may be
+	// from the setpoint for the unit to be considered idle.
+	actionDeadband float64
+	// compressorAttr optionally names an attribute reporting whether the
+	// compressor or outdoor unit is running.
+	compressorAttr string
+
+	// gateway is the connection shared with other units at the same address.
+	gateway *gateway
 
-	connection    base.Connection
-	stateNotifier base.StateNotifier
+	// mutex guards the fields below. It is held while handling an event and
+	// notifying its outcome, so notifications are delivered in order.
+	mutex    sync.Mutex
+	notifier base.Notifier
+	// cancel stops the state polling started by Connect.
+	cancel context.CancelFunc
 
-	online             bool
-	err                string
+	authenticated      bool
+	missedPolls        int
 	powerMode          string
 	opMode             string
 	fanMode            string
+	swingMode          string
+	presetMode         string
 	temperature        string
 	currentTemperature string
 	attrs              map[string]string
 }
 
-func NewSamsungAC2878(name string, host, port, duid, authToken string) *SamsungAC2878 {
+func NewSamsungAC2878(name string, host, port, duid, authToken string,
+	presets map[string]string, actionDeadband float64, compressorAttr string,
+	connectionOptions base.ConnectionOptions) (*SamsungAC2878, error) {
 	if port == "" {
 		port = "2878"
 	}
+	gateway, err := getGateway(host, port, authToken, connectionOptions)
+	if err != nil {
+		return nil, err
+	}
 	return &SamsungAC2878{
-		name:       name,
-		host:       host,
-		port:       port,
-		authToken:  authToken,
-		duid:       duid,
-		connection: base.NewTLSSocketConnection(),
-		attrs:      make(map[string]string),
+		name:            name,
+		duid:            NormalizeDUID(duid),
+		presetModeTable: newPresetModeTable(presets),
+		actionDeadband:  actionDeadband,
+		compressorAttr:  compressorAttr,
+		gateway:         gateway,
+		attrs:           make(map[string]string),
+	}, nil
+}
+
+// withDefaultTLSOptions fills in the TLS settings spoken by most 2878
+// firmware versions where not configured.
+func withDefaultTLSOptions(options base.ConnectionOptions) base.ConnectionOptions {
+	if len(options.TLS.CipherSuites) == 0 {
+		options.TLS.CipherSuites = []string{
+			"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+			"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+		}
+	}
+	if options.TLS.MinVersion == "" {
+		options.TLS.MinVersion = "1.0"
 	}
+	if options.TLS.MaxVersion == "" {
+		options.TLS.MaxVersion = "1.0"
+	}
+	return options
 }
 
 func (c *SamsungAC2878) SetStateNotifier(stateNotifier base.StateNotifier) {
-	c.stateNotifier = stateNotifier
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notifier.SetStateNotifier(stateNotifier)
+}
+
+func (c *SamsungAC2878) ConnectionState() base.ConnectionState {
+	return c.gateway.connection.State()
 }
 
 func (c *SamsungAC2878) Connect() {
-	c.connection.Connect(c.host, c.port, c)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mutex.Lock()
+	c.notifier.SetOnline(false)
+	c.cancel = cancel
+	c.mutex.Unlock()
+	c.gateway.units.AddUnit(c.duid, c)
 	go func() {
-		for range time.Tick(time.Second * 60) {
-			c.sendDeviceStateRequest()
+		ticker := time.NewTicker(time.Second * 60)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.pollDeviceState()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 }
 
+func (c *SamsungAC2878) Close() {
+	log.Printf("Closing %s", c.name)
+	c.mutex.Lock()
+	cancel := c.cancel
+	c.mutex.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	// Not holding the mutex, as the message loop may be delivering to this
+	// unit while the connection closes.
+	c.gateway.units.RemoveUnit(c.duid, c)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notifier.SetOnline(false)
+}
+
 var (
 	authenticateTemplate = template.Must(template.New("authenticate").Parse(
 		`<Request Type="AuthToken"><User Token="{{.token}}" /></Request>
@@ -74,43 +187,89 @@ var (
 `))
 	setFanModeTemplate = template.Must(template.New("setFanMode").Parse(
 		`<Request Type="DeviceControl"><Control CommandID="AC_FUN_WINDLEVEL" DUID="{{.duid}}"><Attr ID="AC_FUN_WINDLEVEL" Value="{{.value}}" /></Control></Request>
+`))
+	setSwingModeTemplate = template.Must(template.New("setSwingMode").Parse(
+		`<Request Type="DeviceControl"><Control CommandID="AC_FUN_DIRECTION" DUID="{{.duid}}"><Attr ID="AC_FUN_DIRECTION" Value="{{.value}}" /></Control></Request>
+`))
+	setPresetModeTemplate = template.Must(template.New("setPresetMode").Parse(
+		`<Request Type="DeviceControl"><Control CommandID="AC_FUN_COMODE" DUID="{{.duid}}"><Attr ID="AC_FUN_COMODE" Value="{{.value}}" /></Control></Request>
 `))
 	setTemperatureTemplate = template.Must(template.New("setTemperature").Parse(
 		`<Request Type="DeviceControl"><Control CommandID="AC_FUN_TEMPSET" DUID="{{.duid}}"><Attr ID="AC_FUN_TEMPSET" Value="{{.value}}" /></Control></Request>
 `))
 )
 
-func (c *SamsungAC2878) SetPowerMode(powerMode string) {
-	c.sendMessage(setPowerModeTemplate, map[string]string{
-		"value": PowerModeToAC(powerMode),
+func (c *SamsungAC2878) SetPower(on bool) {
+	c.sendCommand("power", PowerModeFromBool(on), setPowerModeTemplate, map[string]string{
+		"value": PowerModeToAC(PowerModeFromBool(on)),
 		"duid":  c.duid,
 	})
 }
 
-func (c *SamsungAC2878) SetOpMode(mode string) {
-	if mode == "off" {
-		c.sendMessage(setPowerModeTemplate, map[string]string{
+func (c *SamsungAC2878) SetMode(mode base.Mode) {
+	if mode == base.ModeOff {
+		c.sendCommand("mode", string(mode), setPowerModeTemplate, map[string]string{
 			"value": "Off",
 			"duid":  c.duid,
 		})
 	} else {
-		c.sendMessage(setModeTemplate, map[string]string{
-			"value": OpModeToAC(mode),
-			"duid":  c.duid,
-		})
+		// Selecting a mode turns the unit on, as Home Assistant has no
+		// separate power control.
+		c.sendCommands("mode", string(mode),
+			string(renderMessage(setModeTemplate, map[string]string{
+				"value": OpModeToAC(string(mode)),
+				"duid":  c.duid,
+			})),
+			string(renderMessage(setPowerModeTemplate, map[string]string{
+				"value": PowerModeToAC(PowerModeFromBool(true)),
+				"duid":  c.duid,
+			})))
 	}
 }
 
 func (c *SamsungAC2878) SetFanMode(fanMode string) {
-	c.sendMessage(setFanModeTemplate, map[string]string{
+	c.sendCommand("fan_mode", fanMode, setFanModeTemplate, map[string]string{
 		"value": FanModeToAC(fanMode),
 		"duid":  c.duid,
 	})
 }
 
-func (c *SamsungAC2878) SetTemperature(temperature string) {
-	c.sendMessage(setTemperatureTemplate, map[string]string{
-		"value": temperature,
+func (c *SamsungAC2878) SetSwingMode(swingMode string) {
+	c.sendCommand("swing_mode", swingMode, setSwingModeTemplate, map[string]string{
+		"value": SwingModeToAC(swingMode),
+		"duid":  c.duid,
+	})
+}
+
+func (c *SamsungAC2878) SetPresetMode(presetMode string) {
+	c.sendCommand("preset_mode", presetMode, setPresetModeTemplate, map[string]string{
+		"value": toAc(presetMode, c.presetModeTable),
+		"duid":  c.duid,
+	})
+}
+
+func (c *SamsungAC2878) Capabilities() base.Capabilities {
+	capabilities := base.Capabilities{
+		Modes:              base.Modes,
+		FanModes:           fanModeTable.MQTTValues(),
+		SwingModes:         base.SwingModes,
+		MinTemperature:     16,
+		MaxTemperature:     30,
+		TemperatureStep:    1,
+		CurrentTemperature: true,
+	}
+	for _, presetMode := range c.presetModeTable.MQTTValues() {
+		if presetMode != "none" {
+			capabilities.PresetModes = append(capabilities.PresetModes, presetMode)
+		}
+	}
+	return capabilities
+}
+
+func (c *SamsungAC2878) SetTemperature(temperature float64) {
+	value := strconv.FormatFloat(temperature, 'f', -1, 64)
+	c.sendCommand("temperature", value, setTemperatureTemplate, map[string]string{
+		"value": value,
 		"duid":  c.duid,
 	})
 }
@@ -119,6 +278,7 @@ type Response struct {
 	XMLName     xml.Name `xml:"Response"`
 	Type        string   `xml:"Type,attr"`
 	Status      string   `xml:"Status,attr"`
+	DUID        string   `xml:"DUID,attr"`
 	DeviceState DeviceState
 	Inner       []byte `xml:",innerxml"`
 }
@@ -136,9 +296,9 @@ type Attr struct {
 }
 type Status struct {
 	XMLName xml.Name `xml:"Status"`
-	DUID    string   `xml:"DUID"`
-	GroupID string   `xml:GroupID,attr"`
-	ModelID string   `xml:ModelID,attr"`
+	DUID    string   `xml:"DUID,attr"`
+	GroupID string   `xml:"GroupID,attr"`
+	ModelID string   `xml:"ModelID,attr"`
 	Attr    []Attr
 }
 type Device struct {
@@ -153,120 +313,212 @@ type DeviceState struct {
 	Device  Device
 }
 
-func (c *SamsungAC2878) OnConnectionEstablished() {
-	log.Printf("Established connection to %s", c.name)
-	c.connection.ExpectRead()
+// connectionLost fails the commands awaiting a response, which will not
+// arrive on a new connection.
+func (c *SamsungAC2878) connectionLost() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.authenticated = false
+	c.notifier.SetOnline(false)
 }
 
-func (c *SamsungAC2878) HandleMessage(message []byte) {
-	log.Printf("Received message from %s: %s", c.name, string(message))
-
-	if string(message) == "DPLUG-1.6\n" {
-		log.Printf("Connection hello received from %s", c.name)
-		c.connection.ExpectRead()
-	}
-	var update Update
-	if err := xml.Unmarshal(message, &update); err == nil {
-		c.handleUpdate(&update)
-		return
-	}
-	var response Response
-	if err := xml.Unmarshal(message, &response); err == nil {
-		c.handleResponse(&response)
-		return
-	}
-}
-
-func (c *SamsungAC2878) handleUpdate(update *Update) error {
-	switch update.Type {
-	case "InvalidateAccount":
-		c.handleInvalidateAccount()
-	case "Status":
-		c.handleUpdateStatus(&update.Status)
-	default:
-		log.Println("Error: %s unknown update type", c.name, update.Type)
-		return nil
-	}
-	return nil
+func (c *SamsungAC2878) sendDeviceStateRequest() {
+	c.sendMessage(deviceStateTemplate, map[string]string{
+		"duid": c.duid,
+	})
 }
 
-func (c *SamsungAC2878) handleResponse(response *Response) error {
-	switch response.Type {
-	case "AuthToken":
-		c.handleAuthToken(response.Status)
-	case "DeviceState":
-		c.handleDeviceState(&response.DeviceState)
-	case "DeviceControl":
-		c.handleDeviceControl(response.Status)
-	default:
-		fmt.Println("Error: %s got unknown response", c.name, response.Type)
+// pollDeviceState requests the device state, marking the device offline if
+// too many previous polls went unanswered.
+func (c *SamsungAC2878) pollDeviceState() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.missedPolls++
+	if c.missedPolls > maxMissedPolls {
+		log.Printf("No state received from %s in %d polls", c.name, c.missedPolls-1)
+		c.notifier.SetOnline(false)
 	}
-	return nil
-}
-
-func (c *SamsungAC2878) handleInvalidateAccount() {
-	c.sendMessage(authenticateTemplate, map[string]string{
-		"duid":  c.duid,
-		"token": c.authToken,
-	})
+	c.sendDeviceStateRequest()
 }
 
-func (c *SamsungAC2878) sendDeviceStateRequest() {
-	c.sendMessage(deviceStateTemplate, map[string]string{
-		"duid": c.duid,
-	})
+// stateReceived records that the device answered, bringing it back online
+// if it has authenticated.
+func (c *SamsungAC2878) stateReceived() {
+	c.missedPolls = 0
+	c.notifier.SetOnline(c.authenticated)
 }
 
 func (c *SamsungAC2878) handleAuthToken(status string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if status == "Okay" {
-		c.online = true
+		c.authenticated = true
 	} else {
-		c.online = false
+		log.Printf("Authentication with %s failed: %s", c.name, status)
+		c.authenticated = false
+		c.notifier.SetOnline(false)
 	}
 	c.sendDeviceStateRequest()
 }
 
-func (c *SamsungAC2878) handleDeviceControl(status string) {
-	if status == "Okay" {
-		c.err = ""
-	} else {
-		c.err = status
+// handleDeviceControl records the response to one of the unit's requests,
+// reporting the outcome of its command once the last one is answered.
+func (c *SamsungAC2878) handleDeviceControl(command *base.PendingCommand, status string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if status != "Okay" && command.Outcome.Err == "" {
+		command.Outcome.Err = status
+	}
+	if command.Last {
+		c.reportOutcome(command.Outcome, status)
 	}
 }
 
+// handleOutcome reports the outcome of a command whose last request is left
+// unanswered.
+func (c *SamsungAC2878) handleOutcome(outcome *base.CommandOutcome, status string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reportOutcome(outcome, status)
+}
+
+// reportOutcome reports a command failed with the first error answered, or
+// else with the given status.
+func (c *SamsungAC2878) reportOutcome(outcome *base.CommandOutcome, status string) {
+	if outcome.Err != "" {
+		c.notifier.UpdateCommandResult(outcome.Result, outcome.Err, false)
+		return
+	}
+	c.notifier.UpdateCommandResult(outcome.Result, status, status == "Okay")
+}
+
 func (c *SamsungAC2878) handleUpdateStatus(status *Status) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if status == nil {
-		fmt.Println("Error: No status")
+		log.Printf("Status update from %s without status", c.name)
 		return
 	}
+	c.handleDeviceIds(status.GroupID, status.ModelID)
 	c.handleAttributes(status.Attr)
-	c.notifyState()
+	c.stateReceived()
+	c.notifier.UpdateState(c.snapshot())
 }
 
 func (c *SamsungAC2878) handleDeviceState(deviceState *DeviceState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handleDeviceIds(deviceState.Device.GroupID, deviceState.Device.ModelID)
 	c.handleAttributes(deviceState.Device.Attr)
-	c.notifyState()
+	c.stateReceived()
+	c.notifier.UpdateState(c.snapshot())
 }
 
-func (c *SamsungAC2878) notifyState() {
-	if c.stateNotifier == nil {
-		fmt.Println("Error: want to notify state, but no notifer defined")
-		return
+func (c *SamsungAC2878) Snapshot() base.State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.snapshot()
+}
+
+// snapshot translates the attributes reported by the unit to a State.
+func (c *SamsungAC2878) snapshot() base.State {
+	state := base.State{
+		Power:              strings.EqualFold(c.powerMode, "On"),
+		Mode:               base.Mode(OpModeFromAC(c.opMode)),
+		FanMode:            FanModeFromAC(c.fanMode),
+		Setpoint:           parseTemperature(c.temperature),
+		CurrentTemperature: parseTemperature(c.currentTemperature),
+		Extras:             make(map[string]string, len(c.attrs)),
 	}
-	if strings.ToLower(c.powerMode) == "off" {
-		c.stateNotifier.UpdateOpMode(OpModeFromAC("Off"))
-	} else {
-		c.stateNotifier.UpdateOpMode(OpModeFromAC(c.opMode))
+	if c.swingMode != "" {
+		state.SwingMode = SwingModeFromAC(c.swingMode)
+	}
+	if c.presetMode != "" {
+		state.PresetMode = fromAc(c.presetMode, c.presetModeTable)
+	}
+	for id, value := range c.attrs {
+		state.Extras[id] = value
+	}
+	state.Action = c.action(state)
+	return state
+}
+
+func parseTemperature(value string) *float64 {
+	temperature, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	return &temperature
+}
+
+// action derives what the unit is currently doing from its mode, the
+// temperatures and, if configured, the compressor state.
+func (c *SamsungAC2878) action(state base.State) base.Action {
+	switch state.EffectiveMode() {
+	case base.ModeOff:
+		return base.ActionOff
+	case base.ModeFanOnly:
+		return base.ActionFan
+	}
+	if c.compressorAttr != "" {
+		if running, ok := c.attrs[c.compressorAttr]; ok && !attrIsOn(running) {
+			return base.ActionIdle
+		}
+	}
+	if state.Mode == base.ModeDry {
+		return base.ActionDrying
+	}
+	if state.Setpoint == nil || state.CurrentTemperature == nil {
+		switch state.Mode {
+		case base.ModeCool:
+			return base.ActionCooling
+		case base.ModeHeat:
+			return base.ActionHeating
+		}
+		return base.ActionIdle
+	}
+	setpoint, current := *state.Setpoint, *state.CurrentTemperature
+	switch state.Mode {
+	case base.ModeCool, base.ModeAuto:
+		if current >= setpoint+c.actionDeadband {
+			return base.ActionCooling
+		}
+	}
+	switch state.Mode {
+	case base.ModeHeat, base.ModeAuto:
+		if current <= setpoint-c.actionDeadband {
+			return base.ActionHeating
+		}
+	}
+	return base.ActionIdle
+}
+
+// attrIsOn interprets an On/Off or numeric attribute value.
+func attrIsOn(value string) bool {
+	switch strings.ToLower(value) {
+	case "on", "true":
+		return true
+	case "off", "false", "":
+		return false
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	return err != nil || number != 0
+}
+
+// handleDeviceIds records the unit's group and model, which are reported
+// along with the other attributes.
+func (c *SamsungAC2878) handleDeviceIds(groupID, modelID string) {
+	if groupID != "" {
+		c.attrs["GroupID"] = groupID
+	}
+	if modelID != "" {
+		c.attrs["ModelID"] = modelID
 	}
-	c.stateNotifier.UpdateFanMode(FanModeFromAC(c.fanMode))
-	c.stateNotifier.UpdateTemperature(c.temperature)
-	c.stateNotifier.UpdateCurrentTemperature(c.currentTemperature)
-	c.stateNotifier.UpdateAttributes(c.attrs)
 }
 
 func (c *SamsungAC2878) handleAttributes(attrs []Attr) {
 	for _, attr := range attrs {
-		c.attrs[attr.Type] = attr.Value
+		c.attrs[attr.ID] = attr.Value
 		switch attr.ID {
 		case "AC_FUN_POWER":
 			c.powerMode = attr.Value
@@ -278,13 +530,40 @@ func (c *SamsungAC2878) handleAttributes(attrs []Attr) {
 			c.currentTemperature = attr.Value
 		case "AC_FUN_WINDLEVEL":
 			c.fanMode = attr.Value
+		case "AC_FUN_DIRECTION":
+			c.swingMode = attr.Value
+		case "AC_FUN_COMODE":
+			c.presetMode = attr.Value
 		}
 	}
 }
 
-func (c *SamsungAC2878) sendMessage(messageTemplate *template.Template, data map[string]string) {
-	var buf bytes.Buffer
-	messageTemplate.Execute(&buf, data)
-	log.Printf("sending request to %s [%s]\n", c.name, buf.String())
-	c.connection.SendMessage(buf.Bytes())
+// sendCommand sends a DeviceControl request, reporting its result once the
+// device responds or immediately if it cannot be sent.
+func (c *SamsungAC2878) sendCommand(command, value string, messageTemplate *template.Template, data map[string]string) {
+	c.sendCommands(command, value, string(renderMessage(messageTemplate, data)))
+}
+
+// sendCommands sends the DeviceControl requests of a command. The result is
+// reported when the last one is answered.
+func (c *SamsungAC2878) sendCommands(command, value string, messages ...string) {
+	result := base.CommandResult{
+		Command: command,
+		Value:   value,
+	}
+	// Not holding the mutex, as the response may be handled before sending
+	// returns.
+	if err := c.gateway.sendCommands(c, result, messages...); err != nil {
+		// The responses to the requests already sent are not reported, as
+		// none of them is the last.
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.notifier.UpdateCommandResult(result, err.Error(), false)
+	}
+}
+
+func (c *SamsungAC2878) sendMessage(messageTemplate *template.Template, data map[string]string) error {
+	message := renderMessage(messageTemplate, data)
+	log.Printf("sending request to %s [%s]\n", c.name, string(message))
+	return c.gateway.connection.SendMessage(message)
 }
@@ -0,0 +1,419 @@
+package samsung
+
+import (
+	"fmt"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base/basetest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFakeConnection returns a connection answering requests like a unit.
+func newFakeConnection() *basetest.Connection {
+	return &basetest.Connection{
+		Greeting: []string{"DPLUG-1.6", `<Update Type="InvalidateAccount"/>`},
+		Answer: func(request string) []string {
+			switch {
+			case strings.Contains(request, `Type="AuthToken"`):
+				return []string{`<Response Type="AuthToken" Status="Okay"/>`}
+			case strings.Contains(request, `Type="DeviceState"`):
+				return []string{`<Response Type="DeviceState" Status="Okay"><DeviceState><Device DUID="112233445566"><Attr ID="AC_FUN_POWER" Value="On"/><Attr ID="AC_FUN_OPMODE" Value="Cool"/></Device></DeviceState></Response>`}
+			case strings.Contains(request, `Type="DeviceControl"`):
+				return []string{`<Response Type="DeviceControl" Status="Okay" DUID="112233445566"/>`}
+			}
+			return nil
+		},
+	}
+}
+
+// newTestUnit returns a unit on a gateway using the connection.
+func newTestUnit(t *testing.T, connection base.Connection) (*SamsungAC2878, *basetest.Recorder) {
+	g := newGateway("fake", t.Name(), "token", base.ConnectionOptions{}, connection)
+	unit := &SamsungAC2878{
+		name:            "test",
+		duid:            "112233445566",
+		presetModeTable: newPresetModeTable(nil),
+		actionDeadband:  0.5,
+		gateway:         g,
+		attrs:           make(map[string]string),
+	}
+	return unit, basetest.NewRecorder(unit)
+}
+
+func TestConcurrentCommandsAndUpdates(t *testing.T) {
+	connection := newFakeConnection()
+	unit, notifier := newTestUnit(t, connection)
+	unit.Connect()
+
+	const workers, commands = 4, 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < commands; j++ {
+				if j%2 == 0 {
+					unit.SetMode(base.ModeHeat)
+				} else {
+					unit.SetTemperature(float64(16 + (i+j)%14))
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < commands; j++ {
+			unit.gateway.HandleMessage([]byte(fmt.Sprintf(
+				`<Update Type="Status"><Status DUID="112233445566"><Attr ID="AC_FUN_TEMPNOW" Value="%d"/></Status></Update>`, 20+j%5)))
+			if j%10 == 0 {
+				unit.gateway.OnConnectionLost()
+			}
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < commands; j++ {
+			unit.Snapshot()
+			unit.Capabilities()
+		}
+	}()
+	wg.Wait()
+
+	// Every command is answered by the fake or failed by a lost connection.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(notifier.Results()) < workers*commands && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	unit.Close()
+	if got := len(notifier.Results()); got != workers*commands {
+		t.Errorf("got %d command results, want %d", got, workers*commands)
+	}
+	state := unit.Snapshot()
+	if state.CurrentTemperature == nil {
+		t.Errorf("current temperature not reported: %+v", state)
+	}
+}
+
+func TestCommandResultsInOrder(t *testing.T) {
+	connection := newFakeConnection()
+	unit, notifier := newTestUnit(t, connection)
+	unit.Connect()
+	unit.SetFanMode("low")
+	unit.SetTemperature(22)
+	notifier.WaitFor(t, 0, 2)
+	unit.Close()
+
+	results := notifier.Results()
+	if len(results) != 2 {
+		t.Fatalf("got results %+v, want 2", results)
+	}
+	for i, command := range []string{"fan_mode", "temperature"} {
+		result := results[i]
+		if result.Command != command || !result.Success {
+			t.Errorf("result %d is %+v, want successful %s", i, result, command)
+		}
+	}
+	var controls []string
+	for _, message := range connection.Sent() {
+		if strings.Contains(message, "DeviceControl") {
+			controls = append(controls, message)
+		}
+	}
+	if len(controls) != 2 || !strings.Contains(controls[0], `AC_FUN_WINDLEVEL" Value="Low"`) ||
+		!strings.Contains(controls[1], `AC_FUN_TEMPSET" Value="22"`) {
+		t.Errorf("sent %q", controls)
+	}
+}
+
+// answeringConnection answers DeviceControl requests before SendMessage
+// returns, as the message loop of a real connection may.
+type answeringConnection struct {
+	*basetest.Connection
+	answer func(request string) string
+}
+
+func (c *answeringConnection) SendMessage(message []byte) error {
+	c.Connection.SendMessage(message)
+	if strings.Contains(string(message), `Type="DeviceControl"`) {
+		c.Deliver(c.answer(string(message)))
+	}
+	return nil
+}
+
+func TestCommandAnsweredBeforeSent(t *testing.T) {
+	connection := &answeringConnection{
+		Connection: &basetest.Connection{},
+		// Only the first unit's responses name its DUID.
+		answer: func(request string) string {
+			if strings.Contains(request, `DUID="112233445566"`) {
+				return `<Response Type="DeviceControl" Status="Okay" DUID="112233445566"/>`
+			}
+			return `<Response Type="DeviceControl" Status="Okay"/>`
+		},
+	}
+	g := newGateway("fake", t.Name(), "token", base.ConnectionOptions{}, connection)
+	var units []*SamsungAC2878
+	var recorders []*basetest.Recorder
+	for _, duid := range []string{"112233445566", "AABBCCDDEEFF"} {
+		unit := &SamsungAC2878{
+			name:            duid,
+			duid:            duid,
+			presetModeTable: newPresetModeTable(nil),
+			gateway:         g,
+			attrs:           make(map[string]string),
+		}
+		recorders = append(recorders, basetest.NewRecorder(unit))
+		unit.Connect()
+		defer unit.Close()
+		units = append(units, unit)
+	}
+
+	units[0].SetTemperature(22)
+	units[1].SetTemperature(23)
+	units[1].SetFanMode("low")
+	for i, want := range []int{1, 2} {
+		results := recorders[i].Results()
+		if len(results) != want {
+			t.Errorf("Results of %s = %+v, want %d", units[i].name, results, want)
+		}
+		for _, result := range results {
+			if !result.Success {
+				t.Errorf("Result of %s = %+v, want success", units[i].name, result)
+			}
+		}
+	}
+}
+
+func TestGatewaySharedByUnits(t *testing.T) {
+	options := base.ConnectionOptions{ReadTimeout: time.Second}
+	g, err := getGateway("fake", t.Name(), "token", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err := getGateway("fake", t.Name(), "", options); err != nil || other != g {
+		t.Errorf("Second unit got %p, %v, want the shared gateway", other, err)
+	}
+	if _, err := getGateway("fake", t.Name(), "other", options); err == nil {
+		t.Errorf("Conflicting auth_token accepted")
+	}
+	if _, err := getGateway("fake", t.Name(), "token", base.ConnectionOptions{}); err == nil {
+		t.Errorf("Conflicting connection options accepted")
+	}
+
+	g.connection = newFakeConnection()
+	unit := &SamsungAC2878{
+		name:            "test",
+		duid:            "112233445566",
+		presetModeTable: newPresetModeTable(nil),
+		gateway:         g,
+		attrs:           make(map[string]string),
+	}
+	basetest.NewRecorder(unit)
+	unit.Connect()
+	unit.Close()
+	// The gateway is forgotten with its last unit.
+	other, err := getGateway("fake", t.Name(), "token", base.ConnectionOptions{})
+	if err != nil || other == g {
+		t.Fatalf("Unit after the last was closed got %p, %v, want a new gateway", other, err)
+	}
+	gateways.Remove(other.address(), other)
+}
+
+func TestSetModeTurnsOn(t *testing.T) {
+	connection := newFakeConnection()
+	unit, notifier := newTestUnit(t, connection)
+	unit.Connect()
+	unit.SetMode(base.ModeCool)
+	notifier.WaitFor(t, 0, 1)
+	unit.Close()
+	sent := controls(connection)
+	if len(sent) != 2 || !strings.Contains(sent[0], `AC_FUN_OPMODE" Value="Cool"`) ||
+		!strings.Contains(sent[1], `AC_FUN_POWER" Value="On"`) {
+		t.Errorf("Sent %q, want the mode then power on", sent)
+	}
+	if results := notifier.Results(); len(results) != 1 || !results[0].Success || results[0].Command != "mode" {
+		t.Errorf("Results = %+v, want one successful mode result", results)
+	}
+}
+
+func TestSnapshotPower(t *testing.T) {
+	unit, _ := newTestUnit(t, newFakeConnection())
+	for _, test := range []struct {
+		powerMode string
+		want      bool
+	}{
+		{"On", true},
+		{"on", true},
+		{"Off", false},
+		{"", false},
+		{"Unknown", false},
+	} {
+		unit.powerMode = test.powerMode
+		if got := unit.Snapshot().Power; got != test.want {
+			t.Errorf("Power for %q = %v, want %v", test.powerMode, got, test.want)
+		}
+	}
+}
+
+func controls(connection *basetest.Connection) []string {
+	var controls []string
+	for _, message := range connection.Sent() {
+		if strings.Contains(message, "DeviceControl") {
+			controls = append(controls, message)
+		}
+	}
+	return controls
+}
+
+func TestGatewayRoutesByNormalizedDUID(t *testing.T) {
+	var units []*SamsungAC2878
+	for _, duid := range []string{"11:22:33:44:55:66", "aa-bb-cc-dd-ee-ff"} {
+		unit, err := NewSamsungAC2878(duid, "fake", t.Name(), duid, "token", nil, 0.5, "", base.ConnectionOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		basetest.NewRecorder(unit)
+		units = append(units, unit)
+	}
+	g := units[0].gateway
+	if units[1].gateway != g {
+		t.Fatalf("Units at the same address got different gateways")
+	}
+	connection := newFakeConnection()
+	g.connection = connection
+	for _, unit := range units {
+		unit.Connect()
+		defer unit.Close()
+	}
+
+	g.HandleMessage([]byte(`<Update Type="Status"><Status DUID="AABBCCDDEEFF"><Attr ID="AC_FUN_TEMPNOW" Value="23"/></Status></Update>`))
+	if state := units[1].Snapshot(); state.CurrentTemperature == nil || *state.CurrentTemperature != 23 {
+		t.Errorf("State of %s = %+v, want the routed temperature", units[1].name, state)
+	}
+	if state := units[0].Snapshot(); state.CurrentTemperature != nil && *state.CurrentTemperature == 23 {
+		t.Errorf("Update for AABBCCDDEEFF routed to %s", units[0].name)
+	}
+
+	units[1].SetTemperature(22)
+	found := false
+	for _, message := range controls(connection) {
+		if strings.Contains(message, `DUID="AABBCCDDEEFF"`) && strings.Contains(message, `AC_FUN_TEMPSET" Value="22"`) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Sent %q, want a temperature command with the normalized DUID", controls(connection))
+	}
+}
+
+func TestSwingModes(t *testing.T) {
+	connection := newFakeConnection()
+	unit, notifier := newTestUnit(t, connection)
+	unit.Connect()
+	defer unit.Close()
+	notifier.WaitFor(t, 1, 0)
+	for i, test := range []struct {
+		swingMode string
+		device    string
+	}{
+		{"off", "Fixed"},
+		{"vertical", "SwingUD"},
+		{"horizontal", "SwingLR"},
+		{"both", "Rotation"},
+	} {
+		unit.SetSwingMode(test.swingMode)
+		notifier.WaitFor(t, 0, i+1)
+		sent := controls(connection)
+		if want := `AC_FUN_DIRECTION" Value="` + test.device + `"`; !strings.Contains(sent[len(sent)-1], want) {
+			t.Errorf("SetSwingMode(%q) sent %q, want %s", test.swingMode, sent[len(sent)-1], want)
+		}
+
+		unit.gateway.HandleMessage([]byte(`<Update Type="Status"><Status DUID="112233445566"><Attr ID="AC_FUN_DIRECTION" Value="` + test.device + `"/></Status></Update>`))
+		states := notifier.States()
+		if got := states[len(states)-1].SwingMode; got != test.swingMode {
+			t.Errorf("Swing mode for %q = %q, want %q", test.device, got, test.swingMode)
+		}
+	}
+}
+
+func TestPresetModes(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		presets    map[string]string
+		presetMode string
+		device     string
+	}{
+		{"default none", nil, "none", "Off"},
+		{"default boost", nil, "boost", "TurboMode"},
+		{"default windfree", nil, "windfree", "WindMode1"},
+		{"configured", map[string]string{"eco": "Eco"}, "eco", "Eco"},
+		{"configured none added", map[string]string{"eco": "Eco"}, "none", "Off"},
+		{"configured none replaced", map[string]string{"none": "Normal"}, "none", "Normal"},
+	} {
+		connection := newFakeConnection()
+		unit, notifier := newTestUnit(t, connection)
+		unit.presetModeTable = newPresetModeTable(test.presets)
+		unit.Connect()
+		unit.SetPresetMode(test.presetMode)
+		notifier.WaitFor(t, 1, 1)
+		sent := controls(connection)
+		if want := `AC_FUN_COMODE" Value="` + test.device + `"`; len(sent) != 1 || !strings.Contains(sent[0], want) {
+			t.Errorf("%s: SetPresetMode(%q) sent %q, want %s", test.name, test.presetMode, sent, want)
+		}
+
+		unit.gateway.HandleMessage([]byte(`<Update Type="Status"><Status DUID="112233445566"><Attr ID="AC_FUN_COMODE" Value="` + test.device + `"/></Status></Update>`))
+		states := notifier.States()
+		if got := states[len(states)-1].PresetMode; got != test.presetMode {
+			t.Errorf("%s: preset mode for %q = %q, want %q", test.name, test.device, got, test.presetMode)
+		}
+		unit.Close()
+	}
+}
+
+func TestAction(t *testing.T) {
+	unit, _ := newTestUnit(t, newFakeConnection())
+	for _, test := range []struct {
+		name       string
+		power      string
+		mode       string
+		setpoint   string
+		current    string
+		compressor string
+		want       base.Action
+	}{
+		{"off", "Off", "Cool", "22", "25", "", base.ActionOff},
+		{"fan", "On", "Wind", "22", "25", "", base.ActionFan},
+		{"dry", "On", "Dry", "22", "25", "", base.ActionDrying},
+		{"cooling", "On", "Cool", "22", "25", "", base.ActionCooling},
+		{"cooling within deadband", "On", "Cool", "22", "22.4", "", base.ActionIdle},
+		{"cooling at deadband", "On", "Cool", "22", "22.5", "", base.ActionCooling},
+		{"cooling reached", "On", "Cool", "22", "21", "", base.ActionIdle},
+		{"heating", "On", "Heat", "22", "20", "", base.ActionHeating},
+		{"heating within deadband", "On", "Heat", "22", "21.6", "", base.ActionIdle},
+		{"auto cooling", "On", "Auto", "22", "24", "", base.ActionCooling},
+		{"auto heating", "On", "Auto", "22", "20", "", base.ActionHeating},
+		{"auto idle", "On", "Auto", "22", "22", "", base.ActionIdle},
+		{"no current temperature", "On", "Cool", "22", "", "", base.ActionCooling},
+		{"compressor off", "On", "Cool", "22", "25", "Off", base.ActionIdle},
+		{"compressor on", "On", "Cool", "22", "25", "On", base.ActionCooling},
+		{"compressor off when off", "Off", "Cool", "22", "25", "Off", base.ActionOff},
+	} {
+		unit.powerMode = test.power
+		unit.opMode = test.mode
+		unit.temperature = test.setpoint
+		unit.currentTemperature = test.current
+		unit.compressorAttr = ""
+		delete(unit.attrs, "AC_COMP")
+		if test.compressor != "" {
+			unit.compressorAttr = "AC_COMP"
+			unit.attrs["AC_COMP"] = test.compressor
+		}
+		if got := unit.Snapshot().Action; got != test.want {
+			t.Errorf("%s: Action = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
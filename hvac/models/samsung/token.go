@@ -0,0 +1,115 @@
+package samsung
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"log"
+	"strings"
+)
+
+const getTokenRequest = `<Request Type="GetToken" />
+`
+
+// tokenMessage covers the Update and Response messages of the GetToken exchange.
+type tokenMessage struct {
+	XMLName   xml.Name
+	Type      string `xml:"Type,attr"`
+	Status    string `xml:"Status,attr"`
+	Token     string `xml:"Token,attr"`
+	ErrorCode string `xml:"ErrorCode,attr"`
+}
+
+// tokenReceiver requests a token once the unit asks for authentication and
+// waits for the unit to hand it out.
+type tokenReceiver struct {
+	connection base.Connection
+	ready      chan struct{}
+	tokens     chan string
+	errors     chan error
+}
+
+func (r *tokenReceiver) OnConnectionEstablished() {
+	r.connection.ExpectRead()
+}
+
+func (r *tokenReceiver) OnConnectionLost() {
+	log.Printf("Connection lost while getting token, reconnecting")
+}
+
+func (r *tokenReceiver) HandleMessage(message []byte) {
+	if strings.TrimSpace(string(message)) == "DPLUG-1.6" {
+		r.connection.ExpectRead()
+		return
+	}
+	var msg tokenMessage
+	if err := xml.Unmarshal(message, &msg); err != nil {
+		log.Printf("Cannot parse message while getting token: %s", string(message))
+		return
+	}
+	switch {
+	case msg.XMLName.Local == "Update" && msg.Type == "InvalidateAccount":
+		if err := r.connection.SendMessage([]byte(getTokenRequest)); err != nil {
+			r.fail(err)
+		}
+	case msg.XMLName.Local == "Response" && msg.Type == "GetToken":
+		if msg.Status == "Ready" {
+			select {
+			case r.ready <- struct{}{}:
+			default:
+			}
+		} else {
+			r.fail(fmt.Errorf("unit refused token request: %s %s", msg.Status, msg.ErrorCode))
+		}
+	case msg.XMLName.Local == "Update" && msg.Type == "GetToken":
+		if msg.Status == "Completed" && msg.Token != "" {
+			select {
+			case r.tokens <- msg.Token:
+			default:
+			}
+		} else {
+			r.fail(fmt.Errorf("token not issued: %s %s", msg.Status, msg.ErrorCode))
+		}
+	}
+}
+
+func (r *tokenReceiver) fail(err error) {
+	select {
+	case r.errors <- err:
+	default:
+	}
+}
+
+// GetToken connects to a unit and requests an authentication token. The unit
+// only issues the token after being powered on, so prompt is called once it
+// is waiting for that.
+func GetToken(ctx context.Context, host, port string, options base.ConnectionOptions, prompt func()) (string, error) {
+	if port == "" {
+		port = "2878"
+	}
+	connection, err := base.NewTLSSocketConnection(withDefaultTLSOptions(options), base.NewXMLFramer)
+	if err != nil {
+		return "", err
+	}
+	receiver := &tokenReceiver{
+		connection: connection,
+		ready:      make(chan struct{}, 1),
+		tokens:     make(chan string, 1),
+		errors:     make(chan error, 1),
+	}
+	connection.Connect(host, port, receiver)
+	defer connection.Close()
+	for {
+		select {
+		case <-receiver.ready:
+			prompt()
+		case token := <-receiver.tokens:
+			return token, nil
+		case err := <-receiver.errors:
+			return "", err
+		case <-ctx.Done():
+			return "", fmt.Errorf("no token received from %s:%s: %s", host, port, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package samsung
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base"
+	"github.com/gsasha/hvac_ip_mqtt_bridge/hvac/base/basetest"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeUnit is a TLS listener speaking the start of the 2878 protocol. Once
+// asked for a token, it sends answer and then, when release is closed, the
+// update.
+type fakeUnit struct {
+	listener net.Listener
+	answer   string
+	update   string
+	release  chan struct{}
+}
+
+func newFakeUnit(t *testing.T, answer, update string) *fakeUnit {
+	certificate := newCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &fakeUnit{
+		listener: listener,
+		answer:   answer,
+		update:   update,
+		release:  make(chan struct{}),
+	}
+	go u.serve()
+	return u
+}
+
+func (u *fakeUnit) serve() {
+	conn, err := u.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("DPLUG-1.6\n"))
+	conn.Write([]byte(`<?xml version="1.0" encoding="utf-8" ?><Update Type="InvalidateAccount"/>` + "\n"))
+	lines := bufio.NewScanner(conn)
+	for lines.Scan() {
+		if !strings.Contains(lines.Text(), `Type="GetToken"`) {
+			continue
+		}
+		conn.Write([]byte(u.answer + "\n"))
+		select {
+		case <-u.release:
+		case <-time.After(5 * time.Second):
+			return
+		}
+		if u.update != "" {
+			conn.Write([]byte(u.update + "\n"))
+		}
+		// Hold the connection open until the client closes it.
+		for lines.Scan() {
+		}
+		return
+	}
+}
+
+func (u *fakeUnit) Close() {
+	u.listener.Close()
+}
+
+// newCertificate returns a self-signed certificate, as units present.
+func newCertificate(t *testing.T) tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake unit"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// testOptions connects with TLS 1.2, as the test listener does not offer the
+// TLS 1.0 spoken by units.
+var testOptions = base.ConnectionOptions{
+	TLS: base.TLSOptions{MinVersion: "1.2", MaxVersion: "1.2"},
+}
+
+func TestGetToken(t *testing.T) {
+	unit := newFakeUnit(t,
+		`<Response Type="GetToken" Status="Ready"/>`,
+		`<Update Type="GetToken" Status="Completed" Token="33693adc-2a8a-4b4c-a7f6-8d6d5dd4f5b4"/>`)
+	defer unit.Close()
+	host, port := basetest.HostPort(t, unit.listener.Addr())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	prompts := 0
+	token, err := GetToken(ctx, host, port, testOptions, func() {
+		// The unit hands out the token once powered on.
+		prompts++
+		close(unit.release)
+	})
+	if err != nil {
+		t.Fatalf("GetToken failed: %s", err)
+	}
+	if token != "33693adc-2a8a-4b4c-a7f6-8d6d5dd4f5b4" {
+		t.Errorf("got token %q", token)
+	}
+	if prompts != 1 {
+		t.Errorf("prompted %d times, want once", prompts)
+	}
+}
+
+func TestGetTokenRefused(t *testing.T) {
+	unit := newFakeUnit(t, `<Response Type="GetToken" Status="Fail" ErrorCode="301"/>`, "")
+	defer unit.Close()
+	defer close(unit.release)
+	host, port := basetest.HostPort(t, unit.listener.Addr())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	token, err := GetToken(ctx, host, port, testOptions, func() {
+		t.Error("prompted after refusal")
+	})
+	if err == nil || !strings.Contains(err.Error(), "301") {
+		t.Errorf("got token %q and error %v, want refusal", token, err)
+	}
+}
+
+func TestGetTokenTimeout(t *testing.T) {
+	unit := newFakeUnit(t, `<Response Type="GetToken" Status="Ready"/>`, "")
+	defer unit.Close()
+	defer close(unit.release)
+	host, port := basetest.HostPort(t, unit.listener.Addr())
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	prompted := make(chan struct{}, 1)
+	token, err := GetToken(ctx, host, port, testOptions, func() {
+		prompted <- struct{}{}
+	})
+	if err == nil {
+		t.Fatalf("got token %q, want timeout", token)
+	}
+	select {
+	case <-prompted:
+	default:
+		t.Error("not prompted before timing out")
+	}
+}